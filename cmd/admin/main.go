@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/store"
+)
+
+const usage = `usage: admin <command>
+
+commands:
+  reindex-search                    rebuild the package full-text search index
+  normalize-names                   store normalized names for packages that
+                                    predate them, listing any that collide
+  rename-package <id> <name>        rename a package, e.g. to resolve a collision
+  create-admin <username> [email]   make an existing user a site admin, or create
+                                    one with email; the password is read from
+                                    EBUILD_ADMIN_PASSWORD or the first line of stdin`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	dbPath := os.Getenv("DEV_DB")
+	if dbPath == "" {
+		dbPath = "dev.db"
+	}
+
+	db, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	s := store.New(db)
+	if err := s.CheckFTS5(); err != nil {
+		log.Fatalf("search index: %v", err)
+	}
+	switch os.Args[1] {
+	case "reindex-search":
+		stats, err := s.RebuildSearchIndex()
+		if err != nil {
+			log.Fatalf("reindex failed: %v", err)
+		}
+		fmt.Printf("indexed %d of %d packages (%d distinct terms)\n", stats.Indexed, stats.Packages, stats.Terms)
+	case "normalize-names":
+		n, err := s.NormalizePackageNames()
+		if err != nil {
+			log.Fatalf("normalize-names failed: %v", err)
+		}
+		fmt.Printf("normalized %d package names\n", n)
+	case "rename-package":
+		if len(os.Args) != 4 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		id, err := strconv.ParseInt(os.Args[2], 10, 64)
+		if err != nil {
+			log.Fatalf("invalid package id %q", os.Args[2])
+		}
+		if err := s.RenamePackage(id, os.Args[3]); err != nil {
+			log.Fatalf("rename-package failed: %v", err)
+		}
+		fmt.Printf("package %d is now %s\n", id, os.Args[3])
+	case "create-admin":
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		username := os.Args[2]
+		var email, hash string
+		if len(os.Args) == 4 {
+			email = os.Args[3]
+			pw, err := adminPassword()
+			if err != nil {
+				log.Fatalf("reading password: %v", err)
+			}
+			pc := auth.PasswordConfigFromEnv()
+			if err := pc.Validate(pw, username); err != nil {
+				log.Fatalf("password rejected: %v", err)
+			}
+			if hash, err = pc.Hash(pw); err != nil {
+				log.Fatalf("hashing password: %v", err)
+			}
+		}
+		id, created, err := s.EnsureAdmin(username, email, hash)
+		if err != nil {
+			log.Fatalf("create-admin failed: %v", err)
+		}
+		if created {
+			fmt.Printf("created admin %s (id %d)\n", username, id)
+		} else {
+			fmt.Printf("%s (id %d) is now an admin\n", username, id)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// adminPassword reads the new admin's password without putting it on the
+// command line, where it would end up in shell history.
+func adminPassword() (string, error) {
+	if pw := os.Getenv("EBUILD_ADMIN_PASSWORD"); pw != "" {
+		return pw, nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 
 	"ebuild/internal/api"
+	"ebuild/internal/mail"
+	"ebuild/internal/store"
+	"ebuild/internal/webhook"
 )
 
 func main() {
@@ -22,10 +31,47 @@ func main() {
 	}
 	defer db.Close()
 
+	st := store.New(db)
+	if err := st.CheckFTS5(); err != nil {
+		log.Fatalf("search index: %v", err)
+	}
+	if _, err := st.NormalizePackageNames(); err != nil {
+		log.Fatalf("package names: %v", err)
+	}
+
 	signingKey := []byte("dev-signing-key")
 
-	r := api.SetupRouter(db, signingKey)
+	// download counts are written in batches of up to 500, at least every second
+	downloads := store.New(db).NewDownloadQueue(10000, 500, time.Second)
+
+	// EBUILD_WEBHOOK_ALLOW_PRIVATE=1 lets webhooks reach receivers on
+	// localhost, for development
+	hooks := webhook.NewDispatcher(db, webhook.Options{AllowPrivate: os.Getenv("EBUILD_WEBHOOK_ALLOW_PRIVATE") == "1"})
 
-	log.Println("starting server on :8080")
-	r.Run(":8080")
+	r := api.SetupRouter(db, signingKey, mail.FromEnv(), downloads)
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	srv.RegisterOnShutdown(api.CloseEventStreams)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Println("starting server on :8080")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server: %v", err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+
+	// finish in-flight requests first, so nothing is pushed after Close
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := downloads.Close(); err != nil {
+		log.Printf("flushing download counts: %v", err)
+	}
+	hooks.Close()
 }
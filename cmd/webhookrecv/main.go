@@ -0,0 +1,54 @@
+// Command webhookrecv is a webhook receiver for local development. It checks
+// each delivery's X-Ebuild-Signature against WEBHOOK_SECRET and logs the
+// event, so webhooks can be tried without a public endpoint.
+//
+// Run the server with EBUILD_WEBHOOK_ALLOW_PRIVATE=1 and register
+//
+//	http://localhost:9100/
+//
+// with the same secret. WEBHOOK_FAIL=1 answers every delivery with 500, to
+// watch retries.
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"ebuild/internal/webhook"
+)
+
+func main() {
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("WEBHOOK_SECRET is required")
+	}
+	addr := os.Getenv("WEBHOOK_ADDR")
+	if addr == "" {
+		addr = ":9100"
+	}
+	fail := os.Getenv("WEBHOOK_FAIL") == "1"
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := webhook.Verify(secret, r.Header.Get("X-Ebuild-Signature"), body, 5*time.Minute, time.Now()); err != nil {
+			log.Printf("delivery %s rejected: %v", r.Header.Get("X-Ebuild-Delivery"), err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		log.Printf("delivery %s %s: %s", r.Header.Get("X-Ebuild-Delivery"), r.Header.Get("X-Ebuild-Event"), body)
+		if fail {
+			http.Error(w, "failing on purpose", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	log.Printf("receiving webhooks on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
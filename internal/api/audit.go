@@ -0,0 +1,19 @@
+package api
+
+import (
+	"database/sql"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// auditEvent appends to audit_log. The actor is the authenticated caller, if
+// any. Like token_audit writes, failures are ignored so auditing never
+// blocks the action itself.
+func auditEvent(db *sqlx.DB, c *gin.Context, action, targetType string, targetID int64, meta string) {
+	var actor sql.NullInt64
+	if claims := claimsFrom(c); claims != nil {
+		actor = sql.NullInt64{Int64: claims.UserID, Valid: true}
+	}
+	_, _ = db.Exec(`INSERT INTO audit_log (action, actor_user_id, target_type, target_id, ip, meta) VALUES (?, ?, ?, ?, ?, ?)`, action, actor, targetType, targetID, c.ClientIP(), meta)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// Registry events, as stored in registry_events and sent to webhooks.
+const (
+	EventVersionPublished  = "version.published"
+	EventVersionYanked     = "version.yanked"
+	EventVersionDeprecated = "version.deprecated"
+	EventArtifactAdded     = "artifact.added"
+	EventMaintainerChanged = "maintainer.changed"
+)
+
+var webhookEvents = map[string]bool{
+	EventVersionPublished:  true,
+	EventVersionYanked:     true,
+	EventVersionDeprecated: true,
+	EventArtifactAdded:     true,
+	EventMaintainerChanged: true,
+}
+
+type eventPackage struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type eventPayload struct {
+	ID        int64        `json:"id"`
+	Event     string       `json:"event"`
+	Package   eventPackage `json:"package"`
+	Data      gin.H        `json:"data"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// recordEvent appends an event about the package to registry_events and
+// queues a delivery for every active webhook subscribed to it. Failures are
+// logged: the change the event describes has already happened.
+func recordEvent(db *sqlx.DB, event string, pkgID int64, data gin.H) {
+	if err := insertEvent(db, event, pkgID, data); err != nil {
+		log.Printf("record event %s for package %d: %v", event, pkgID, err)
+		return
+	}
+	streams.notify()
+}
+
+func insertEvent(db *sqlx.DB, event string, pkgID int64, data gin.H) error {
+	var pkg struct {
+		Name  string `db:"name"`
+		OrgID *int64 `db:"org_id"`
+	}
+	if err := db.Get(&pkg, `SELECT name, org_id FROM packages WHERE id = ?`, pkgID); err != nil {
+		return err
+	}
+	var hooks []struct {
+		ID        int64             `db:"id"`
+		OwnerID   int64             `db:"owner_user_id"`
+		PackageID *int64            `db:"package_id"`
+		OrgID     *int64            `db:"org_id"`
+		Events    models.StringList `db:"events"`
+	}
+	err := db.Select(&hooks, `SELECT id, owner_user_id, package_id, org_id, events FROM webhooks
+		WHERE active = 1 AND (package_id = ? OR org_id = ? OR (package_id IS NULL AND org_id IS NULL))`, pkgID, pkg.OrgID)
+	if err != nil {
+		return err
+	}
+	var targets []int64
+	for _, h := range hooks {
+		if containsString(h.Events, event) && webhookOwnerMaySee(db, h.OwnerID, pkgID, h.PackageID, h.OrgID) {
+			targets = append(targets, h.ID)
+		}
+	}
+
+	p := eventPayload{Event: event, Package: eventPackage{ID: pkgID, Name: pkg.Name}, Data: data, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// the id is part of the payload, so insert first and fill it in
+	if err := tx.Get(&p.ID, `INSERT INTO registry_events (event, package_id, payload, created_at) VALUES (?, ?, '', ?) RETURNING id`, event, pkgID, p.CreatedAt.Format("2006-01-02 15:04:05")); err != nil {
+		return err
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE registry_events SET payload = ? WHERE id = ?`, string(body), p.ID); err != nil {
+		return err
+	}
+	for _, id := range targets {
+		if _, err := tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload) VALUES (?, ?, ?, ?)`, id, p.ID, event, string(body)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// eventHub wakes the open event streams when an event has been recorded;
+// they then read it from registry_events like any other.
+type eventHub struct {
+	mu        sync.Mutex
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var streams = &eventHub{wake: make(chan struct{}), closed: make(chan struct{})}
+
+// wait returns a channel closed at the next notify.
+func (h *eventHub) wait() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.wake
+}
+
+func (h *eventHub) notify() {
+	h.mu.Lock()
+	close(h.wake)
+	h.wake = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// CloseEventStreams ends all open event streams, which would otherwise
+// hold up a graceful shutdown. Clients reconnect and resume with
+// Last-Event-ID.
+func CloseEventStreams() {
+	streams.closeOnce.Do(func() { close(streams.closed) })
+}
+
+// webhookOwnerMaySee re-checks, for every event, that the webhook's owner
+// may still learn about the package: the account is usable and, for package
+// and org webhooks, the owner can read the package; global webhooks need a
+// site admin.
+func webhookOwnerMaySee(db *sqlx.DB, ownerID, pkgID int64, hookPkg, hookOrg *int64) bool {
+	if checkAccount(db, ownerID) != nil {
+		return false
+	}
+	if hookPkg == nil && hookOrg == nil {
+		var role string
+		return db.Get(&role, `SELECT role FROM users WHERE id = ?`, ownerID) == nil && role == string(models.RoleAdmin)
+	}
+	ok, err := canRead(db, &auth.Claims{UserID: ownerID, Scopes: []string{"read"}}, pkgID)
+	return err == nil && ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
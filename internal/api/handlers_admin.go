@@ -0,0 +1,360 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ebuild/internal/models"
+	"ebuild/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+func RebuildSearchIndexHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := store.New(db).RebuildSearchIndex()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "stats": stats})
+	}
+}
+
+// UnlockUserHandler lifts a login lockout before it expires.
+func UnlockUserHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+		if err := (loginGuard{db}).unlock(userID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "account_unlocked", "user", userID, "")
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+const userAccountColumns = `u.id, u.username, u.email, u.password_hash, u.role, u.created_at,
+	u.email_verified_at IS NOT NULL AS email_verified, u.totp_enabled_at IS NOT NULL AS two_factor,
+	u.suspended_at, u.suspended_reason, u.deleted_at`
+
+// ListUsersHandler searches accounts for site admins. q matches username or
+// email; role and status (active, suspended, deleted or all) filter. Deleted
+// accounts are left out unless asked for.
+func ListUsersHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var clauses []string
+		var args []interface{}
+		if q := strings.TrimSpace(c.Query("q")); q != "" {
+			like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q)) + "%"
+			clauses = append(clauses, `(lower(u.username) LIKE ? ESCAPE '\' OR lower(u.email) LIKE ? ESCAPE '\')`)
+			args = append(args, like, like)
+		}
+		if role := c.Query("role"); role != "" {
+			if !models.Role(role).Valid() {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+				return
+			}
+			clauses = append(clauses, "u.role = ?")
+			args = append(args, role)
+		}
+		switch c.DefaultQuery("status", "") {
+		case "":
+			clauses = append(clauses, "u.deleted_at IS NULL")
+		case "active":
+			clauses = append(clauses, "u.deleted_at IS NULL AND u.suspended_at IS NULL")
+		case "suspended":
+			clauses = append(clauses, "u.deleted_at IS NULL AND u.suspended_at IS NOT NULL")
+		case "deleted":
+			clauses = append(clauses, "u.deleted_at IS NOT NULL")
+		case "all":
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be active, suspended, deleted or all"})
+			return
+		}
+		where := ""
+		if len(clauses) > 0 {
+			where = " WHERE " + strings.Join(clauses, " AND ")
+		}
+		limit := 50
+		if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 200 {
+			limit = v
+		}
+		offset := 0
+		if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+			offset = v
+		}
+		var total int
+		if err := db.Get(&total, `SELECT COUNT(*) FROM users u`+where, args...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		users := []models.UserAccount{}
+		if err := db.Select(&users, `SELECT `+userAccountColumns+` FROM users u`+where+` ORDER BY u.id LIMIT ? OFFSET ?`, append(args, limit, offset)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"users": users, "total": total, "limit": limit, "offset": offset})
+	}
+}
+
+// adminTargetUser loads the :id user for the admin user routes. On failure
+// the response has been written.
+func adminTargetUser(c *gin.Context, db *sqlx.DB) (*models.UserAccount, bool) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return nil, false
+	}
+	var u models.UserAccount
+	if err := db.Get(&u, `SELECT `+userAccountColumns+` FROM users u WHERE u.id = ?`, userID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &u, true
+}
+
+// lastActiveAdmin reports whether u is the only admin who can still sign
+// in, and so must not be demoted or deleted.
+func lastActiveAdmin(db *sqlx.DB, u *models.UserAccount) (bool, error) {
+	if u.Role != models.RoleAdmin || u.SuspendedAt != nil || u.DeletedAt != nil {
+		return false, nil
+	}
+	var n int
+	err := db.Get(&n, `SELECT COUNT(*) FROM users WHERE role = ? AND suspended_at IS NULL AND deleted_at IS NULL`, models.RoleAdmin)
+	return n <= 1, err
+}
+
+func GetUserHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := adminTargetUser(c, db)
+		if !ok {
+			return
+		}
+		type pkgRef struct {
+			ID   int64  `db:"id" json:"id"`
+			Name string `db:"name" json:"name"`
+		}
+		type orgRef struct {
+			Name string `db:"name" json:"name"`
+			Role string `db:"role" json:"role"`
+		}
+		pkgs := []pkgRef{}
+		orgs := []orgRef{}
+		issuers := []string{}
+		err1 := db.Select(&pkgs, `SELECT id, name FROM packages WHERE created_by = ?
+			UNION SELECT p.id, p.name FROM packages p JOIN package_maintainers pm ON pm.package_id = p.id WHERE pm.user_id = ? ORDER BY name`, u.ID, u.ID)
+		err2 := db.Select(&orgs, `SELECT o.name, om.role FROM org_members om JOIN organizations o ON o.id = om.org_id WHERE om.user_id = ? ORDER BY o.name`, u.ID)
+		err3 := db.Select(&issuers, `SELECT issuer FROM user_identities WHERE user_id = ? ORDER BY issuer`, u.ID)
+		for _, err := range []error{err1, err2, err3} {
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"user": u, "packages": pkgs, "orgs": orgs, "identities": issuers})
+	}
+}
+
+func SetUserRoleHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := adminTargetUser(c, db)
+		if !ok {
+			return
+		}
+		var req struct {
+			Role models.Role `json:"role" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !req.Role.Valid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role must be public, maintainer or admin"})
+			return
+		}
+		if u.DeletedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "user is deleted"})
+			return
+		}
+		if req.Role != models.RoleAdmin {
+			last, err := lastActiveAdmin(db, u)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if last {
+				c.JSON(http.StatusConflict, gin.H{"error": "cannot demote the last admin"})
+				return
+			}
+		}
+		if _, err := db.Exec(`UPDATE users SET role = ? WHERE id = ?`, req.Role, u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Role != u.Role {
+			auditEvent(db, c, "role_changed", "user", u.ID, fmt.Sprintf("from=%s to=%s", u.Role, req.Role))
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "role": req.Role})
+	}
+}
+
+// revokeUserTokens revokes every token the user owns, sessions included.
+func revokeUserTokens(db sqlx.Execer, userID int64) error {
+	_, err := db.Exec(`UPDATE tokens SET revoked_at = datetime('now') WHERE owner_user_id = ? AND revoked_at IS NULL`, userID)
+	return err
+}
+
+// SuspendUserHandler blocks an account: sign-in fails, and every token it
+// holds is revoked so existing sessions and CI tokens stop at once.
+func SuspendUserHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := adminTargetUser(c, db)
+		if !ok {
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		_ = c.ShouldBindJSON(&req)
+		if claims := claimsFrom(c); claims != nil && claims.UserID == u.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot suspend yourself"})
+			return
+		}
+		if u.DeletedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "user is deleted"})
+			return
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE users SET suspended_at = COALESCE(suspended_at, datetime('now')), suspended_reason = ? WHERE id = ?`, strings.TrimSpace(req.Reason), u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := revokeUserTokens(tx, u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "user_suspended", "user", u.ID, "reason="+strings.TrimSpace(req.Reason))
+		c.JSON(http.StatusOK, gin.H{"status": "suspended"})
+	}
+}
+
+func UnsuspendUserHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := adminTargetUser(c, db)
+		if !ok {
+			return
+		}
+		if u.DeletedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "user is deleted"})
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET suspended_at = NULL, suspended_reason = '' WHERE id = ?`, u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if u.SuspendedAt != nil {
+			auditEvent(db, c, "user_unsuspended", "user", u.ID, "")
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// DeleteUserHandler deletes an account by anonymizing it. The row stays so
+// packages keep their creator and the username is never handed out again;
+// credentials, identities and memberships are removed.
+func DeleteUserHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := adminTargetUser(c, db)
+		if !ok {
+			return
+		}
+		if claims := claimsFrom(c); claims != nil && claims.UserID == u.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete yourself"})
+			return
+		}
+		if u.DeletedAt != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		last, err := lastActiveAdmin(db, u)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if last {
+			c.JSON(http.StatusConflict, gin.H{"error": "cannot delete the last admin"})
+			return
+		}
+		// orgs must not be left without an owner
+		var owned []string
+		if err := db.Select(&owned, `SELECT o.name FROM org_members om JOIN organizations o ON o.id = om.org_id
+			WHERE om.user_id = ? AND om.role = 'owner'
+			AND NOT EXISTS (SELECT 1 FROM org_members x WHERE x.org_id = om.org_id AND x.role = 'owner' AND x.user_id != om.user_id)`, u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(owned) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "user is the only owner of: " + strings.Join(owned, ", ")})
+			return
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		if err := revokeUserTokens(tx, u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, q := range []string{
+			`UPDATE users SET email = 'deleted-' || id || '@invalid', password_hash = '!', role = 'public',
+				totp_secret = NULL, totp_enabled_at = NULL, email_verified_at = NULL,
+				suspended_at = NULL, suspended_reason = '', deleted_at = datetime('now') WHERE id = ?`,
+			`DELETE FROM user_identities WHERE user_id = ?`,
+			`DELETE FROM recovery_codes WHERE user_id = ?`,
+			`DELETE FROM email_tokens WHERE user_id = ?`,
+			`DELETE FROM org_members WHERE user_id = ?`,
+			`DELETE FROM team_members WHERE user_id = ?`,
+			`DELETE FROM package_maintainers WHERE user_id = ?`,
+			`DELETE FROM trusted_publishers WHERE created_by = ?`,
+		} {
+			if _, err := tx.Exec(q, u.ID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "user_deleted", "user", u.ID, "username="+u.Username)
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
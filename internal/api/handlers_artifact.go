@@ -4,13 +4,27 @@ import (
 	"database/sql"
 	"net/http"
 	"strconv"
+	"time"
 
 	"ebuild/internal/auth"
+	"ebuild/internal/store"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
+type versionQuarantine struct {
+	ID          int64 `db:"id"`
+	Quarantined bool  `db:"quarantined"`
+}
+
+// getVersionQuarantine loads the version's id and whether it or its package
+// is quarantined.
+func getVersionQuarantine(db *sqlx.DB, v *versionQuarantine, pkgID, ver string) error {
+	return db.Get(v, `SELECT pv.id, p.quarantined_at IS NOT NULL OR pv.quarantined_at IS NOT NULL AS quarantined
+		FROM package_versions pv JOIN packages p ON p.id = pv.package_id WHERE pv.package_id = ? AND pv.version = ?`, pkgID, ver)
+}
+
 func AddArtifactHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		pkgID := c.Param("id")
@@ -30,9 +44,8 @@ func AddArtifactHandler(db *sqlx.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		var versionID int64
-		err := db.Get(&versionID, `SELECT id FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, ver)
-		if err != nil {
+		var v versionQuarantine
+		if err := getVersionQuarantine(db, &v, pkgID, ver); err != nil {
 			if err == sql.ErrNoRows {
 				c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
 				return
@@ -41,21 +54,26 @@ func AddArtifactHandler(db *sqlx.DB) gin.HandlerFunc {
 			return
 		}
 		pkgIDint, _ := strconv.ParseInt(pkgID, 10, 64)
-		ok, err := isMaintainerOrAdmin(db, claims.UserID, pkgIDint)
+		ok, err := canPublish(db, claims, pkgIDint)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			publishError(c, err)
 			return
 		}
 		if !ok {
 			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
 			return
 		}
-		res, err := db.Exec(`INSERT INTO artifacts (package_version_id, blob_url, filename, size_bytes, created_at) VALUES (?, ?, ?, ?, datetime('now'))`, versionID, req.BlobURL, req.Filename, req.Size)
+		if v.Quarantined {
+			c.JSON(http.StatusForbidden, gin.H{"error": "package or version is quarantined"})
+			return
+		}
+		res, err := db.Exec(`INSERT INTO artifacts (package_version_id, blob_url, filename, size_bytes, created_at) VALUES (?, ?, ?, ?, datetime('now'))`, v.ID, req.BlobURL, req.Filename, req.Size)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		id, _ := res.LastInsertId()
+		recordEvent(db, EventArtifactAdded, pkgIDint, gin.H{"version": ver, "artifact_id": id, "filename": req.Filename, "size_bytes": req.Size})
 		c.JSON(http.StatusCreated, gin.H{"id": id})
 	}
 }
@@ -64,9 +82,8 @@ func ListArtifactsHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		pkgID := c.Param("id")
 		ver := c.Param("ver")
-		var versionID int64
-		err := db.Get(&versionID, `SELECT id FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, ver)
-		if err != nil {
+		var v versionQuarantine
+		if err := getVersionQuarantine(db, &v, pkgID, ver); err != nil {
 			if err == sql.ErrNoRows {
 				c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
 				return
@@ -75,7 +92,7 @@ func ListArtifactsHandler(db *sqlx.DB) gin.HandlerFunc {
 			return
 		}
 		var arts []map[string]interface{}
-		rows, err := db.Query(`SELECT id, blob_url, filename, size_bytes, created_at FROM artifacts WHERE package_version_id = ?`, versionID)
+		rows, err := db.Query(`SELECT id, blob_url, filename, size_bytes, created_at FROM artifacts WHERE package_version_id = ?`, v.ID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -94,6 +111,10 @@ func ListArtifactsHandler(db *sqlx.DB) gin.HandlerFunc {
 			}
 			m := map[string]interface{}{}
 			for i, col := range cols {
+				// the blob would bypass the 451 download answers
+				if col == "blob_url" && v.Quarantined {
+					continue
+				}
 				v := vals[i]
 				if b, ok := v.([]byte); ok {
 					m[col] = string(b)
@@ -107,7 +128,7 @@ func ListArtifactsHandler(db *sqlx.DB) gin.HandlerFunc {
 	}
 }
 
-func DownloadArtifactHandler(db *sqlx.DB) gin.HandlerFunc {
+func DownloadArtifactHandler(db *sqlx.DB, downloads *store.DownloadQueue) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		aID := c.Param("artifact_id")
 		var art struct {
@@ -115,14 +136,33 @@ func DownloadArtifactHandler(db *sqlx.DB) gin.HandlerFunc {
 			PackageVersionID int64  `db:"package_version_id"`
 			BlobURL          string `db:"blob_url"`
 			PackageID        int64  `db:"package_id"`
+			Quarantined      bool   `db:"quarantined"`
 		}
-		err := db.Get(&art, `SELECT a.id, a.package_version_id, a.blob_url, pv.package_id FROM artifacts a JOIN package_versions pv ON a.package_version_id = pv.id WHERE a.id = ?`, aID)
+		err := db.Get(&art, `SELECT a.id, a.package_version_id, a.blob_url, pv.package_id, p.quarantined_at IS NOT NULL OR pv.quarantined_at IS NOT NULL AS quarantined
+			FROM artifacts a JOIN package_versions pv ON a.package_version_id = pv.id JOIN packages p ON p.id = pv.package_id WHERE a.id = ?`, aID)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "artifact not found"})
 			return
 		}
-		_, _ = db.Exec(`UPDATE package_versions SET download_count = COALESCE(download_count,0) + 1 WHERE id = ?`, art.PackageVersionID)
-		_, _ = db.Exec(`UPDATE packages SET download_count = COALESCE(download_count,0) + 1 WHERE id = ?`, art.PackageID)
+		if ok, err := canRead(db, claimsFrom(c), art.PackageID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "artifact not found"})
+			return
+		}
+		if art.Quarantined {
+			c.JSON(http.StatusUnavailableForLegalReasons, gin.H{"error": "this release has been quarantined by the registry administrators"})
+			return
+		}
+		// counted in the background; the redirect does not wait for the write
+		downloads.Push(store.Download{
+			ArtifactID:       art.ID,
+			PackageVersionID: art.PackageVersionID,
+			PackageID:        art.PackageID,
+			Client:           downloadClient(c),
+			At:               time.Now(),
+		})
 		c.Redirect(http.StatusFound, art.BlobURL)
 	}
 }
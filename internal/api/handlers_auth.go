@@ -5,16 +5,20 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"log"
 	"net/http"
+	netmail "net/mail"
 	"os"
+	"strings"
 	"time"
 
 	"ebuild/internal/auth"
+	"ebuild/internal/mail"
 	"ebuild/internal/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func hashTokenRaw(t string) string {
@@ -22,7 +26,28 @@ func hashTokenRaw(t string) string {
 	return hex.EncodeToString(h[:])
 }
 
-func RegisterHandler(db *sqlx.DB) gin.HandlerFunc {
+// passwordError answers 400 for policy violations and 500 otherwise.
+func passwordError(c *gin.Context, err error) {
+	for _, e := range []error{auth.ErrPasswordTooShort, auth.ErrPasswordTooLong, auth.ErrPasswordUsername, auth.ErrPasswordBreached} {
+		if errors.Is(err, e) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// defaultRole is the site role of new accounts, from EBUILD_DEFAULT_ROLE:
+// maintainer (the default) or public, for registries where admins grant
+// publishing. Admins are only ever made explicitly.
+func defaultRole() models.Role {
+	if models.Role(os.Getenv("EBUILD_DEFAULT_ROLE")) == models.RolePublic {
+		return models.RolePublic
+	}
+	return models.RoleMaintainer
+}
+
+func RegisterHandler(db *sqlx.DB, mailer mail.Mailer) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Username string `json:"username" binding:"required"`
@@ -33,14 +58,32 @@ func RegisterHandler(db *sqlx.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		pw, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-		res, err := db.Exec(`INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)`, req.Username, req.Email, string(pw), models.RoleMaintainer)
+		addr, err := netmail.ParseAddress(req.Email)
+		if err != nil || addr.Name != "" || addr.Address != strings.TrimSpace(req.Email) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email address"})
+			return
+		}
+		pc := auth.PasswordConfigFromEnv()
+		if err := pc.Validate(req.Password, req.Username); err != nil {
+			passwordError(c, err)
+			return
+		}
+		pw, err := pc.Hash(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res, err := db.Exec(`INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)`, req.Username, addr.Address, pw, defaultRole())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		id, _ := res.LastInsertId()
-		c.JSON(http.StatusCreated, gin.H{"id": id})
+		// the account exists either way; a failed mail can be resent later
+		if err := sendVerificationEmail(db, mailer, id, req.Username, addr.Address); err != nil {
+			log.Printf("verification mail for user %d: %v", id, err)
+		}
+		c.JSON(http.StatusCreated, gin.H{"id": id, "verification": "sent"})
 	}
 }
 
@@ -54,51 +97,145 @@ func LoginHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		guard := loginGuard{db}
+		ip := c.ClientIP()
+		byUser, byIP, err := guard.failures(req.Username, ip)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if byIP >= loginIPBlockAfter {
+			c.Header("Retry-After", ceilSeconds(loginFailureWindow))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins from this address"})
+			return
+		}
+		time.Sleep(guard.delay(byUser, byIP))
 		var user models.User
-		err := db.Get(&user, `SELECT id, username, email, password_hash, role FROM users WHERE username = ?`, req.Username)
+		err = db.Get(&user, `SELECT id, username, email, password_hash, role FROM users WHERE username = ?`, req.Username)
 		if err != nil {
 			if err == sql.ErrNoRows {
+				// unknown names count too, so probing for accounts is throttled
+				_, _ = guard.recordFailure(req.Username, ip, 0)
 				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 				return
 			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		locked, err := guard.lockedFor(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		accessTok, err := auth.NewToken(signingKey, user.ID, []string{"read", "maintain"}, time.Minute*30)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		if locked > 0 {
+			c.Header("Retry-After", ceilSeconds(locked))
+			c.JSON(http.StatusLocked, gin.H{"error": "account temporarily locked"})
 			return
 		}
-		refreshTok, err := auth.NewToken(signingKey, user.ID, []string{"refresh"}, time.Hour*24*30)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		pc := auth.PasswordConfigFromEnv()
+		ok, rehash := pc.Verify(user.Password, req.Password)
+		if !ok {
+			locked, err := guard.recordFailure(req.Username, ip, user.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if locked > 0 {
+				auditEvent(db, c, "account_locked", "user", user.ID, "duration="+locked.String())
+				c.Header("Retry-After", ceilSeconds(locked))
+				c.JSON(http.StatusLocked, gin.H{"error": "account temporarily locked"})
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 			return
 		}
-		hash := hashTokenRaw(refreshTok)
-		_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, created_at) VALUES (?, ?, 0, ?, datetime('now'))`, user.ID, hash, "refresh")
-		if err != nil {
-			// non-fatal
+		guard.recordSuccess(req.Username)
+		if err := checkAccount(db, user.ID); err != nil {
+			accountError(c, err)
+			return
+		}
+		// upgrade hashes made with an older algorithm or cost while the
+		// plaintext is at hand
+		if rehash {
+			if h, err := pc.Hash(req.Password); err == nil {
+				_, _ = db.Exec(`UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?`, h, user.ID, user.Password)
+			}
 		}
-		_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, parent_token_hash, meta) VALUES (?, ?, ?, ?, ?, ?)`, "refresh_created", hash, user.ID, user.ID, nil, nil)
-		secure := os.Getenv("EBUILD_COOKIE_SECURE") == "1"
-		domain := os.Getenv("EBUILD_COOKIE_DOMAIN")
-		b := make([]byte, 32)
-		if _, err := rand.Read(b); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate csrf"})
+		var mfa bool
+		if err := db.Get(&mfa, `SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?`, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		csrf := hex.EncodeToString(b)
-		// SameSite: default Strict unless EBUILD_COOKIE_SAMESITE="Lax"
-		samesite := http.SameSiteStrictMode
-		if os.Getenv("EBUILD_COOKIE_SAMESITE") == "Lax" {
-			samesite = http.SameSiteLaxMode
+		if mfa {
+			// the password was right; the session is issued by
+			// LoginMFAHandler once a second factor is presented
+			challenge, err := auth.NewToken(signingKey, user.ID, []string{auth.ScopeMFA}, mfaChallengeTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": challenge})
+			return
 		}
-		http.SetCookie(c.Writer, &http.Cookie{Name: "ebuild_refresh", Value: refreshTok, Path: "/", HttpOnly: true, Secure: secure, SameSite: samesite, Domain: domain, MaxAge: 60 * 60 * 24 * 30})
-		http.SetCookie(c.Writer, &http.Cookie{Name: "ebuild_csrf", Value: csrf, Path: "/", HttpOnly: false, Secure: secure, SameSite: samesite, Domain: domain, MaxAge: 60 * 60 * 24 * 30})
-		c.JSON(http.StatusOK, gin.H{"token": accessTok, "username": user.Username, "csrf": csrf})
+		issueSession(c, db, signingKey, user.ID, user.Username)
+	}
+}
+
+// issueSession answers a successful sign-in: a short-lived access token in
+// the body and a refresh token plus CSRF token as cookies.
+func issueSession(c *gin.Context, db *sqlx.DB, signingKey []byte, userID int64, username string) {
+	accessTok, csrf, ok := startSession(c, db, signingKey, userID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": accessTok, "username": username, "csrf": csrf})
+}
+
+// startSession sets the refresh and CSRF cookies and returns a new access
+// token and the CSRF value. On failure the response has been written.
+func startSession(c *gin.Context, db *sqlx.DB, signingKey []byte, userID int64) (accessTok, csrf string, ok bool) {
+	if err := checkAccount(db, userID); err != nil {
+		accountError(c, err)
+		return "", "", false
+	}
+	sid, err := newSessionID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return "", "", false
+	}
+	accessTok, err = auth.NewTokenFromClaims(signingKey, auth.Claims{UserID: userID, Scopes: []string{"read", "maintain"}, SessionID: sid}, time.Minute*30)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return "", "", false
+	}
+	refreshTok, err := auth.NewToken(signingKey, userID, []string{"refresh"}, time.Hour*24*30)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		return "", "", false
+	}
+	hash := hashTokenRaw(refreshTok)
+	// the access token is tied to this row's family, so without it the
+	// session would end at once
+	_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, family_id, user_agent, ip, last_used_at, created_at) VALUES (?, ?, 0, ?, ?, ?, ?, datetime('now'), datetime('now'))`, userID, hash, "refresh", sid, userAgent(c), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return "", "", false
+	}
+	_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, parent_token_hash, meta) VALUES (?, ?, ?, ?, ?, ?)`, "refresh_created", hash, userID, userID, nil, nil)
+	secure := os.Getenv("EBUILD_COOKIE_SECURE") == "1"
+	domain := os.Getenv("EBUILD_COOKIE_DOMAIN")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate csrf"})
+		return "", "", false
+	}
+	csrf = hex.EncodeToString(b)
+	// SameSite: default Strict unless EBUILD_COOKIE_SAMESITE="Lax"
+	samesite := http.SameSiteStrictMode
+	if os.Getenv("EBUILD_COOKIE_SAMESITE") == "Lax" {
+		samesite = http.SameSiteLaxMode
 	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: "ebuild_refresh", Value: refreshTok, Path: "/", HttpOnly: true, Secure: secure, SameSite: samesite, Domain: domain, MaxAge: 60 * 60 * 24 * 30})
+	http.SetCookie(c.Writer, &http.Cookie{Name: "ebuild_csrf", Value: csrf, Path: "/", HttpOnly: false, Secure: secure, SameSite: samesite, Domain: domain, MaxAge: 60 * 60 * 24 * 30})
+	return accessTok, csrf, true
 }
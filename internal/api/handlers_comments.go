@@ -1,13 +1,77 @@
 package api
 
 import (
+	"database/sql"
 	"ebuild/internal/auth"
+	"ebuild/internal/markdown"
+	"ebuild/internal/models"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
+const maxCommentBytes = 10000
+
+// commentSelect reads comments with their author and the lock state of
+// their thread, which lives on the root comment.
+const commentSelect = `SELECT c.id, c.user_id, u.username, c.package_id, c.package_version_id, c.parent_id, c.root_id,
+	c.body, c.body_html, c.created_at, c.updated_at,
+	c.deleted_at IS NOT NULL AS deleted, c.hidden_at IS NOT NULL AS hidden, r.locked_at IS NOT NULL AS locked
+	FROM comments c JOIN users u ON u.id = c.user_id JOIN comments r ON r.id = COALESCE(c.root_id, c.id)`
+
+// isSiteAdmin reports whether the caller is a site admin using a token that
+// may exercise that role.
+func isSiteAdmin(db *sqlx.DB, claims *auth.Claims) (bool, error) {
+	if claims == nil || !claims.AdminCapable() {
+		return false, nil
+	}
+	var role string
+	if err := db.Get(&role, `SELECT role FROM users WHERE id = ?`, claims.UserID); err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	return role == string(models.RoleAdmin), nil
+}
+
+// validCommentBody trims body and checks its size. On failure the response
+// has been written.
+func validCommentBody(c *gin.Context, body string) (string, bool) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "comment is empty"})
+		return "", false
+	}
+	if len(body) > maxCommentBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("comment is longer than %d bytes", maxCommentBytes)})
+		return "", false
+	}
+	return body, true
+}
+
+// packageComment loads the :comment_id comment of the :id package. On
+// failure the response has been written.
+func packageComment(c *gin.Context, db *sqlx.DB) (*models.Comment, bool) {
+	pkgID, err1 := strconv.ParseInt(c.Param("id"), 10, 64)
+	commentID, err2 := strconv.ParseInt(c.Param("comment_id"), 10, 64)
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var cm models.Comment
+	if err := db.Get(&cm, commentSelect+` WHERE c.id = ? AND c.package_id = ?`, commentID, pkgID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "comment not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &cm, true
+}
+
 func CreateCommentHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ci, exists := c.Get(string(CtxClaims))
@@ -16,38 +80,333 @@ func CreateCommentHandler(db *sqlx.DB) gin.HandlerFunc {
 			return
 		}
 		claims := ci.(*auth.Claims)
-		pkgID := c.Param("id")
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
 		var req struct {
-			Body           string  `json:"body" binding:"required"`
-			PackageVersion *string `json:"package_version_id"`
+			Body             string `json:"body" binding:"required"`
+			ParentID         *int64 `json:"parent_id"`
+			PackageVersionID *int64 `json:"package_version_id"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		var pvID interface{}
-		if req.PackageVersion != nil {
-			pvID = req.PackageVersion
-		} else {
-			pvID = nil
+		body, ok := validCommentBody(c, req.Body)
+		if !ok {
+			return
+		}
+		var rootID *int64
+		if req.ParentID != nil {
+			var parent models.Comment
+			if err := db.Get(&parent, commentSelect+` WHERE c.id = ? AND c.package_id = ?`, *req.ParentID, pkgID); err != nil {
+				if err == sql.ErrNoRows {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "parent comment not found"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			switch {
+			case parent.Locked:
+				c.JSON(http.StatusForbidden, gin.H{"error": "thread is locked"})
+				return
+			case parent.Deleted || parent.Hidden:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "cannot reply to a removed comment"})
+				return
+			}
+			rootID = parent.RootID
+			if rootID == nil {
+				rootID = &parent.ID
+			}
+			// replies are about the same release as what they answer
+			if req.PackageVersionID == nil {
+				req.PackageVersionID = parent.PackageVersionID
+			}
+		}
+		if req.PackageVersionID != nil {
+			var one int
+			if err := db.Get(&one, `SELECT 1 FROM package_versions WHERE id = ? AND package_id = ?`, *req.PackageVersionID, pkgID); err != nil {
+				if err == sql.ErrNoRows {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "version does not belong to this package"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
 		}
-		_, err := db.Exec(`INSERT INTO comments (user_id, package_id, package_version_id, body, created_at) VALUES (?, ?, ?, ?, datetime('now'))`, claims.UserID, pkgID, pvID, req.Body)
+		res, err := db.Exec(`INSERT INTO comments (user_id, package_id, package_version_id, parent_id, root_id, body, body_html, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now'))`, claims.UserID, pkgID, req.PackageVersionID, req.ParentID, rootID, body, markdown.Render(body))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusCreated, gin.H{"status": "ok"})
+		id, _ := res.LastInsertId()
+		var cm models.Comment
+		if err := db.Get(&cm, commentSelect+` WHERE c.id = ?`, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, cm)
 	}
 }
 
+// ListCommentsHandler returns the package's comments as threads, newest
+// thread first and replies oldest first. Deleted and hidden comments keep
+// their place in the tree without a body; site admins still see hidden
+// bodies.
 func ListCommentsHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		pkgID := c.Param("id")
-		var comments []map[string]interface{}
-		if err := db.Select(&comments, `SELECT id, user_id, package_version_id, body, created_at FROM comments WHERE package_id = ? ORDER BY created_at DESC`, pkgID); err != nil {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		admin, err := isSiteAdmin(db, claimsFrom(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var all []*models.Comment
+		if err := db.Select(&all, commentSelect+` WHERE c.package_id = ? ORDER BY c.created_at, c.id`, pkgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		byID := make(map[int64]*models.Comment, len(all))
+		for _, cm := range all {
+			cm.Replies = []*models.Comment{}
+			if cm.Deleted || cm.Hidden && !admin {
+				cm.Body, cm.BodyHTML = "", ""
+			} else if cm.BodyHTML == "" {
+				// comments from before rendering was stored
+				cm.BodyHTML = markdown.Render(cm.Body)
+			}
+			byID[cm.ID] = cm
+		}
+		threads := []*models.Comment{}
+		for _, cm := range all {
+			if cm.ParentID != nil {
+				if parent, ok := byID[*cm.ParentID]; ok {
+					parent.Replies = append(parent.Replies, cm)
+					continue
+				}
+			}
+			threads = append(threads, cm)
+		}
+		for i, j := 0, len(threads)-1; i < j; i, j = i+1, j-1 {
+			threads[i], threads[j] = threads[j], threads[i]
+		}
+		c.JSON(http.StatusOK, gin.H{"comments": threads, "count": len(all)})
+	}
+}
+
+// UpdateCommentHandler lets the author edit a comment. The previous body is
+// kept in comment_edits.
+func UpdateCommentHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		if claims == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		cm, ok := packageComment(c, db)
+		if !ok {
+			return
+		}
+		var req struct {
+			Body string `json:"body" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		body, ok := validCommentBody(c, req.Body)
+		if !ok {
+			return
+		}
+		switch {
+		case cm.UserID != claims.UserID:
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the author can edit a comment"})
+			return
+		case cm.Deleted:
+			c.JSON(http.StatusNotFound, gin.H{"error": "comment not found"})
+			return
+		case cm.Hidden:
+			c.JSON(http.StatusForbidden, gin.H{"error": "comment was hidden by a moderator"})
+			return
+		case cm.Locked:
+			c.JSON(http.StatusForbidden, gin.H{"error": "thread is locked"})
+			return
+		}
+		if body != cm.Body {
+			tx, err := db.Beginx()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			defer tx.Rollback()
+			if _, err := tx.Exec(`INSERT INTO comment_edits (comment_id, body, edited_by) VALUES (?, ?, ?)`, cm.ID, cm.Body, claims.UserID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if _, err := tx.Exec(`UPDATE comments SET body = ?, body_html = ?, updated_at = datetime('now') WHERE id = ?`, body, markdown.Render(body), cm.ID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		cm, ok = packageComment(c, db)
+		if !ok {
+			return
+		}
+		cm.Replies = nil
+		c.JSON(http.StatusOK, cm)
+	}
+}
+
+// CommentEditsHandler lists a comment's earlier bodies, newest first.
+// Removed comments' history is for site admins only.
+func CommentEditsHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cm, ok := packageComment(c, db)
+		if !ok {
+			return
+		}
+		if cm.Deleted || cm.Hidden {
+			admin, err := isSiteAdmin(db, claimsFrom(c))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !admin {
+				c.JSON(http.StatusNotFound, gin.H{"error": "comment not found"})
+				return
+			}
+		}
+		edits := []models.CommentEdit{}
+		if err := db.Select(&edits, `SELECT body, edited_by, edited_at FROM comment_edits WHERE comment_id = ? ORDER BY id DESC`, cm.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"edits": edits})
+	}
+}
+
+// DeleteCommentHandler soft-deletes a comment. Authors may delete their
+// own; package maintainers and site admins may delete any on the package.
+func DeleteCommentHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		if claims == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		cm, ok := packageComment(c, db)
+		if !ok {
+			return
+		}
+		if cm.Deleted {
+			c.JSON(http.StatusNotFound, gin.H{"error": "comment not found"})
+			return
+		}
+		if cm.UserID != claims.UserID {
+			// moderating others takes a token that could also publish the
+			// package, or one that may act as site admin
+			ok, err := isSiteAdmin(db, claims)
+			if err == nil && !ok && claims.HasScope("maintain") {
+				ok, err = canPublish(db, claims, cm.PackageID)
+			}
+			if err != nil {
+				publishError(c, err)
+				return
+			}
+			if !ok {
+				c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to delete this comment"})
+				return
+			}
+		}
+		if _, err := db.Exec(`UPDATE comments SET deleted_at = datetime('now'), deleted_by = ? WHERE id = ?`, claims.UserID, cm.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if cm.UserID != claims.UserID {
+			auditEvent(db, c, "comment_deleted", "comment", cm.ID, fmt.Sprintf("package=%d author=%d", cm.PackageID, cm.UserID))
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
+
+// ModerateCommentHandler lets site admins hide a comment or lock the thread
+// it belongs to. Locked threads take no replies or edits.
+func ModerateCommentHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		commentID, err := strconv.ParseInt(c.Param("comment_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid comment id"})
+			return
+		}
+		var req struct {
+			Hidden *bool `json:"hidden"`
+			Locked *bool `json:"locked"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Hidden == nil && req.Locked == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+			return
+		}
+		var cm models.Comment
+		if err := db.Get(&cm, commentSelect+` WHERE c.id = ?`, commentID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "comment not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Hidden != nil && *req.Hidden != cm.Hidden {
+			action := "comment_hidden"
+			if *req.Hidden {
+				_, err = db.Exec(`UPDATE comments SET hidden_at = datetime('now'), hidden_by = ? WHERE id = ?`, claims.UserID, cm.ID)
+			} else {
+				action = "comment_unhidden"
+				_, err = db.Exec(`UPDATE comments SET hidden_at = NULL, hidden_by = NULL WHERE id = ?`, cm.ID)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			auditEvent(db, c, action, "comment", cm.ID, fmt.Sprintf("package=%d author=%d", cm.PackageID, cm.UserID))
+		}
+		if req.Locked != nil && *req.Locked != cm.Locked {
+			root := cm.ID
+			if cm.RootID != nil {
+				root = *cm.RootID
+			}
+			action := "thread_locked"
+			if *req.Locked {
+				_, err = db.Exec(`UPDATE comments SET locked_at = datetime('now') WHERE id = ?`, root)
+			} else {
+				action = "thread_unlocked"
+				_, err = db.Exec(`UPDATE comments SET locked_at = NULL WHERE id = ?`, root)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			auditEvent(db, c, action, "comment", root, fmt.Sprintf("package=%d", cm.PackageID))
+		}
+		if err := db.Get(&cm, commentSelect+` WHERE c.id = ?`, commentID); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"comments": comments})
+		c.JSON(http.StatusOK, cm)
 	}
 }
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ebuild/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// maxStatsDays bounds the range of a download series.
+const maxStatsDays = 366
+
+// downloadClient identifies a downloader for the unique client estimate.
+// Clients behind one address with the same User-Agent count once.
+func downloadClient(c *gin.Context) string {
+	return c.ClientIP() + "|" + c.Request.UserAgent()
+}
+
+// DownloadStatsHandler returns the package's daily downloads and estimated
+// unique clients between from and to (YYYY-MM-DD, UTC, inclusive), the last
+// 30 days by default. version or artifact_id narrow the series.
+func DownloadStatsHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		to := time.Now().UTC()
+		if v := c.Query("to"); v != "" {
+			if to, err = time.Parse("2006-01-02", v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date like 2006-01-02"})
+				return
+			}
+		}
+		from := to.AddDate(0, 0, -29)
+		if v := c.Query("from"); v != "" {
+			if from, err = time.Parse("2006-01-02", v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date like 2006-01-02"})
+				return
+			}
+		}
+		if from.After(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from is after to"})
+			return
+		}
+		if to.Sub(from) >= maxStatsDays*24*time.Hour {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "range is longer than " + strconv.Itoa(maxStatsDays) + " days"})
+			return
+		}
+		var f store.DownloadFilter
+		if v := c.Query("version"); v != "" {
+			var versionID int64
+			if err := db.Get(&versionID, `SELECT id FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, v); err != nil {
+				if err == sql.ErrNoRows {
+					c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			f.PackageVersionID = &versionID
+		}
+		if v := c.Query("artifact_id"); v != "" {
+			artifactID, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid artifact id"})
+				return
+			}
+			f.ArtifactID = &artifactID
+		}
+		series, err := store.New(db).DownloadSeries(pkgID, f, from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, series)
+	}
+}
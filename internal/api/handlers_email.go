@@ -0,0 +1,241 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/mail"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	emailTokenVerify = "verify"
+	emailTokenReset  = "reset"
+
+	verifyTokenTTL = 48 * time.Hour
+	resetTokenTTL  = time.Hour
+)
+
+// baseURL is where links in outgoing mail point, EBUILD_BASE_URL or the
+// local dev server.
+func baseURL() string {
+	if u := os.Getenv("EBUILD_BASE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// issueEmailToken stores a new single-use token for userID and returns it.
+// Older unused tokens for the same purpose are invalidated.
+func issueEmailToken(db *sqlx.DB, userID int64, email, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	raw := hex.EncodeToString(b)
+	if _, err := db.Exec(`UPDATE email_tokens SET used_at = datetime('now') WHERE user_id = ? AND purpose = ? AND used_at IS NULL`, userID, purpose); err != nil {
+		return "", err
+	}
+	_, err := db.Exec(`INSERT INTO email_tokens (user_id, purpose, token_hash, email, expires_at) VALUES (?, ?, ?, ?, datetime('now', ?))`, userID, purpose, hashTokenRaw(raw), email, fmt.Sprintf("+%d seconds", int(ttl.Seconds())))
+	if err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeEmailToken marks a valid token as used and returns its user and the
+// address it was sent to. Unknown, expired and used tokens yield
+// sql.ErrNoRows.
+func consumeEmailToken(db *sqlx.DB, raw, purpose string) (userID int64, email string, err error) {
+	var row struct {
+		UserID int64  `db:"user_id"`
+		Email  string `db:"email"`
+	}
+	err = db.Get(&row, `UPDATE email_tokens SET used_at = datetime('now') WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > datetime('now') RETURNING user_id, email`, hashTokenRaw(raw), purpose)
+	return row.UserID, row.Email, err
+}
+
+// sendVerificationEmail mails a verification link to email. Delivery errors
+// are returned so callers can decide whether they matter.
+func sendVerificationEmail(db *sqlx.DB, mailer mail.Mailer, userID int64, username, email string) error {
+	tok, err := issueEmailToken(db, userID, email, emailTokenVerify, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Verify your ebuild email address",
+		Body: fmt.Sprintf("Hello %s,\n\nconfirm this address for your ebuild account by opening\n\n  %s/static/account.html?verify=%s\n\nThe link expires in %d hours.\n",
+			username, baseURL(), url.QueryEscape(tok), int(verifyTokenTTL.Hours())),
+	})
+}
+
+func VerifyEmailHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, email, err := consumeEmailToken(db, req.Token, emailTokenVerify)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// the address must not have changed since the link was sent
+		res, err := db.Exec(`UPDATE users SET email_verified_at = datetime('now') WHERE id = ? AND email = ?`, userID, email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "verified"})
+	}
+}
+
+func ResendVerificationHandler(db *sqlx.DB, mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var user struct {
+			Username string         `db:"username"`
+			Email    string         `db:"email"`
+			Verified sql.NullString `db:"email_verified_at"`
+		}
+		if err := db.Get(&user, `SELECT username, email, email_verified_at FROM users WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.Verified.Valid {
+			c.JSON(http.StatusConflict, gin.H{"error": "email already verified"})
+			return
+		}
+		if err := sendVerificationEmail(db, mailer, claims.UserID, user.Username, user.Email); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to send email"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "sent"})
+	}
+}
+
+// ForgotPasswordHandler mails a reset link. It answers the same way whether
+// or not the address belongs to an account.
+func ForgotPasswordHandler(db *sqlx.DB, mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var user struct {
+			ID       int64  `db:"id"`
+			Username string `db:"username"`
+			Email    string `db:"email"`
+		}
+		err := db.Get(&user, `SELECT id, username, email FROM users WHERE lower(email) = lower(?)`, strings.TrimSpace(req.Email))
+		if err == nil {
+			tok, err := issueEmailToken(db, user.ID, user.Email, emailTokenReset, resetTokenTTL)
+			if err == nil {
+				err = mailer.Send(mail.Message{
+					To:      user.Email,
+					Subject: "Reset your ebuild password",
+					Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset the password of your ebuild account. To choose a new one, open\n\n  %s/static/account.html?reset=%s\n\nThe link expires in %d minutes. If this was not you, ignore this message.\n",
+						user.Username, baseURL(), url.QueryEscape(tok), int(resetTokenTTL.Minutes())),
+				})
+			}
+			if err != nil {
+				log.Printf("password reset mail for user %d: %v", user.ID, err)
+			}
+		} else if err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "if the address is registered, a reset link has been sent"})
+	}
+}
+
+// ResetPasswordHandler sets a new password from a reset token and revokes
+// every refresh token of the account, signing out all sessions.
+func ResetPasswordHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token    string `json:"token" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// check the policy first so a rejected password does not burn the token
+		pc := auth.PasswordConfigFromEnv()
+		if err := pc.Validate(req.Password, ""); err != nil {
+			passwordError(c, err)
+			return
+		}
+		userID, email, err := consumeEmailToken(db, req.Token, emailTokenReset)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		pw, err := pc.Hash(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		// receiving the mail proves the address, and a reset lifts any lockout
+		if _, err := tx.Exec(`UPDATE users SET password_hash = ?, locked_until = NULL, email_verified_at = CASE WHEN email = ? THEN COALESCE(email_verified_at, datetime('now')) ELSE email_verified_at END WHERE id = ?`, pw, email, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var revoked []string
+		if err := tx.Select(&revoked, `UPDATE tokens SET revoked_at = datetime('now') WHERE owner_user_id = ? AND scopes = 'refresh' AND revoked_at IS NULL RETURNING token_hash`, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, h := range revoked {
+			_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, meta) VALUES (?, ?, ?, ?, ?)`, "refresh_revoked", h, userID, userID, "password_reset")
+		}
+		auditEvent(db, c, "password_reset", "user", userID, "")
+		c.JSON(http.StatusOK, gin.H{"status": "password updated"})
+	}
+}
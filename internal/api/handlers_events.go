@@ -0,0 +1,156 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// streamKeepalive is how often an idle stream sends a comment, so proxies
+// keep the connection open. It doubles as a fallback poll.
+const streamKeepalive = 15 * time.Second
+
+// EventStreamHandler streams registry events as Server-Sent Events. Each
+// event's SSE id is its registry_events id and its data the same JSON
+// payload webhooks receive. A client that reconnects with Last-Event-ID (or
+// ?last_event_id, which EventSource cannot send as a header on its first
+// connection) gets everything it missed; without one the stream starts with
+// the next event. package (ids, repeatable or comma separated) and event
+// narrow the stream. Events of private packages only reach callers who can
+// read them.
+func EventStreamHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		clause, args, err := readablePackagesClause(db, claims)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var pkgIDs []interface{}
+		for _, v := range splitQuery(c, "package") {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+				return
+			}
+			pkgIDs = append(pkgIDs, id)
+		}
+		if len(pkgIDs) > 0 {
+			clause += " AND e.package_id IN (?" + strings.Repeat(", ?", len(pkgIDs)-1) + ")"
+			args = append(args, pkgIDs...)
+		}
+		var events []interface{}
+		for _, v := range splitQuery(c, "event") {
+			if !webhookEvents[v] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown event " + v})
+				return
+			}
+			events = append(events, v)
+		}
+		if len(events) > 0 {
+			clause += " AND e.event IN (?" + strings.Repeat(", ?", len(events)-1) + ")"
+			args = append(args, events...)
+		}
+
+		var last int64
+		lastID := c.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.Query("last_event_id")
+		}
+		if lastID != "" {
+			if last, err = strconv.ParseInt(lastID, 10, 64); err != nil || last < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid last event id"})
+				return
+			}
+		} else if err := db.Get(&last, `SELECT COALESCE(MAX(id), 0) FROM registry_events`); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the token was checked once, so end the stream when it expires; the
+		// client reconnects with a fresh one
+		var expired <-chan time.Time
+		if claims != nil && claims.ExpiresAt != nil {
+			t := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+			defer t.Stop()
+			expired = t.C
+		}
+		keepalive := time.NewTicker(streamKeepalive)
+		defer keepalive.Stop()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		if _, err := c.Writer.WriteString("retry: 3000\n\n"); err != nil {
+			return
+		}
+		c.Writer.Flush()
+		for {
+			// take the wake channel before querying, so an event recorded
+			// in between is not missed
+			wake := streams.wait()
+			var rows []struct {
+				ID      int64  `db:"id"`
+				Event   string `db:"event"`
+				Payload string `db:"payload"`
+			}
+			err := db.Select(&rows, `SELECT e.id, e.event, e.payload FROM registry_events e JOIN packages p ON p.id = e.package_id
+				WHERE e.id > ? AND `+clause+` ORDER BY e.id LIMIT 100`, append([]interface{}{last}, args...)...)
+			if err != nil {
+				// headers are out; the client retries from its last id
+				return
+			}
+			for _, r := range rows {
+				if err := sse.Encode(c.Writer, sse.Event{Id: strconv.FormatInt(r.ID, 10), Event: r.Event, Data: r.Payload}); err != nil {
+					return
+				}
+				last = r.ID
+			}
+			if len(rows) > 0 {
+				c.Writer.Flush()
+			}
+			if len(rows) == 100 {
+				continue
+			}
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-streams.closed:
+				return
+			case <-expired:
+				return
+			case <-wake:
+			case <-keepalive.C:
+				// the token was checked once at the start; end the stream
+				// as soon as it is revoked or its account suspended
+				if claims != nil && checkToken(db, claims, c.GetString(string(CtxRawToken))) != nil {
+					return
+				}
+				if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// splitQuery returns the values of a repeatable query parameter, also
+// splitting them on commas.
+func splitQuery(c *gin.Context, key string) []string {
+	var out []string
+	for _, v := range c.QueryArray(key) {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
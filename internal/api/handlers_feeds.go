@@ -0,0 +1,230 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ebuild/internal/atom"
+	"ebuild/internal/markdown"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// feedSize is how many releases a feed lists, newest first.
+const feedSize = 50
+
+type feedRelease struct {
+	PackageID   int64          `db:"package_id"`
+	PackageName string         `db:"package_name"`
+	Version     string         `db:"version"`
+	Metadata    string         `db:"metadata"`
+	ReleasedAt  time.Time      `db:"released_at"`
+	YankedAt    *time.Time     `db:"yanked_at"`
+	NotesHTML   string         `db:"release_notes_html"`
+	NotesAt     *time.Time     `db:"release_notes_updated_at"`
+	Publisher   sql.NullString `db:"publisher"`
+}
+
+// feedReleases returns the latest releases matching where, a condition over
+// packages p and package_versions v. Quarantined releases are left out.
+func feedReleases(db *sqlx.DB, where string, args ...interface{}) ([]feedRelease, error) {
+	var rows []feedRelease
+	err := db.Select(&rows, `SELECT p.id AS package_id, p.name AS package_name, v.version, v.metadata, v.released_at, v.yanked_at, v.release_notes_html, v.release_notes_updated_at, u.username AS publisher
+		FROM package_versions v JOIN packages p ON p.id = v.package_id LEFT JOIN users u ON u.id = v.released_by
+		WHERE v.quarantined_at IS NULL AND p.quarantined_at IS NULL AND `+where+`
+		ORDER BY v.released_at DESC, v.id DESC LIMIT ?`, append(args, feedSize)...)
+	return rows, err
+}
+
+// versionChangelog returns the changelog field of JSON version metadata, or
+// "" when there is none.
+func versionChangelog(metadata string) string {
+	var m struct {
+		Changelog string `json:"changelog"`
+	}
+	if json.Unmarshal([]byte(metadata), &m) != nil {
+		return ""
+	}
+	return m.Changelog
+}
+
+// writeFeed renders releases as an Atom feed, with their release notes or
+// else the metadata changelog as content. The feed's updated time, that of
+// the latest release, yank or notes edit, is sent as Last-Modified and a
+// hash of the body as ETag; conditional requests matching either get 304.
+func writeFeed(c *gin.Context, id, title, alternate string, releases []feedRelease) {
+	feed := atom.Feed{
+		ID:    id,
+		Title: title,
+		Links: []atom.Link{{Href: id, Rel: "self", Type: "application/atom+xml"}, {Href: alternate, Rel: "alternate"}},
+	}
+	for _, r := range releases {
+		url := baseURL() + "/packages/" + strconv.FormatInt(r.PackageID, 10) + "/versions/" + r.Version
+		released := r.ReleasedAt
+		e := atom.Entry{
+			ID:        url,
+			Title:     r.PackageName + " " + r.Version,
+			Updated:   r.ReleasedAt,
+			Published: &released,
+			Links:     []atom.Link{{Href: url, Rel: "alternate"}},
+		}
+		if r.NotesHTML != "" {
+			e.Content = atom.HTML(r.NotesHTML)
+		} else {
+			e.Content = atom.HTML(markdown.Render(versionChangelog(r.Metadata)))
+		}
+		if r.YankedAt != nil {
+			e.Title += " (yanked)"
+			if r.YankedAt.After(e.Updated) {
+				e.Updated = *r.YankedAt
+			}
+		}
+		if r.NotesAt != nil && r.NotesAt.After(e.Updated) {
+			e.Updated = *r.NotesAt
+		}
+		if r.Publisher.Valid {
+			e.Author = &atom.Person{Name: r.Publisher.String}
+		}
+		if e.Updated.After(feed.Updated) {
+			feed.Updated = e.Updated
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	if feed.Updated.IsZero() {
+		// an empty feed; keep it stable so it stays cacheable
+		feed.Updated = time.Unix(0, 0)
+	}
+	body, err := atom.Marshal(&feed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	modified := feed.Updated.UTC().Truncate(time.Second)
+
+	// feeds of private packages must not land in shared caches
+	if claimsFrom(c) != nil {
+		c.Header("Cache-Control", "private, max-age=300")
+	} else {
+		c.Header("Cache-Control", "public, max-age=300")
+	}
+	c.Header("Vary", "Authorization")
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	} else if t, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !modified.After(t) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, atom.ContentType, body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, compared
+// weakly as RFC 9110 asks for GET.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// PackageFeedHandler is an Atom feed of the package's releases.
+func PackageFeedHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		var name string
+		if err := db.Get(&name, `SELECT name FROM packages WHERE id = ?`, pkgID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		releases, err := feedReleases(db, "p.id = ?", pkgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		base := baseURL() + "/packages/" + strconv.FormatInt(pkgID, 10)
+		writeFeed(c, base+"/releases.atom", name+" releases", base, releases)
+	}
+}
+
+// RecentReleasesFeedHandler is an Atom feed of the latest releases across
+// the packages the caller can read.
+func RecentReleasesFeedHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clause, args, err := readablePackagesClause(db, claimsFrom(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		releases, err := feedReleases(db, clause, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		writeFeed(c, baseURL()+"/feeds/releases.atom", "Recent releases", baseURL()+"/", releases)
+	}
+}
+
+// CategoryFeedHandler and BucketFeedHandler are Atom feeds of the latest
+// releases of the packages in a category or bucket.
+func CategoryFeedHandler(db *sqlx.DB) gin.HandlerFunc {
+	return groupFeedHandler(db, "categories", "package_categories", "category_id", "category")
+}
+
+func BucketFeedHandler(db *sqlx.DB) gin.HandlerFunc {
+	return groupFeedHandler(db, "buckets", "package_buckets", "bucket_id", "bucket")
+}
+
+func groupFeedHandler(db *sqlx.DB, table, memberTable, column, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + kind + " id"})
+			return
+		}
+		var name string
+		if err := db.Get(&name, `SELECT name FROM `+table+` WHERE id = ?`, id); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": kind + " not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		clause, args, err := readablePackagesClause(db, claimsFrom(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		releases, err := feedReleases(db, `p.id IN (SELECT package_id FROM `+memberTable+` WHERE `+column+` = ?) AND `+clause, append([]interface{}{id}, args...)...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		self := baseURL() + "/feeds/" + table + "/" + strconv.FormatInt(id, 10) + "/releases.atom"
+		writeFeed(c, self, "Recent releases in "+name, baseURL()+"/search?"+kind+"="+strconv.FormatInt(id, 10), releases)
+	}
+}
@@ -21,12 +21,77 @@ func MeHandler(db *sqlx.DB) gin.HandlerFunc {
 			ID       int64  `db:"id" json:"id"`
 			Username string `db:"username" json:"username"`
 			Role     string `db:"role" json:"role"`
+			Email    string `db:"email" json:"email"`
+			Verified bool   `db:"email_verified" json:"email_verified"`
+			TwoFA    bool   `db:"two_factor" json:"two_factor"`
 		}
-		err := db.Get(&user, `SELECT id, username, role FROM users WHERE id = ? LIMIT 1`, claims.UserID)
+		err := db.Get(&user, `SELECT id, username, role, email, email_verified_at IS NOT NULL AS email_verified, totp_enabled_at IS NOT NULL AS two_factor FROM users WHERE id = ? LIMIT 1`, claims.UserID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"id": user.ID, "username": user.Username, "role": user.Role})
+		c.JSON(http.StatusOK, gin.H{"id": user.ID, "username": user.Username, "role": user.Role, "email": user.Email, "email_verified": user.Verified, "two_factor": user.TwoFA})
+	}
+}
+
+// ChangePasswordHandler replaces the caller's password after checking the
+// current one. Refresh tokens of other sessions are revoked; the session
+// making the change stays signed in.
+func ChangePasswordHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var req struct {
+			CurrentPassword string `json:"current_password" binding:"required"`
+			NewPassword     string `json:"new_password" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var user struct {
+			Username string `db:"username"`
+			Password string `db:"password_hash"`
+		}
+		if err := db.Get(&user, `SELECT username, password_hash FROM users WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		pc := auth.PasswordConfigFromEnv()
+		if ok, _ := pc.Verify(user.Password, req.CurrentPassword); !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "current password is incorrect"})
+			return
+		}
+		if err := pc.Validate(req.NewPassword, user.Username); err != nil {
+			passwordError(c, err)
+			return
+		}
+		pw, err := pc.Hash(req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, pw, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		keep := ""
+		if rt, err := c.Cookie("ebuild_refresh"); err == nil {
+			keep = hashTokenRaw(rt)
+		}
+		var revoked []string
+		if err := db.Select(&revoked, `UPDATE tokens SET revoked_at = datetime('now') WHERE owner_user_id = ? AND scopes = 'refresh' AND revoked_at IS NULL AND token_hash != ? RETURNING token_hash`, claims.UserID, keep); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, h := range revoked {
+			_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, meta) VALUES (?, ?, ?, ?, ?)`, "refresh_revoked", h, claims.UserID, claims.UserID, "password_changed")
+		}
+		auditEvent(db, c, "password_changed", "user", claims.UserID, "")
+		c.JSON(http.StatusOK, gin.H{"status": "password updated", "sessions_revoked": len(revoked)})
 	}
 }
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"ebuild/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones. Only their hashes are stored.
+func newRecoveryCodes(tx *sqlx.Tx, userID int64) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(recoveryEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hashTokenRaw(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery code,
+// consuming whichever matched.
+func verifySecondFactor(db *sqlx.DB, c *gin.Context, userID int64, code string) (bool, error) {
+	var u struct {
+		Secret      sql.NullString `db:"totp_secret"`
+		LastCounter int64          `db:"totp_last_counter"`
+	}
+	if err := db.Get(&u, `SELECT totp_secret, totp_last_counter FROM users WHERE id = ?`, userID); err != nil {
+		return false, err
+	}
+	if u.Secret.Valid {
+		if counter, ok := auth.ValidateTOTP(u.Secret.String, code, time.Now(), u.LastCounter); ok {
+			// the counter check makes concurrent use of one code fail
+			res, err := db.Exec(`UPDATE users SET totp_last_counter = ? WHERE id = ? AND totp_last_counter < ?`, counter, userID, counter)
+			if err != nil {
+				return false, err
+			}
+			n, _ := res.RowsAffected()
+			return n == 1, nil
+		}
+	}
+	var id int64
+	err := db.Get(&id, `UPDATE recovery_codes SET used_at = datetime('now') WHERE user_id = ? AND code_hash = ? AND used_at IS NULL RETURNING id`, userID, hashTokenRaw(normalizeRecoveryCode(code)))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	auditEvent(db, c, "recovery_code_used", "user", userID, "")
+	return true, nil
+}
+
+// LoginMFAHandler completes a login started by LoginHandler for accounts
+// with 2FA. Wrong codes count as failed logins.
+func LoginMFAHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			MFAToken string `json:"mfa_token" binding:"required"`
+			Code     string `json:"code" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		claims, err := auth.ParseToken(signingKey, req.MFAToken)
+		if err != nil || !claims.HasScope(auth.ScopeMFA) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired challenge"})
+			return
+		}
+		var username string
+		if err := db.Get(&username, `SELECT username FROM users WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired challenge"})
+			return
+		}
+		guard := loginGuard{db}
+		locked, err := guard.lockedFor(claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if locked > 0 {
+			c.Header("Retry-After", ceilSeconds(locked))
+			c.JSON(http.StatusLocked, gin.H{"error": "account temporarily locked"})
+			return
+		}
+		ok, err := verifySecondFactor(db, c, claims.UserID, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			locked, err := guard.recordFailure(username, c.ClientIP(), claims.UserID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if locked > 0 {
+				auditEvent(db, c, "account_locked", "user", claims.UserID, "duration="+locked.String())
+				c.Header("Retry-After", ceilSeconds(locked))
+				c.JSON(http.StatusLocked, gin.H{"error": "account temporarily locked"})
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+			return
+		}
+		guard.recordSuccess(username)
+		issueSession(c, db, signingKey, claims.UserID, username)
+	}
+}
+
+// BeginTOTPHandler starts enrollment by storing a fresh secret. 2FA is not
+// enabled until ConfirmTOTPHandler sees a code generated from it.
+func BeginTOTPHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var user struct {
+			Username string         `db:"username"`
+			Enabled  sql.NullString `db:"totp_enabled_at"`
+		}
+		if err := db.Get(&user, `SELECT username, totp_enabled_at FROM users WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.Enabled.Valid {
+			c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		secret, err := auth.NewTOTPSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET totp_secret = ?, totp_last_counter = 0 WHERE id = ?`, secret, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": auth.TOTPURI("ebuild", user.Username, secret)})
+	}
+}
+
+// ConfirmTOTPHandler enables 2FA and returns the recovery codes. They are
+// shown only this once.
+func ConfirmTOTPHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var req struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var user struct {
+			Secret  sql.NullString `db:"totp_secret"`
+			Enabled sql.NullString `db:"totp_enabled_at"`
+		}
+		if err := db.Get(&user, `SELECT totp_secret, totp_enabled_at FROM users WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.Enabled.Valid {
+			c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		if !user.Secret.Valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "start enrollment first"})
+			return
+		}
+		counter, ok := auth.ValidateTOTP(user.Secret.String, req.Code, time.Now(), 0)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+			return
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE users SET totp_enabled_at = datetime('now'), totp_last_counter = ? WHERE id = ?`, counter, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		codes, err := newRecoveryCodes(tx, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "2fa_enabled", "user", claims.UserID, "")
+		c.JSON(http.StatusOK, gin.H{"status": "enabled", "recovery_codes": codes})
+	}
+}
+
+// DisableTOTPHandler turns 2FA off. It needs the password and a second
+// factor, so a stolen session alone cannot remove it.
+func DisableTOTPHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var req struct {
+			Password string `json:"password" binding:"required"`
+			Code     string `json:"code" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var hash string
+		if err := db.Get(&hash, `SELECT password_hash FROM users WHERE id = ? AND totp_enabled_at IS NOT NULL`, claims.UserID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if ok, _ := auth.PasswordConfigFromEnv().Verify(hash, req.Password); !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "password is incorrect"})
+			return
+		}
+		ok, err := verifySecondFactor(db, c, claims.UserID, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid code"})
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_counter = 0 WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, _ = db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, claims.UserID)
+		auditEvent(db, c, "2fa_disabled", "user", claims.UserID, "")
+		c.JSON(http.StatusOK, gin.H{"status": "disabled"})
+	}
+}
+
+// RegenerateRecoveryCodesHandler invalidates the old recovery codes and
+// returns a new set.
+func RegenerateRecoveryCodesHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var req struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ok, err := verifySecondFactor(db, c, claims.UserID, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid code"})
+			return
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		codes, err := newRecoveryCodes(tx, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "recovery_codes_regenerated", "user", claims.UserID, "")
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
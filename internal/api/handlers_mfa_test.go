@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ebuild/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// mfaDB is an in-memory database with the tables verifySecondFactor uses and
+// user 1 enrolled with secret.
+func mfaDB(t *testing.T, secret string) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each connection would get its own empty database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	db.MustExec(`CREATE TABLE users (id INTEGER PRIMARY KEY, totp_secret TEXT, totp_last_counter INTEGER NOT NULL DEFAULT 0)`)
+	db.MustExec(`CREATE TABLE recovery_codes (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, code_hash TEXT NOT NULL, used_at DATETIME)`)
+	db.MustExec(`CREATE TABLE audit_log (id INTEGER PRIMARY KEY AUTOINCREMENT, action TEXT, actor_user_id INTEGER, target_type TEXT, target_id INTEGER, ip TEXT, meta TEXT)`)
+	db.MustExec(`INSERT INTO users (id, totp_secret) VALUES (1, ?)`, secret)
+	return db
+}
+
+func testContext() *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/login/mfa", nil)
+	return c
+}
+
+func TestVerifySecondFactorTOTPReplay(t *testing.T) {
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mfaDB(t, secret)
+	code, err := auth.TOTPCode(secret, time.Now().Unix()/30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verifySecondFactor(db, testContext(), 1, code); err != nil || !ok {
+		t.Fatalf("first use = %v, %v; want accepted", ok, err)
+	}
+	if ok, err := verifySecondFactor(db, testContext(), 1, code); err != nil || ok {
+		t.Fatalf("replay = %v, %v; want rejected", ok, err)
+	}
+	var last int64
+	db.Get(&last, `SELECT totp_last_counter FROM users WHERE id = 1`)
+	if last == 0 {
+		t.Error("totp_last_counter was not advanced")
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	db := mfaDB(t, "")
+	db.MustExec(`UPDATE users SET totp_secret = NULL`)
+	tx := db.MustBegin()
+	codes, err := newRecoveryCodes(tx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	var stored []string
+	db.Select(&stored, `SELECT code_hash FROM recovery_codes`)
+	for _, h := range stored {
+		for _, code := range codes {
+			if h == code || h == normalizeRecoveryCode(code) {
+				t.Fatalf("recovery code %s stored in the clear", code)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"as shown", codes[0], true},
+		{"used twice", codes[0], false},
+		{"upper case with a space", strings.ToUpper(strings.Replace(codes[1], "-", " ", 1)), true},
+		{"unknown", "aaaaa-aaaaa", false},
+	}
+	for _, tt := range tests {
+		if ok, err := verifySecondFactor(db, testContext(), 1, tt.code); err != nil || ok != tt.want {
+			t.Errorf("%s: verifySecondFactor(%q) = %v, %v; want %v", tt.name, tt.code, ok, err, tt.want)
+		}
+	}
+	var audited int
+	db.Get(&audited, `SELECT COUNT(*) FROM audit_log WHERE action = 'recovery_code_used'`)
+	if audited != 2 {
+		t.Errorf("audited %d recovery code uses, want 2", audited)
+	}
+
+	// regenerating replaces the old set
+	tx = db.MustBegin()
+	if _, err := newRecoveryCodes(tx, 1); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if ok, _ := verifySecondFactor(db, testContext(), 1, codes[2]); ok {
+		t.Error("a code from the replaced set was accepted")
+	}
+}
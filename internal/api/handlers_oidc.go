@@ -0,0 +1,299 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/oidc"
+	"ebuild/internal/pkgname"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	oidcFlowCookie = "ebuild_oidc"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// oidcConfigFromEnv reads EBUILD_OIDC_ISSUER, EBUILD_OIDC_CLIENT_ID,
+// EBUILD_OIDC_CLIENT_SECRET, EBUILD_OIDC_REDIRECT_URL and EBUILD_OIDC_SCOPES.
+// OIDC login is off unless issuer and client id are set.
+func oidcConfigFromEnv() (oidcConfig, bool) {
+	cfg := oidcConfig{
+		Issuer:       os.Getenv("EBUILD_OIDC_ISSUER"),
+		ClientID:     os.Getenv("EBUILD_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("EBUILD_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("EBUILD_OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("EBUILD_OIDC_SCOPES")),
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = baseURL() + "/oidc/callback"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return cfg, cfg.Issuer != "" && cfg.ClientID != ""
+}
+
+// oidcFlow is kept in a signed cookie between the redirect to the provider
+// and the callback.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func OIDCLoginHandler(signingKey []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg, ok := oidcConfigFromEnv()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+			return
+		}
+		p, err := oidc.Cached(c.Request.Context(), cfg.Issuer)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		state, err1 := oidc.RandomString(24)
+		nonce, err2 := oidc.RandomString(24)
+		verifier, challenge, err3 := oidc.NewPKCE()
+		if err := errors.Join(err1, err2, err3); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		flow := oidcFlow{State: state, Nonce: nonce, Verifier: verifier}
+		flow.ExpiresAt = jwt.NewNumericDate(time.Now().Add(oidcFlowTTL))
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, flow).SignedString(signingKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// Lax so the cookie comes back on the provider's cross-site redirect
+		// to the callback
+		http.SetCookie(c.Writer, &http.Cookie{Name: oidcFlowCookie, Value: signed, Path: "/oidc", HttpOnly: true, Secure: os.Getenv("EBUILD_COOKIE_SECURE") == "1", SameSite: http.SameSiteLaxMode, MaxAge: int(oidcFlowTTL.Seconds())})
+		c.Redirect(http.StatusFound, p.AuthCodeURL(cfg.ClientID, cfg.RedirectURL, state, nonce, challenge, cfg.Scopes))
+	}
+}
+
+// OIDCCallbackHandler finishes the code flow, signs the user in with the
+// same cookie pair LoginHandler sets and sends the browser back to the UI.
+func OIDCCallbackHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg, ok := oidcConfigFromEnv()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+			return
+		}
+		if e := c.Query("error"); e != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "provider returned " + e + ": " + c.Query("error_description")})
+			return
+		}
+		raw, err := c.Cookie(oidcFlowCookie)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "login flow expired, start again"})
+			return
+		}
+		http.SetCookie(c.Writer, &http.Cookie{Name: oidcFlowCookie, Value: "", Path: "/oidc", HttpOnly: true, MaxAge: -1})
+		var flow oidcFlow
+		if _, err := jwt.ParseWithClaims(raw, &flow, func(t *jwt.Token) (interface{}, error) { return signingKey, nil }, jwt.WithValidMethods([]string{"HS256"})); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "login flow expired, start again"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(flow.State), []byte(c.Query("state"))) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state mismatch"})
+			return
+		}
+		p, err := oidc.Cached(c.Request.Context(), cfg.Issuer)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		rawID, err := p.Exchange(c.Request.Context(), cfg.ClientID, cfg.ClientSecret, cfg.RedirectURL, c.Query("code"), flow.Verifier)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		tok, err := p.Verify(c.Request.Context(), rawID, cfg.ClientID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(flow.Nonce), []byte(tok.Nonce)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "nonce mismatch"})
+			return
+		}
+		userID, err := oidcUser(db, c, tok)
+		if err != nil {
+			if err == errOIDCEmailTaken || err == errOIDCNoEmail || err == errOIDCLocalUnverified {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var mfa bool
+		if err := db.Get(&mfa, `SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if mfa {
+			// the UI picks the challenge up from the fragment and asks for
+			// a code, as after a password login
+			challenge, err := auth.NewToken(signingKey, userID, []string{auth.ScopeMFA}, mfaChallengeTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+				return
+			}
+			c.Redirect(http.StatusFound, "/static/index.html#mfa_token="+challenge)
+			return
+		}
+		if _, _, ok := startSession(c, db, signingKey, userID); !ok {
+			return
+		}
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
+var (
+	errOIDCEmailTaken = errors.New("an account with this email exists; the provider must report the address as verified to link it")
+	errOIDCNoEmail    = errors.New("the provider did not share an email address")
+	// an unverified local address may have been registered by someone else,
+	// who would keep their password on the linked account
+	errOIDCLocalUnverified = errors.New("an account with this email exists but has not verified it; sign in with its password and verify the address before linking")
+)
+
+// oidcUser maps a verified ID token to a local user: by a linked identity,
+// else by linking the account with the same email when both the provider and
+// the account have verified it, else by creating a new account.
+func oidcUser(db *sqlx.DB, c *gin.Context, tok *oidc.IDToken) (int64, error) {
+	var userID int64
+	err := db.Get(&userID, `SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`, tok.Issuer, tok.Subject)
+	if err == nil {
+		_, _ = db.Exec(`UPDATE user_identities SET last_login_at = datetime('now'), email = ? WHERE issuer = ? AND subject = ?`, tok.Email, tok.Issuer, tok.Subject)
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	if tok.Email == "" {
+		return 0, errOIDCNoEmail
+	}
+	var local struct {
+		ID       int64 `db:"id"`
+		Verified bool  `db:"verified"`
+	}
+	err = db.Get(&local, `SELECT id, email_verified_at IS NOT NULL AS verified FROM users WHERE lower(email) = lower(?)`, tok.Email)
+	userID = local.ID
+	switch {
+	case err == nil && !local.Verified:
+		return 0, errOIDCLocalUnverified
+	case err == nil && tok.EmailVerified:
+		if _, err := db.Exec(`INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, ?, datetime('now'))`, userID, tok.Issuer, tok.Subject, tok.Email); err != nil {
+			return 0, err
+		}
+		auditEvent(db, c, "identity_linked", "user", userID, "issuer="+tok.Issuer)
+		return userID, nil
+	case err == nil:
+		return 0, errOIDCEmailTaken
+	case err != sql.ErrNoRows:
+		return 0, err
+	}
+
+	candidate := tok.PreferredUsername
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(tok.Email, "@")
+	}
+	username, err := freeUsername(db, candidate)
+	if err != nil {
+		return 0, err
+	}
+	// the account has no usable password until the user sets one through
+	// the reset flow
+	unusable, err := oidc.RandomString(32)
+	if err != nil {
+		return 0, err
+	}
+	var verifiedAt interface{}
+	if tok.EmailVerified {
+		verifiedAt = time.Now().UTC().Format("2006-01-02 15:04:05")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO users (username, email, password_hash, role, email_verified_at) VALUES (?, ?, ?, ?, ?)`, username, tok.Email, "!"+unusable, defaultRole(), verifiedAt)
+	if err != nil {
+		return 0, err
+	}
+	userID, _ = res.LastInsertId()
+	if _, err := tx.Exec(`INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, ?, datetime('now'))`, userID, tok.Issuer, tok.Subject, tok.Email); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	log.Printf("created user %s (%d) from %s", username, userID, tok.Issuer)
+	auditEvent(db, c, "user_created", "user", userID, "via=oidc issuer="+tok.Issuer)
+	return userID, nil
+}
+
+var usernameJunkRe = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// freeUsername derives an available username from candidate, appending a
+// number on collisions with users or organizations.
+func freeUsername(db *sqlx.DB, candidate string) (string, error) {
+	base := strings.Trim(usernameJunkRe.ReplaceAllString(strings.ToLower(candidate), "-"), "-._")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 32 {
+		base = base[:32]
+	}
+	for i := 1; i < 1000; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		n, err := pkgname.Parse(name)
+		if err != nil || n.Reserved() {
+			continue
+		}
+		taken, err := usernameTaken(db, n.Normalized())
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			var org int
+			err = db.Get(&org, `SELECT 1 FROM organizations WHERE normalized_name = ? LIMIT 1`, n.Normalized())
+			if err == sql.ErrNoRows {
+				return name, nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return "", fmt.Errorf("no free username for %q", candidate)
+}
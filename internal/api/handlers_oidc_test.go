@@ -0,0 +1,23 @@
+package api
+
+import "testing"
+
+func TestFreeUsername(t *testing.T) {
+	db := authDB(t)
+	db.MustExec(`ALTER TABLE users ADD COLUMN username TEXT`)
+	db.MustExec(`CREATE TABLE organizations (id INTEGER PRIMARY KEY, normalized_name TEXT)`)
+	db.MustExec(`INSERT INTO users (id, username) VALUES (2, 'jane__doe')`)
+	db.MustExec(`INSERT INTO organizations (id, normalized_name) VALUES (1, 'jane-doe-2')`)
+	tests := []struct {
+		candidate, want string
+	}{
+		{"Jane.Doe", "jane.doe-3"},
+		{"john doe", "john-doe"},
+		{"!!!", "user"},
+	}
+	for _, tt := range tests {
+		if got, err := freeUsername(db, tt.candidate); err != nil || got != tt.want {
+			t.Errorf("freeUsername(%q) = %q, %v; want %q", tt.candidate, got, err, tt.want)
+		}
+	}
+}
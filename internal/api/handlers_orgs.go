@@ -0,0 +1,723 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/models"
+	"ebuild/internal/pkgname"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+const orgColumns = `id, name, normalized_name, display_name, require_2fa, created_at`
+
+var errTwoFactorRequired = errors.New("this organization requires two-factor authentication to publish")
+
+// checkOrgTwoFactor returns errTwoFactorRequired when the org requires 2FA
+// and the user has not enabled it.
+func checkOrgTwoFactor(db *sqlx.DB, orgID, userID int64) error {
+	var missing bool
+	err := db.Get(&missing, `SELECT o.require_2fa AND u.totp_enabled_at IS NULL FROM organizations o, users u WHERE o.id = ? AND u.id = ?`, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if missing {
+		return errTwoFactorRequired
+	}
+	return nil
+}
+
+// effectiveOrgRole returns the user's role in the org, or "" for
+// non-members. Site admins act as owners of every org.
+func effectiveOrgRole(db *sqlx.DB, orgID, userID int64) (models.OrgRole, error) {
+	var siteRole string
+	if err := db.Get(&siteRole, `SELECT role FROM users WHERE id = ?`, userID); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if siteRole == string(models.RoleAdmin) {
+		return models.OrgRoleOwner, nil
+	}
+	var role models.OrgRole
+	if err := db.Get(&role, `SELECT role FROM org_members WHERE org_id = ? AND user_id = ?`, orgID, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// orgForCaller loads the :org route param and checks that the caller holds at
+// least min in it. On failure the response has already been written.
+func orgForCaller(c *gin.Context, db *sqlx.DB, min models.OrgRole) (*models.Organization, *auth.Claims, bool) {
+	ci, exists := c.Get(string(CtxClaims))
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return nil, nil, false
+	}
+	claims := ci.(*auth.Claims)
+	if claims.TrustedPublisher {
+		c.JSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
+		return nil, nil, false
+	}
+	var org models.Organization
+	if err := db.Get(&org, `SELECT `+orgColumns+` FROM organizations WHERE normalized_name = ?`, pkgname.Normalize(c.Param("org"))); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+			return nil, nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	if claims.OrgID != 0 && claims.OrgID != org.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "token is bound to another organization"})
+		return nil, nil, false
+	}
+	role, err := effectiveOrgRole(db, org.ID, claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	if !role.AtLeast(min) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "requires organization role " + string(min)})
+		return nil, nil, false
+	}
+	return &org, claims, true
+}
+
+// usernameTaken reports whether some user's username normalizes to
+// normalized, the way package scopes do. SQL only narrows the candidates to
+// usernames with the same letters once separators are dropped;
+// pkgname.Normalize decides, so "a__b" and "a-b" collide.
+func usernameTaken(db *sqlx.DB, normalized string) (bool, error) {
+	var names []string
+	err := db.Select(&names, `SELECT username FROM users WHERE replace(replace(replace(lower(username), '-', ''), '_', ''), '.', '') = ?`, strings.ReplaceAll(normalized, "-", ""))
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if pkgname.Normalize(n) == normalized {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func CreateOrgHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		var req struct {
+			Name        string `json:"name" binding:"required"`
+			DisplayName string `json:"display_name"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		name, err := pkgname.Parse(strings.TrimSpace(req.Name))
+		if err != nil || name.Scope != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid organization name"})
+			return
+		}
+		if name.Reserved() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "organization name is reserved"})
+			return
+		}
+		// org names share the scope namespace with usernames
+		taken, err := usernameTaken(db, name.Normalized())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "name is already used by a user"})
+			return
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(`INSERT INTO organizations (name, normalized_name, display_name, created_by) VALUES (?, ?, ?, ?)`, name.String(), name.Normalized(), req.DisplayName, claims.UserID)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				c.JSON(http.StatusConflict, gin.H{"error": "organization already exists"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := res.LastInsertId()
+		if _, err := tx.Exec(`INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)`, id, claims.UserID, models.OrgRoleOwner); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"id": id, "name": name.String()})
+	}
+}
+
+func GetOrgHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var org models.Organization
+		if err := db.Get(&org, `SELECT `+orgColumns+` FROM organizations WHERE normalized_name = ?`, pkgname.Normalize(c.Param("org"))); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var packages []struct {
+			ID   int64  `db:"id" json:"id"`
+			Name string `db:"name" json:"name"`
+		}
+		readable, readableArgs, err := readablePackagesClause(db, claimsFrom(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Select(&packages, `SELECT p.id, p.name FROM packages p WHERE p.org_id = ? AND `+readable+` ORDER BY p.name`, append([]interface{}{org.ID}, readableArgs...)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		out := gin.H{"organization": org, "packages": packages}
+		// membership details are only visible to members
+		if ci, exists := c.Get(string(CtxClaims)); exists {
+			role, err := effectiveOrgRole(db, org.ID, ci.(*auth.Claims).UserID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if role.Valid() {
+				var members []models.OrgMember
+				if err := db.Select(&members, `SELECT om.user_id, u.username, om.role FROM org_members om JOIN users u ON u.id = om.user_id WHERE om.org_id = ? ORDER BY u.username`, org.ID); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				var teams []models.Team
+				if err := db.Select(&teams, `SELECT id, org_id, name, created_at FROM teams WHERE org_id = ? ORDER BY name`, org.ID); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				out["members"] = members
+				out["teams"] = teams
+				out["role"] = role
+			}
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// UpdateOrgHandler changes org settings; org admins and owners only.
+func UpdateOrgHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		var req struct {
+			DisplayName *string `json:"display_name"`
+			Require2FA  *bool   `json:"require_2fa"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var sets []string
+		var args []interface{}
+		if req.DisplayName != nil {
+			sets = append(sets, "display_name = ?")
+			args = append(args, strings.TrimSpace(*req.DisplayName))
+		}
+		if req.Require2FA != nil {
+			sets = append(sets, "require_2fa = ?")
+			args = append(args, *req.Require2FA)
+		}
+		if len(sets) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+			return
+		}
+		args = append(args, org.ID)
+		if _, err := db.Exec(`UPDATE organizations SET `+strings.Join(sets, ", ")+` WHERE id = ?`, args...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Require2FA != nil && *req.Require2FA != org.Require2FA {
+			auditEvent(db, c, "org_require_2fa_changed", "org", org.ID, fmt.Sprintf("require_2fa=%t", *req.Require2FA))
+		}
+		var updated models.Organization
+		if err := db.Get(&updated, `SELECT `+orgColumns+` FROM organizations WHERE id = ?`, org.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"organization": updated})
+	}
+}
+
+func SetOrgMemberHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, claims, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		var req struct {
+			Role models.OrgRole `json:"role" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !req.Role.Valid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of owner, admin, publisher, viewer"})
+			return
+		}
+		var userID int64
+		if err := db.Get(&userID, `SELECT id FROM users WHERE username = ?`, c.Param("username")); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		callerRole, err := effectiveOrgRole(db, org.ID, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		current, err := effectiveOrgRole(db, org.ID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// only owners may create owners or change an owner's role
+		if (req.Role == models.OrgRoleOwner || current == models.OrgRoleOwner) && callerRole != models.OrgRoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only owners can grant or change the owner role"})
+			return
+		}
+		if current == models.OrgRoleOwner && req.Role != models.OrgRoleOwner {
+			if last, err := isLastOwner(db, org.ID, userID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			} else if last {
+				c.JSON(http.StatusConflict, gin.H{"error": "organization must keep at least one owner"})
+				return
+			}
+		}
+		_, err = db.Exec(`INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?) ON CONFLICT(org_id, user_id) DO UPDATE SET role = excluded.role`, org.ID, userID, req.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func RemoveOrgMemberHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// members may always leave; removing others needs admin
+		org, claims, ok := orgForCaller(c, db, models.OrgRoleViewer)
+		if !ok {
+			return
+		}
+		var userID int64
+		if err := db.Get(&userID, `SELECT id FROM users WHERE username = ?`, c.Param("username")); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		callerRole, err := effectiveOrgRole(db, org.ID, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var current models.OrgRole
+		if err := db.Get(&current, `SELECT role FROM org_members WHERE org_id = ? AND user_id = ?`, org.ID, userID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not a member"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if userID != claims.UserID {
+			if !callerRole.AtLeast(models.OrgRoleAdmin) || (current == models.OrgRoleOwner && callerRole != models.OrgRoleOwner) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to remove this member"})
+				return
+			}
+		}
+		if current == models.OrgRoleOwner {
+			if last, err := isLastOwner(db, org.ID, userID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			} else if last {
+				c.JSON(http.StatusConflict, gin.H{"error": "organization must keep at least one owner"})
+				return
+			}
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM team_members WHERE user_id = ? AND team_id IN (SELECT id FROM teams WHERE org_id = ?)`, userID, org.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := tx.Exec(`DELETE FROM org_members WHERE org_id = ? AND user_id = ?`, org.ID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func isLastOwner(db *sqlx.DB, orgID, userID int64) (bool, error) {
+	var others int
+	if err := db.Get(&others, `SELECT COUNT(*) FROM org_members WHERE org_id = ? AND role = 'owner' AND user_id != ?`, orgID, userID); err != nil {
+		return false, err
+	}
+	return others == 0, nil
+}
+
+func CreateTeamHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		var req struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		name, err := pkgname.Parse(strings.TrimSpace(req.Name))
+		if err != nil || name.Scope != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid team name"})
+			return
+		}
+		res, err := db.Exec(`INSERT INTO teams (org_id, name) VALUES (?, ?)`, org.ID, name.Normalized())
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				c.JSON(http.StatusConflict, gin.H{"error": "team already exists"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		id, _ := res.LastInsertId()
+		c.JSON(http.StatusCreated, gin.H{"id": id, "name": name.Normalized()})
+	}
+}
+
+func DeleteTeamHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		res, err := db.Exec(`DELETE FROM teams WHERE org_id = ? AND name = ?`, org.ID, pkgname.Normalize(c.Param("team")))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+			return
+		}
+		// team_members and team_packages have no cascade without foreign_keys enabled
+		_, _ = db.Exec(`DELETE FROM team_members WHERE team_id NOT IN (SELECT id FROM teams)`)
+		_, _ = db.Exec(`DELETE FROM team_packages WHERE team_id NOT IN (SELECT id FROM teams)`)
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
+
+func teamID(db *sqlx.DB, orgID int64, name string) (int64, error) {
+	var id int64
+	err := db.Get(&id, `SELECT id FROM teams WHERE org_id = ? AND name = ?`, orgID, pkgname.Normalize(name))
+	return id, err
+}
+
+func SetTeamMemberHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		tID, err := teamID(db, org.ID, c.Param("team"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var userID int64
+		err = db.Get(&userID, `SELECT u.id FROM users u JOIN org_members om ON om.user_id = u.id AND om.org_id = ? WHERE u.username = ?`, org.ID, c.Param("username"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user is not a member of the organization"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := db.Exec(`INSERT OR IGNORE INTO team_members (team_id, user_id) VALUES (?, ?)`, tID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func RemoveTeamMemberHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		tID, err := teamID(db, org.ID, c.Param("team"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM team_members WHERE team_id = ? AND user_id = (SELECT id FROM users WHERE username = ?)`, tID, c.Param("username")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func SetTeamPackageHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		var req struct {
+			Role models.OrgRole `json:"role" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !req.Role.Valid() || req.Role == models.OrgRoleOwner {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of admin, publisher, viewer"})
+			return
+		}
+		tID, err := teamID(db, org.ID, c.Param("team"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var pkgID int64
+		if err := db.Get(&pkgID, `SELECT id FROM packages WHERE id = ? AND org_id = ?`, c.Param("package_id"), org.ID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "package not found in organization"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, err = db.Exec(`INSERT INTO team_packages (team_id, package_id, role) VALUES (?, ?, ?) ON CONFLICT(team_id, package_id) DO UPDATE SET role = excluded.role`, tID, pkgID, req.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recordEvent(db, EventMaintainerChanged, pkgID, gin.H{"change": "team_granted", "org": org.Name, "team": c.Param("team"), "role": req.Role})
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func RemoveTeamPackageHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, _, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		tID, err := teamID(db, org.ID, c.Param("team"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "team not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res, err := db.Exec(`DELETE FROM team_packages WHERE team_id = ? AND package_id = ?`, tID, c.Param("package_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			pkgID, _ := strconv.ParseInt(c.Param("package_id"), 10, 64)
+			recordEvent(db, EventMaintainerChanged, pkgID, gin.H{"change": "team_revoked", "org": org.Name, "team": c.Param("team")})
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// TransferPackageHandler moves a package into an organization, or back to
+// its creator when org is empty. The caller must be able to publish the
+// package and be an admin of the receiving (or current) organization.
+func TransferPackageHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		if claims.TrustedPublisher {
+			c.JSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
+			return
+		}
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		var req struct {
+			Org string `json:"org"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ok, err := canPublish(db, claims, pkgID)
+		if err != nil {
+			publishError(c, err)
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
+			return
+		}
+		var current sql.NullInt64
+		if err := db.Get(&current, `SELECT org_id FROM packages WHERE id = ?`, pkgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var target *int64
+		if req.Org != "" {
+			var org models.Organization
+			if err := db.Get(&org, `SELECT `+orgColumns+` FROM organizations WHERE normalized_name = ?`, pkgname.Normalize(req.Org)); err != nil {
+				if err == sql.ErrNoRows {
+					c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			target = &org.ID
+		}
+		for _, orgID := range []*int64{target, nullInt64Ptr(current)} {
+			if orgID == nil {
+				continue
+			}
+			role, err := effectiveOrgRole(db, *orgID, claims.UserID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !role.AtLeast(models.OrgRoleAdmin) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "requires organization role admin"})
+				return
+			}
+		}
+		if _, err := db.Exec(`UPDATE packages SET org_id = ? WHERE id = ?`, target, pkgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// grants from the previous org's teams no longer apply
+		_, _ = db.Exec(`DELETE FROM team_packages WHERE package_id = ?`, pkgID)
+		recordEvent(db, EventMaintainerChanged, pkgID, gin.H{"change": "transferred", "org": req.Org})
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// CreateOrgTokenHandler issues a token on behalf of an org, for CI, valid
+// for expires_in_days or ten years. It carries the issuer's identity but
+// only acts on the org's packages, with the read and maintain scopes.
+func CreateOrgTokenHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, claims, ok := orgForCaller(c, db, models.OrgRoleAdmin)
+		if !ok {
+			return
+		}
+		var req struct {
+			Scopes        []string `json:"scopes" binding:"required"`
+			ExpiresInDays int      `json:"expires_in_days"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := validScopes(req.Scopes, "read", "maintain"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ttl, err := tokenTTL(req.ExpiresInDays)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tokenStr, err := auth.NewTokenFromClaims(signingKey, auth.Claims{UserID: claims.UserID, Scopes: req.Scopes, OrgID: org.ID}, ttl)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+		hash := fmtHash(tokenStr)
+		_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, org_id, created_at) VALUES (?, ?, 1, ?, ?, datetime('now'))`, claims.UserID, hash, strings.Join(req.Scopes, ","), org.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, meta) VALUES (?, ?, ?, ?, ?)`, "org_token_generated", hash, claims.UserID, claims.UserID, "org="+org.Name)
+		c.JSON(http.StatusOK, gin.H{"token": tokenStr})
+	}
+}
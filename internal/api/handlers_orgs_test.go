@@ -0,0 +1,25 @@
+package api
+
+import "testing"
+
+func TestUsernameTaken(t *testing.T) {
+	db := authDB(t)
+	db.MustExec(`ALTER TABLE users ADD COLUMN username TEXT`)
+	db.MustExec(`INSERT INTO users (id, username) VALUES (2, 'a__b'), (3, 'Foo.-_Bar'), (4, 'ab')`)
+	tests := []struct {
+		normalized string
+		want       bool
+	}{
+		{"a-b", true},
+		{"foo-bar", true},
+		{"ab", true},
+		{"a-b-c", false},
+		{"foobar", false},
+	}
+	for _, tt := range tests {
+		got, err := usernameTaken(db, tt.normalized)
+		if err != nil || got != tt.want {
+			t.Errorf("usernameTaken(%q) = %v, %v; want %v", tt.normalized, got, err, tt.want)
+		}
+	}
+}
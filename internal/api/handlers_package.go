@@ -2,18 +2,37 @@ package api
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"ebuild/internal/auth"
+	"ebuild/internal/markdown"
 	"ebuild/internal/models"
+	"ebuild/internal/pkgname"
+	"ebuild/internal/spdx"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
+const packageColumns = `id, name, description, created_by, token_required, org_id, COALESCE(license, '') AS license, homepage, repository_url, keywords, readme, readme_html, created_at, quarantined_at, quarantine_reason`
+
+const (
+	maxKeywords          = 20
+	maxKeywordLen        = 50
+	maxReadmeBytes       = 512 * 1024
+	maxReleaseNotesBytes = 64 * 1024
+	maxURLLen            = 2048
+)
+
+var keywordRe = regexp.MustCompile(`^[a-z0-9][a-z0-9+._-]*$`)
+
 func CreatePackageHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ci, exists := c.Get(string(CtxClaims))
@@ -22,16 +41,72 @@ func CreatePackageHandler(db *sqlx.DB) gin.HandlerFunc {
 			return
 		}
 		claims := ci.(*auth.Claims)
+		if claims.TrustedPublisher {
+			c.JSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
+			return
+		}
+		var role models.Role
+		if err := db.Get(&role, `SELECT role FROM users WHERE id = ?`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if role == models.RolePublic {
+			c.JSON(http.StatusForbidden, gin.H{"error": "creating packages requires the maintainer role"})
+			return
+		}
 
 		var req struct {
 			Name        string `json:"name" binding:"required"`
 			Description string `json:"description"`
+			Private     bool   `json:"private"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		res, err := db.Exec(`INSERT INTO packages (name, description, created_by, token_required) VALUES (?, ?, ?, 1)`, req.Name, req.Description, claims.UserID)
+		name, err := pkgname.Parse(strings.TrimSpace(req.Name))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if name.Reserved() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": pkgname.ErrReserved.Error()})
+			return
+		}
+		var orgID *int64
+		if name.Scope != "" {
+			var ok bool
+			orgID, ok, err = resolveScope(db, claims.UserID, name.NormalizedScope())
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !ok {
+				c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to publish under @" + name.Scope})
+				return
+			}
+		}
+		if claims.OrgID != 0 && (orgID == nil || *orgID != claims.OrgID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "organization tokens can only create packages in the organization's scope"})
+			return
+		}
+		if orgID != nil {
+			if err := checkOrgTwoFactor(db, *orgID, claims.UserID); err != nil {
+				publishError(c, err)
+				return
+			}
+		}
+		var existing string
+		err = db.Get(&existing, `SELECT name FROM packages WHERE normalized_name = ? LIMIT 1`, name.Normalized())
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "name conflicts with existing package " + existing})
+			return
+		}
+		if err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res, err := db.Exec(`INSERT INTO packages (name, normalized_name, description, created_by, token_required, org_id) VALUES (?, ?, ?, ?, ?, ?)`, name.String(), name.Normalized(), req.Description, claims.UserID, req.Private, orgID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -41,11 +116,97 @@ func CreatePackageHandler(db *sqlx.DB) gin.HandlerFunc {
 	}
 }
 
+// resolveScope reports whether the user may create packages under @scope
+// and, for organization scopes, which org will own them. A user's own
+// (normalized) username is a personal scope; an organization's name is usable
+// by its publishers and up. Admins may use any scope.
+func resolveScope(db *sqlx.DB, userID int64, scope string) (orgID *int64, ok bool, err error) {
+	var org models.Organization
+	err = db.Get(&org, `SELECT `+orgColumns+` FROM organizations WHERE normalized_name = ?`, scope)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	}
+	if err == nil {
+		role, err := effectiveOrgRole(db, org.ID, userID)
+		if err != nil {
+			return nil, false, err
+		}
+		return &org.ID, role.AtLeast(models.OrgRolePublisher), nil
+	}
+	var u struct {
+		Username string `db:"username"`
+		Role     string `db:"role"`
+	}
+	if err := db.Get(&u, `SELECT username, role FROM users WHERE id = ?`, userID); err != nil {
+		return nil, false, err
+	}
+	if u.Role == string(models.RoleAdmin) {
+		return nil, true, nil
+	}
+	return nil, pkgname.Normalize(u.Username) == scope, nil
+}
+
+// PackageByNameHandler serves the name-based mirror of the package routes:
+//
+//	/packages/by-name/<name>
+//	/packages/by-name/<name>/versions
+//	/packages/by-name/<name>/versions/<ver>
+//	/packages/by-name/<name>/versions/<ver>/artifacts
+//
+// where <name> may be scoped (@scope/name). The name is resolved through its
+// normalized form and the request is handed to the id-based handler.
+func PackageByNameHandler(db *sqlx.DB) gin.HandlerFunc {
+	getPackage := GetPackageHandler(db)
+	listVersions := ListVersionsHandler(db)
+	getVersion := GetVersionHandler(db)
+	listArtifacts := ListArtifactsHandler(db)
+	return func(c *gin.Context) {
+		parts := strings.Split(strings.Trim(c.Param("path"), "/"), "/")
+		name := parts[0]
+		rest := parts[1:]
+		if strings.HasPrefix(name, "@") && len(parts) > 1 {
+			name += "/" + parts[1]
+			rest = parts[2:]
+		}
+		var id int64
+		if err := db.Get(&id, `SELECT id FROM packages WHERE normalized_name = ? LIMIT 1`, pkgname.Normalize(name)); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if ok, err := canRead(db, claimsFrom(c), id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.Params = gin.Params{{Key: "id", Value: strconv.FormatInt(id, 10)}}
+		switch {
+		case len(rest) == 0:
+			getPackage(c)
+		case len(rest) == 1 && rest[0] == "versions":
+			listVersions(c)
+		case len(rest) == 2 && rest[0] == "versions":
+			c.Params = append(c.Params, gin.Param{Key: "ver", Value: rest[1]})
+			getVersion(c)
+		case len(rest) == 3 && rest[0] == "versions" && rest[2] == "artifacts":
+			c.Params = append(c.Params, gin.Param{Key: "ver", Value: rest[1]})
+			listArtifacts(c)
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		}
+	}
+}
+
 func GetPackageHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
 		var pkg models.Package
-		err := db.Get(&pkg, `SELECT id, name, description, created_by, token_required, created_at FROM packages WHERE id = ?`, id)
+		err := db.Get(&pkg, `SELECT `+packageColumns+` FROM packages WHERE id = ?`, id)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
@@ -55,7 +216,8 @@ func GetPackageHandler(db *sqlx.DB) gin.HandlerFunc {
 			return
 		}
 		var ver models.PackageVersion
-		err = db.Get(&ver, `SELECT id, package_id, version, metadata, released_by, released_at, is_deprecated FROM package_versions WHERE package_id = ? ORDER BY released_at DESC LIMIT 1`, id)
+		// quarantined and yanked versions are never resolved as latest
+		err = db.Get(&ver, `SELECT id, package_id, version, metadata, released_by, released_at, is_deprecated, release_notes, release_notes_html FROM package_versions WHERE package_id = ? AND quarantined_at IS NULL AND yanked_at IS NULL ORDER BY released_at DESC LIMIT 1`, id)
 		if err != nil && err != sql.ErrNoRows {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -64,30 +226,238 @@ func GetPackageHandler(db *sqlx.DB) gin.HandlerFunc {
 	}
 }
 
-func isMaintainerOrAdmin(db *sqlx.DB, userID int64, pkgID int64) (bool, error) {
+func UpdatePackageHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		ok, err := canPublish(db, claims, pkgID)
+		if err != nil {
+			publishError(c, err)
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
+			return
+		}
+		// nil fields are left unchanged; an empty string clears the field
+		var req struct {
+			Description   *string   `json:"description"`
+			Homepage      *string   `json:"homepage"`
+			RepositoryURL *string   `json:"repository_url"`
+			License       *string   `json:"license"`
+			Keywords      *[]string `json:"keywords"`
+			Readme        *string   `json:"readme"`
+			Private       *bool     `json:"private"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var sets []string
+		var args []interface{}
+		if req.Description != nil {
+			sets = append(sets, "description = ?")
+			args = append(args, strings.TrimSpace(*req.Description))
+		}
+		for _, f := range []struct {
+			col string
+			val *string
+		}{{"homepage", req.Homepage}, {"repository_url", req.RepositoryURL}} {
+			if f.val == nil {
+				continue
+			}
+			u := strings.TrimSpace(*f.val)
+			if u != "" && !validMetadataURL(u) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + f.col + ": must be an absolute http(s) URL"})
+				return
+			}
+			sets = append(sets, f.col+" = ?")
+			args = append(args, u)
+		}
+		if req.License != nil {
+			var lic interface{}
+			if strings.TrimSpace(*req.License) != "" {
+				norm, err := spdx.Normalize(*req.License)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid license: " + err.Error()})
+					return
+				}
+				lic = norm
+			}
+			sets = append(sets, "license = ?")
+			args = append(args, lic)
+		}
+		if req.Keywords != nil {
+			kws, err := normalizeKeywords(*req.Keywords)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			sets = append(sets, "keywords = ?")
+			args = append(args, kws)
+		}
+		if req.Readme != nil {
+			if len(*req.Readme) > maxReadmeBytes {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "readme too large"})
+				return
+			}
+			sets = append(sets, "readme = ?", "readme_html = ?")
+			args = append(args, *req.Readme, markdown.Render(*req.Readme))
+		}
+		if req.Private != nil {
+			sets = append(sets, "token_required = ?")
+			args = append(args, *req.Private)
+		}
+		if len(sets) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+			return
+		}
+		args = append(args, pkgID)
+		if _, err := db.Exec(`UPDATE packages SET `+strings.Join(sets, ", ")+` WHERE id = ?`, args...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var pkg models.Package
+		if err := db.Get(&pkg, `SELECT `+packageColumns+` FROM packages WHERE id = ?`, pkgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"package": pkg})
+	}
+}
+
+func validMetadataURL(s string) bool {
+	if len(s) > maxURLLen {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func normalizeKeywords(in []string) (models.StringList, error) {
+	seen := map[string]bool{}
+	var out models.StringList
+	for _, k := range in {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == "" || seen[k] {
+			continue
+		}
+		if len(k) > maxKeywordLen || !keywordRe.MatchString(k) {
+			return nil, fmt.Errorf("invalid keyword %q", k)
+		}
+		seen[k] = true
+		out = append(out, k)
+	}
+	if len(out) > maxKeywords {
+		return nil, fmt.Errorf("at most %d keywords allowed", maxKeywords)
+	}
+	return out, nil
+}
+
+// isMaintainerOrAdmin reports whether the caller holds publish rights on the
+// package. Site admins have them on every package, but only through a token
+// that may exercise the admin role.
+func isMaintainerOrAdmin(db *sqlx.DB, claims *auth.Claims, pkgID int64) (bool, error) {
+	userID := claims.UserID
 	var role string
 	if err := db.Get(&role, `SELECT role FROM users WHERE id = ?`, userID); err != nil {
 		return false, err
 	}
-	if role == string(models.RoleAdmin) {
-		return true, nil
+	switch role {
+	case string(models.RoleAdmin):
+		if claims.AdminCapable() {
+			return true, nil
+		}
+	case string(models.RolePublic):
+		// demoted users keep their packages but cannot publish
+		return false, nil
 	}
-	var owner sql.NullInt64
-	if err := db.Get(&owner, `SELECT created_by FROM packages WHERE id = ?`, pkgID); err != nil {
+	var pkg struct {
+		CreatedBy sql.NullInt64 `db:"created_by"`
+		OrgID     sql.NullInt64 `db:"org_id"`
+	}
+	if err := db.Get(&pkg, `SELECT created_by, org_id FROM packages WHERE id = ?`, pkgID); err != nil {
 		return false, err
 	}
-	if owner.Valid && owner.Int64 == userID {
+	var exists int
+	if pkg.OrgID.Valid {
+		// org-owned packages go by org and team roles alone, so leaving the
+		// org or a team ends the rights; being the creator or a maintainer
+		// from before the transfer grants nothing: publishers and up in the
+		// org, or members of a team of that org granted publish rights on
+		// the package
+		err := db.Get(&exists, `SELECT 1 FROM org_members WHERE org_id = ? AND user_id = ? AND role IN ('owner', 'admin', 'publisher')
+			UNION ALL
+			SELECT 1 FROM team_packages tp JOIN teams t ON t.id = tp.team_id JOIN team_members tm ON tm.team_id = tp.team_id WHERE tp.package_id = ? AND t.org_id = ? AND tm.user_id = ? AND tp.role IN ('admin', 'publisher')
+			LIMIT 1`, pkg.OrgID.Int64, userID, pkgID, pkg.OrgID.Int64, userID)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if pkg.CreatedBy.Valid && pkg.CreatedBy.Int64 == userID {
 		return true, nil
 	}
-	var exists int
 	err := db.Get(&exists, `SELECT 1 FROM package_maintainers WHERE package_id = ? AND user_id = ? LIMIT 1`, pkgID, userID)
-	if err != nil {
-		if err == sql.ErrNoRows {
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// canPublish is isMaintainerOrAdmin for the caller's token. Tokens limited
+// to some packages, or issued on behalf of an organization, only act on those
+// packages, and still require their issuer to hold publish rights. Packages
+// of orgs that require 2FA yield errTwoFactorRequired for callers without it.
+func canPublish(db *sqlx.DB, claims *auth.Claims, pkgID int64) (bool, error) {
+	if !claims.AllowsPackage(pkgID) {
+		return false, nil
+	}
+	if claims.OrgID != 0 {
+		var orgID sql.NullInt64
+		if err := db.Get(&orgID, `SELECT org_id FROM packages WHERE id = ?`, pkgID); err != nil {
+			return false, err
+		}
+		if !orgID.Valid || orgID.Int64 != claims.OrgID {
 			return false, nil
 		}
+	}
+	ok, err := isMaintainerOrAdmin(db, claims, pkgID)
+	if err != nil || !ok {
+		return false, err
+	}
+	var orgID sql.NullInt64
+	if err := db.Get(&orgID, `SELECT org_id FROM packages WHERE id = ?`, pkgID); err != nil {
 		return false, err
 	}
-	return exists == 1, nil
+	if orgID.Valid {
+		if err := checkOrgTwoFactor(db, orgID.Int64, claims.UserID); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// publishError answers for a failed canPublish: 403 when the org's 2FA
+// policy blocks the caller, 404 for missing packages, 500 otherwise.
+func publishError(c *gin.Context, err error) {
+	switch err {
+	case errTwoFactorRequired:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
 
 func CreateVersionHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
@@ -104,18 +474,28 @@ func CreateVersionHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 			return
 		}
 		claims := ci.(*auth.Claims)
-		ok, err := isMaintainerOrAdmin(db, claims.UserID, pkgID64)
+		ok, err := canPublish(db, claims, pkgID64)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			publishError(c, err)
 			return
 		}
 		if !ok {
 			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
 			return
 		}
+		var quarantined bool
+		if err := db.Get(&quarantined, `SELECT quarantined_at IS NOT NULL FROM packages WHERE id = ?`, pkgID64); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if quarantined {
+			c.JSON(http.StatusForbidden, gin.H{"error": "package is quarantined"})
+			return
+		}
 		var req struct {
-			Version  string `json:"version" binding:"required"`
-			Metadata string `json:"metadata"`
+			Version      string `json:"version" binding:"required"`
+			Metadata     string `json:"metadata"`
+			ReleaseNotes string `json:"release_notes"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -125,12 +505,17 @@ func CreateVersionHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid semver"})
 			return
 		}
-		res, err := db.Exec(`INSERT INTO package_versions (package_id, version, metadata, released_by, released_at) VALUES (?, ?, ?, ?, ?)`, pkgID64, req.Version, req.Metadata, claims.UserID, time.Now())
+		if len(req.ReleaseNotes) > maxReleaseNotesBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "release notes too large"})
+			return
+		}
+		res, err := db.Exec(`INSERT INTO package_versions (package_id, version, metadata, released_by, released_at, release_notes, release_notes_html) VALUES (?, ?, ?, ?, ?, ?, ?)`, pkgID64, req.Version, req.Metadata, claims.UserID, time.Now(), req.ReleaseNotes, markdown.Render(req.ReleaseNotes))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		id, _ := res.LastInsertId()
+		recordEvent(db, EventVersionPublished, pkgID64, gin.H{"version": req.Version, "version_id": id, "released_by": claims.UserID})
 		c.JSON(http.StatusCreated, gin.H{"id": id})
 	}
 }
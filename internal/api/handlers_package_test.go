@@ -0,0 +1,110 @@
+package api
+
+import (
+	"testing"
+
+	"ebuild/internal/auth"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// packageDB is authDB plus the tables that decide package access.
+func packageDB(t *testing.T) *sqlx.DB {
+	db := authDB(t)
+	db.MustExec(`CREATE TABLE packages (id INTEGER PRIMARY KEY, created_by INTEGER, org_id INTEGER, token_required INTEGER NOT NULL DEFAULT 0)`)
+	db.MustExec(`CREATE TABLE package_maintainers (package_id INTEGER, user_id INTEGER)`)
+	db.MustExec(`CREATE TABLE org_members (org_id INTEGER, user_id INTEGER, role TEXT)`)
+	db.MustExec(`CREATE TABLE teams (id INTEGER PRIMARY KEY, org_id INTEGER)`)
+	db.MustExec(`CREATE TABLE team_members (team_id INTEGER, user_id INTEGER)`)
+	db.MustExec(`CREATE TABLE team_packages (team_id INTEGER, package_id INTEGER, role TEXT)`)
+	return db
+}
+
+func TestIsMaintainerOrAdmin(t *testing.T) {
+	db := packageDB(t)
+	// users: 2 creator, 3 maintainer, 4 org publisher, 5 org member,
+	// 6 publisher through a team, 7 in a team of another org, 8 demoted
+	db.MustExec(`INSERT INTO users (id, role) VALUES (2, 'maintainer'), (3, 'maintainer'), (4, 'maintainer'), (5, 'maintainer'), (6, 'maintainer'), (7, 'maintainer'), (8, 'public')`)
+	// package 10 is personal, 20 belongs to org 1 and was created by user 2
+	// before the transfer
+	db.MustExec(`INSERT INTO packages (id, created_by, org_id) VALUES (10, 2, NULL), (20, 2, 1), (30, 8, NULL)`)
+	db.MustExec(`INSERT INTO package_maintainers VALUES (10, 3), (20, 3)`)
+	db.MustExec(`INSERT INTO org_members VALUES (1, 4, 'publisher'), (1, 5, 'member'), (1, 6, 'member')`)
+	db.MustExec(`INSERT INTO teams VALUES (1, 1), (2, 9)`)
+	db.MustExec(`INSERT INTO team_members VALUES (1, 6), (2, 7)`)
+	db.MustExec(`INSERT INTO team_packages VALUES (1, 20, 'publisher'), (2, 20, 'publisher')`)
+
+	tests := []struct {
+		name string
+		user int64
+		pkg  int64
+		want bool
+	}{
+		{"creator of a personal package", 2, 10, true},
+		{"maintainer of a personal package", 3, 10, true},
+		{"stranger", 4, 10, false},
+		{"creator no longer in the org", 2, 20, false},
+		{"maintainer from before the transfer", 3, 20, false},
+		{"org publisher", 4, 20, true},
+		{"org member", 5, 20, false},
+		{"team publisher", 6, 20, true},
+		{"team of another org", 7, 20, false},
+		{"demoted creator", 8, 30, false},
+	}
+	for _, tt := range tests {
+		got, err := isMaintainerOrAdmin(db, &auth.Claims{UserID: tt.user, Scopes: []string{"maintain"}}, tt.pkg)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: isMaintainerOrAdmin(%d, %d) = %v, %v; want %v", tt.name, tt.user, tt.pkg, got, err, tt.want)
+		}
+	}
+}
+
+func TestCanReadOrgPackage(t *testing.T) {
+	db := packageDB(t)
+	db.MustExec(`INSERT INTO users (id, role) VALUES (2, 'maintainer'), (3, 'maintainer'), (4, 'maintainer')`)
+	db.MustExec(`INSERT INTO packages (id, created_by, org_id, token_required) VALUES (10, 2, NULL, 1), (20, 2, 1, 1)`)
+	db.MustExec(`INSERT INTO package_maintainers VALUES (10, 3), (20, 3)`)
+	db.MustExec(`INSERT INTO org_members VALUES (1, 4, 'member')`)
+
+	tests := []struct {
+		user int64
+		pkg  int64
+		want bool
+	}{
+		{2, 10, true},
+		{3, 10, true},
+		{4, 10, false},
+		{2, 20, false},
+		{3, 20, false},
+		{4, 20, true},
+	}
+	for _, tt := range tests {
+		got, err := canRead(db, &auth.Claims{UserID: tt.user, Scopes: []string{"read"}}, tt.pkg)
+		if err != nil || got != tt.want {
+			t.Errorf("canRead(user %d, package %d) = %v, %v; want %v", tt.user, tt.pkg, got, err, tt.want)
+		}
+	}
+}
+
+func TestIsMaintainerOrAdminAdminTokens(t *testing.T) {
+	db := packageDB(t)
+	db.MustExec(`INSERT INTO packages (id, created_by, org_id) VALUES (10, 2, NULL), (11, 1, NULL)`)
+	tests := []struct {
+		name   string
+		claims auth.Claims
+		pkg    int64
+		want   bool
+	}{
+		{"session", auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}, SessionID: "s"}, 10, true},
+		{"admin scope", auth.Claims{UserID: 1, Scopes: []string{"maintain", auth.ScopeAdmin}}, 10, true},
+		{"maintain token", auth.Claims{UserID: 1, Scopes: []string{"maintain"}}, 10, false},
+		{"maintain token on own package", auth.Claims{UserID: 1, Scopes: []string{"maintain"}}, 11, true},
+		{"trusted publisher", auth.Claims{UserID: 1, Scopes: []string{"maintain"}, PackageIDs: []int64{10}, TrustedPublisher: true}, 10, false},
+	}
+	for _, tt := range tests {
+		got, err := isMaintainerOrAdmin(db, &tt.claims, tt.pkg)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: isMaintainerOrAdmin = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
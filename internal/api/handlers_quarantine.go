@@ -0,0 +1,167 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ebuild/internal/mail"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+var errVersionNotFound = errors.New("version not found")
+
+// setQuarantine quarantines (on) or releases the package, or only the named
+// versions of it, audits each change and mails the maintainers. It returns
+// what actually changed: "package" or the version strings. Versions already
+// in the requested state are skipped.
+func setQuarantine(db *sqlx.DB, c *gin.Context, mailer mail.Mailer, pkgID int64, versions []string, on bool, reason string) ([]string, error) {
+	var pkgName string
+	if err := db.Get(&pkgName, `SELECT name FROM packages WHERE id = ?`, pkgID); err != nil {
+		return nil, err
+	}
+	actor := claimsFrom(c).UserID
+	pkgAction, versionAction := "package_quarantined", "version_quarantined"
+	if !on {
+		pkgAction, versionAction = "package_released", "version_released"
+	}
+	var changed []string
+	if len(versions) == 0 {
+		var res sql.Result
+		var err error
+		if on {
+			res, err = db.Exec(`UPDATE packages SET quarantined_at = datetime('now'), quarantine_reason = ?, quarantined_by = ? WHERE id = ? AND quarantined_at IS NULL`, reason, actor, pkgID)
+		} else {
+			res, err = db.Exec(`UPDATE packages SET quarantined_at = NULL, quarantine_reason = '', quarantined_by = NULL WHERE id = ? AND quarantined_at IS NOT NULL`, pkgID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			changed = append(changed, "package")
+			auditEvent(db, c, pkgAction, "package", pkgID, reason)
+		}
+	} else {
+		// resolve every version first so a typo changes nothing
+		ids := make([]int64, len(versions))
+		for i, v := range versions {
+			if err := db.Get(&ids[i], `SELECT id FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, v); err != nil {
+				if err == sql.ErrNoRows {
+					return nil, fmt.Errorf("%w: %s", errVersionNotFound, v)
+				}
+				return nil, err
+			}
+		}
+		for i, v := range versions {
+			versionID := ids[i]
+			var res sql.Result
+			var err error
+			if on {
+				res, err = db.Exec(`UPDATE package_versions SET quarantined_at = datetime('now'), quarantine_reason = ?, quarantined_by = ? WHERE id = ? AND quarantined_at IS NULL`, reason, actor, versionID)
+			} else {
+				res, err = db.Exec(`UPDATE package_versions SET quarantined_at = NULL, quarantine_reason = '', quarantined_by = NULL WHERE id = ? AND quarantined_at IS NOT NULL`, versionID)
+			}
+			if err != nil {
+				return changed, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				changed = append(changed, v)
+				auditEvent(db, c, versionAction, "package", pkgID, strings.TrimSpace("version="+v+" "+reason))
+			}
+		}
+	}
+	if len(changed) > 0 {
+		notifyQuarantine(db, mailer, pkgID, pkgName, changed, on, reason)
+	}
+	return changed, nil
+}
+
+// notifyQuarantine mails the package's creator and maintainers. Delivery
+// errors are logged; the takedown stands either way.
+func notifyQuarantine(db *sqlx.DB, mailer mail.Mailer, pkgID int64, pkgName string, changed []string, on bool, reason string) {
+	var recipients []struct {
+		Username string `db:"username"`
+		Email    string `db:"email"`
+	}
+	err := db.Select(&recipients, `SELECT username, email FROM users WHERE deleted_at IS NULL AND email != '' AND (
+		id = (SELECT created_by FROM packages WHERE id = ?) OR id IN (SELECT user_id FROM package_maintainers WHERE package_id = ?))`, pkgID, pkgID)
+	if err != nil {
+		log.Printf("quarantine notification for package %d: %v", pkgID, err)
+		return
+	}
+	what := pkgName
+	if changed[0] != "package" {
+		what = pkgName + " " + strings.Join(changed, ", ")
+	}
+	subject, body := "Quarantined on ebuild: "+what, "an ebuild administrator quarantined %s. Its artifacts can no longer be downloaded"+
+		" and it is skipped when resolving the latest version.\n\nReason: %s\n\nReply to this message if you believe this is a mistake.\n"
+	if !on {
+		subject, body = "Released from quarantine on ebuild: "+what, "an ebuild administrator released %s from quarantine. Its artifacts can be downloaded again.%s\n"
+		if reason != "" {
+			reason = "\n\nNote: " + reason
+		}
+	}
+	for _, r := range recipients {
+		err := mailer.Send(mail.Message{To: r.Email, Subject: subject, Body: fmt.Sprintf("Hello %s,\n\n"+body, r.Username, what, reason)})
+		if err != nil {
+			log.Printf("quarantine notification to user %s: %v", r.Username, err)
+		}
+	}
+}
+
+// QuarantinePackageHandler takes a package down, or only the listed
+// versions when versions is given. Quarantined artifacts answer 451 and
+// quarantined versions are skipped as latest version.
+func QuarantinePackageHandler(db *sqlx.DB, mailer mail.Mailer) gin.HandlerFunc {
+	return quarantineHandler(db, mailer, true)
+}
+
+// UnquarantinePackageHandler reverses QuarantinePackageHandler.
+func UnquarantinePackageHandler(db *sqlx.DB, mailer mail.Mailer) gin.HandlerFunc {
+	return quarantineHandler(db, mailer, false)
+}
+
+func quarantineHandler(db *sqlx.DB, mailer mail.Mailer, on bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		var req struct {
+			Reason   string   `json:"reason"`
+			Versions []string `json:"versions"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if on && req.Reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reason is required"})
+			return
+		}
+		changed, err := setQuarantine(db, c, mailer, pkgID, req.Versions, on, req.Reason)
+		if err != nil {
+			switch {
+			case err == sql.ErrNoRows:
+				c.JSON(http.StatusNotFound, gin.H{"error": "package not found"})
+			case errors.Is(err, errVersionNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		if changed == nil {
+			changed = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"quarantined": on, "changed": changed})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -15,6 +16,11 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// refreshReuseGrace is how long after a rotation the old refresh token may
+// come back without ending the session: two tabs refreshing at once both
+// send the same cookie, and only one of them wins the rotation.
+const refreshReuseGrace = 10 * time.Second
+
 func RefreshHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		cookie, err := c.Request.Cookie("ebuild_refresh")
@@ -36,13 +42,39 @@ func RefreshHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 		}
 		h := sha256.Sum256([]byte(refreshTok))
 		hS := hex.EncodeToString(h[:])
-		var revoked sql.NullString
-		err = db.Get(&revoked, `SELECT revoked_at FROM tokens WHERE token_hash = ? LIMIT 1`, hS)
-		if err != nil || revoked.Valid {
+		var row struct {
+			Revoked  sql.NullString `db:"revoked_at"`
+			FamilyID sql.NullString `db:"family_id"`
+		}
+		err = db.Get(&row, `SELECT revoked_at, family_id FROM tokens WHERE token_hash = ? LIMIT 1`, hS)
+		if err != nil || row.Revoked.Valid {
+			// a rotated-away token coming back after the grace window means
+			// it was copied; end the whole session so neither copy can
+			// continue it
+			if err == nil && row.FamilyID.Valid {
+				var recent bool
+				if db.Get(&recent, `SELECT created_at >= datetime('now', ?) FROM tokens WHERE parent_token_hash = ? LIMIT 1`, fmt.Sprintf("-%d seconds", int(refreshReuseGrace.Seconds())), hS) == nil && !recent {
+					n, _ := revokeSession(db, claims.UserID, row.FamilyID.String, "refresh_reuse")
+					if n > 0 {
+						auditEvent(db, c, "refresh_token_reused", "user", claims.UserID, "")
+					}
+				}
+			}
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token revoked or not found"})
 			return
 		}
-		accessTok, err := auth.NewToken(signingKey, claims.UserID, []string{"read", "maintain"}, time.Minute*30)
+		if err := checkAccount(db, claims.UserID); err != nil {
+			accountError(c, err)
+			return
+		}
+		sid := row.FamilyID.String
+		if !row.FamilyID.Valid {
+			if sid, err = newSessionID(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+				return
+			}
+		}
+		accessTok, err := auth.NewTokenFromClaims(signingKey, auth.Claims{UserID: claims.UserID, Scopes: []string{"read", "maintain"}, SessionID: sid}, time.Minute*30)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create access token"})
 			return
@@ -56,10 +88,33 @@ func RefreshHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 		oldHash := hex.EncodeToString(hOld[:])
 		hNew := sha256.Sum256([]byte(newRefresh))
 		newHash := hex.EncodeToString(hNew[:])
-		_, _ = db.Exec(`UPDATE tokens SET revoked_at = datetime('now') WHERE token_hash = ?`, oldHash)
-		_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, parent_token_hash, created_at) VALUES (?, ?, 0, ?, ?, datetime('now'))`, claims.UserID, newHash, "refresh", oldHash)
+		// revoking first claims the token, so of two concurrent refreshes
+		// with one cookie only one rotates; the child goes in with it so the
+		// family never looks ended in between
+		tx, err := db.Beginx()
 		if err != nil {
-			// non-fatal
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate refresh token"})
+			return
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(`UPDATE tokens SET revoked_at = datetime('now') WHERE token_hash = ? AND revoked_at IS NULL`, oldHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate refresh token"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			// another request rotated it a moment ago
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token revoked or not found"})
+			return
+		}
+		_, err = tx.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, parent_token_hash, family_id, user_agent, ip, last_used_at, created_at) VALUES (?, ?, 0, ?, ?, ?, ?, ?, datetime('now'), datetime('now'))`, claims.UserID, newHash, "refresh", oldHash, sid, userAgent(c), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate refresh token"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate refresh token"})
+			return
 		}
 		_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, parent_token_hash) VALUES (?, ?, ?, ?, ?)`, "refresh_revoked", oldHash, claims.UserID, claims.UserID, nil)
 		_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, parent_token_hash) VALUES (?, ?, ?, ?, ?)`, "refresh_created", newHash, claims.UserID, claims.UserID, oldHash)
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/mail"
+	"ebuild/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+const maxReportDetailsBytes = 2000
+
+var reportReasons = map[string]bool{"spam": true, "malware": true, "abuse": true, "impersonation": true, "other": true}
+
+// reportSelect reads reports with the reporter's name, the package name and
+// how many reports are still open on the same target.
+const reportSelect = `SELECT r.id, r.reporter_id, u.username AS reporter, r.package_id, p.name AS package_name,
+	r.target_type, r.target_id, r.reason, r.details, r.status, r.resolution, r.resolution_note,
+	r.resolved_by, r.resolved_at, r.created_at,
+	(SELECT COUNT(*) FROM reports o WHERE o.target_type = r.target_type AND o.target_id = r.target_id AND o.status = 'open') AS open_on_target
+	FROM reports r JOIN users u ON u.id = r.reporter_id JOIN packages p ON p.id = r.package_id`
+
+// CreateReportHandler files a report against the :id package, or against one
+// of its versions or comments when version or comment_id is given.
+func CreateReportHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		var req struct {
+			Reason    string `json:"reason" binding:"required"`
+			Details   string `json:"details"`
+			Version   string `json:"version"`
+			CommentID *int64 `json:"comment_id"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !reportReasons[req.Reason] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be spam, malware, abuse, impersonation or other"})
+			return
+		}
+		req.Details = strings.TrimSpace(req.Details)
+		if len(req.Details) > maxReportDetailsBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("details are longer than %d bytes", maxReportDetailsBytes)})
+			return
+		}
+		targetType, targetID := "package", pkgID
+		switch {
+		case req.Version != "" && req.CommentID != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "report either a version or a comment"})
+			return
+		case req.Version != "":
+			targetType = "version"
+			err = db.Get(&targetID, `SELECT id FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, req.Version)
+		case req.CommentID != nil:
+			targetType = "comment"
+			err = db.Get(&targetID, `SELECT id FROM comments WHERE id = ? AND package_id = ? AND deleted_at IS NULL`, *req.CommentID, pkgID)
+		}
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": targetType + " not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var id int64
+		err = db.Get(&id, `INSERT INTO reports (reporter_id, package_id, target_type, target_id, reason, details) VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+			claims.UserID, pkgID, targetType, targetID, req.Reason, req.Details)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				c.JSON(http.StatusConflict, gin.H{"error": "you already reported this " + targetType})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"id": id, "status": "open"})
+	}
+}
+
+// ListReportsHandler is the admin review queue, oldest first. status is
+// open (default), resolved or all; target_type, reason and package_id
+// filter further.
+func ListReportsHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var clauses []string
+		var args []interface{}
+		switch status := c.DefaultQuery("status", "open"); status {
+		case "open", "resolved":
+			clauses = append(clauses, "r.status = ?")
+			args = append(args, status)
+		case "all":
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open, resolved or all"})
+			return
+		}
+		if v := c.Query("target_type"); v != "" {
+			clauses = append(clauses, "r.target_type = ?")
+			args = append(args, v)
+		}
+		if v := c.Query("reason"); v != "" {
+			clauses = append(clauses, "r.reason = ?")
+			args = append(args, v)
+		}
+		if v := c.Query("package_id"); v != "" {
+			pkgID, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+				return
+			}
+			clauses = append(clauses, "r.package_id = ?")
+			args = append(args, pkgID)
+		}
+		where := ""
+		if len(clauses) > 0 {
+			where = " WHERE " + strings.Join(clauses, " AND ")
+		}
+		limit := 50
+		if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 200 {
+			limit = v
+		}
+		offset := 0
+		if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+			offset = v
+		}
+		var total int
+		if err := db.Get(&total, `SELECT COUNT(*) FROM reports r`+where, args...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports := []models.Report{}
+		if err := db.Select(&reports, reportSelect+where+` ORDER BY r.created_at, r.id LIMIT ? OFFSET ?`, append(args, limit, offset)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"reports": reports, "total": total, "limit": limit, "offset": offset})
+	}
+}
+
+// ResolveReportHandler closes a report, and every other open report on the
+// same target, with one of these actions:
+//
+//	dismiss     nothing to do
+//	hide        hide the reported comment
+//	quarantine  quarantine the reported package or version
+func ResolveReportHandler(db *sqlx.DB, mailer mail.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		reportID, err := strconv.ParseInt(c.Param("report_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+			return
+		}
+		var req struct {
+			Action string `json:"action" binding:"required"`
+			Note   string `json:"note"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var r models.Report
+		if err := db.Get(&r, reportSelect+` WHERE r.id = ?`, reportID); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if r.Status != "open" {
+			c.JSON(http.StatusConflict, gin.H{"error": "report is already resolved"})
+			return
+		}
+		note := strings.TrimSpace(req.Note)
+		var resolution string
+		switch req.Action {
+		case "dismiss":
+			resolution = "dismissed"
+		case "hide":
+			if r.TargetType != "comment" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "only comments can be hidden"})
+				return
+			}
+			resolution = "hidden"
+			if _, err := db.Exec(`UPDATE comments SET hidden_at = COALESCE(hidden_at, datetime('now')), hidden_by = COALESCE(hidden_by, ?) WHERE id = ?`, claims.UserID, r.TargetID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			auditEvent(db, c, "comment_hidden", "comment", r.TargetID, fmt.Sprintf("package=%d report=%d", r.PackageID, r.ID))
+		case "quarantine":
+			if r.TargetType == "comment" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "comments cannot be quarantined; hide them instead"})
+				return
+			}
+			resolution = "quarantined"
+			reason := fmt.Sprintf("report %d (%s)", r.ID, r.Reason)
+			if note != "" {
+				reason += ": " + note
+			}
+			var versions []string
+			if r.TargetType == "version" {
+				var v string
+				if err := db.Get(&v, `SELECT version FROM package_versions WHERE id = ?`, r.TargetID); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				versions = []string{v}
+			}
+			if _, err := setQuarantine(db, c, mailer, r.PackageID, versions, true, reason); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "action must be dismiss, hide or quarantine"})
+			return
+		}
+		res, err := db.Exec(`UPDATE reports SET status = 'resolved', resolution = ?, resolution_note = ?, resolved_by = ?, resolved_at = datetime('now')
+			WHERE target_type = ? AND target_id = ? AND status = 'open'`, resolution, note, claims.UserID, r.TargetType, r.TargetID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		n, _ := res.RowsAffected()
+		auditEvent(db, c, "report_resolved", "report", r.ID, fmt.Sprintf("resolution=%s target=%s:%d closed=%d", resolution, r.TargetType, r.TargetID, n))
+		c.JSON(http.StatusOK, gin.H{"status": "resolved", "resolution": resolution, "reports_closed": n})
+	}
+}
@@ -1,142 +1,360 @@
 package api
 
 import (
+	"database/sql"
+	"html"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
+// highlight markers emitted by FTS5; replaced by <mark> after escaping
+const (
+	hlStart = "\x02"
+	hlEnd   = "\x03"
+)
+
+const maxSearchTerms = 10
+
+type searchFacet struct {
+	ID    int64  `db:"id" json:"id,omitempty"`
+	Name  string `db:"name" json:"name"`
+	Count int64  `db:"count" json:"count"`
+}
+
 func SearchHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		q := c.Query("q")
+		q := strings.TrimSpace(c.Query("q"))
 		category := c.Query("category")
 		bucket := c.Query("bucket")
-		// default to most_downloaded on main page
-		sort := c.DefaultQuery("sort", "most_downloaded")
-		var rows []map[string]interface{}
+		license := c.Query("license")
+		terms := searchTerms(q)
+		// default to most_downloaded on main page, relevance when searching
+		defaultSort := "most_downloaded"
+		if len(terms) > 0 {
+			defaultSort = "relevance"
+		}
+		sort := c.DefaultQuery("sort", defaultSort)
 		limit := 50
-		// Simple FTS5 search if q provided
-		// see https://sqlite.org/fts5.html for details.
-		if q != "" {
-			// use parameterized query and the FTS alias 'f'
-			base := "SELECT p.id, p.name, p.description, p.download_count FROM packages p JOIN packages_fts f ON p.id = f.rowid WHERE f MATCH ?"
-			switch sort {
-			case "most_downloaded":
-				base += " ORDER BY p.download_count DESC"
-			case "random":
-				base += " ORDER BY RANDOM()"
-			default:
-				base += " ORDER BY p.created_at DESC"
-			}
-			base += " LIMIT ?"
-			log.Printf("search fts query=%s args=[%s %d]", base, q, limit)
-			rs, err := db.Query(base, q, limit)
-			if err != nil {
+
+		// private packages only show up for callers who can read them
+		readable, readableArgs, err := readablePackagesClause(db, claimsFrom(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		clauses := []string{readable}
+		args := readableArgs
+		if category != "" {
+			clauses = append(clauses, "p.id IN (SELECT package_id FROM package_categories WHERE category_id = ?)")
+			args = append(args, category)
+		}
+		if bucket != "" {
+			clauses = append(clauses, "p.id IN (SELECT package_id FROM package_buckets WHERE bucket_id = ?)")
+			args = append(args, bucket)
+		}
+		if license != "" {
+			clauses = append(clauses, "p.license = ?")
+			args = append(args, license)
+		}
+
+		var rows []map[string]interface{}
+		var matchSQL string
+		var matchArgs []interface{}
+		corrected := false
+		if len(terms) > 0 {
+			// Simple FTS5 search if q provided
+			// see https://sqlite.org/fts5.html for details.
+			rows, matchSQL, matchArgs, err = ftsSearch(db, ftsMatchExpr(terms, nil), clauses, args, sort, limit)
+			if err != nil && isFTSUnavailable(err) {
 				// if SQLite built without FTS5, fallback to LIKE search
-				if strings.Contains(err.Error(), "fts5") || strings.Contains(err.Error(), "no such module") {
-					likeQ := "%" + q + "%"
-					alt := "SELECT p.id, p.name, p.description, p.download_count FROM packages p WHERE p.name LIKE ? OR p.description LIKE ?"
-					switch sort {
-					case "most_downloaded":
-						alt += " ORDER BY p.download_count DESC"
-					case "random":
-						alt += " ORDER BY RANDOM()"
-					default:
-						alt += " ORDER BY p.created_at DESC"
-					}
-					alt += " LIMIT ?"
-					log.Printf("fts unavailable, falling back to LIKE query=%s args=[%s %s %d]", alt, likeQ, likeQ, limit)
-					rs, err = db.Query(alt, likeQ, likeQ, limit)
-					if err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-						return
-					}
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			}
-			defer rs.Close()
-			cols, _ := rs.Columns()
-			for rs.Next() {
-				vals := make([]interface{}, len(cols))
-				valPtrs := make([]interface{}, len(cols))
-				for i := range vals {
-					valPtrs[i] = &vals[i]
-				}
-				if err := rs.Scan(valPtrs...); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				m := map[string]interface{}{}
-				for i, col := range cols {
-					v := vals[i]
-					if b, ok := v.([]byte); ok {
-						m[col] = string(b)
-					} else {
-						m[col] = v
-					}
+				rows, matchSQL, matchArgs, err = likeSearch(db, q, clauses, args, sort, limit)
+			} else if err == nil && len(rows) == 0 {
+				// nothing matched as typed: retry with close terms from the index vocabulary
+				alts, verr := fuzzyAlternatives(db, terms)
+				if verr != nil {
+					log.Printf("search vocabulary lookup failed: %v", verr)
+				} else if len(alts) > 0 {
+					rows, matchSQL, matchArgs, err = ftsSearch(db, ftsMatchExpr(terms, alts), clauses, args, sort, limit)
+					corrected = len(rows) > 0
 				}
-				rows = append(rows, m)
 			}
 		} else {
-			base := "SELECT id, name, description, download_count FROM packages"
-			var clauses []string
-			var args []interface{}
-			if category != "" {
-				clauses = append(clauses, "id IN (SELECT package_id FROM package_categories WHERE category_id = ?)")
-				args = append(args, category)
+			rows, matchSQL, matchArgs, err = browseSearch(db, clauses, args, sort, limit)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		facets, err := searchFacets(db, matchSQL, matchArgs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"results": rows, "facets": facets, "corrected": corrected})
+	}
+}
+
+func ftsSearch(db *sqlx.DB, match string, clauses []string, args []interface{}, sortBy string, limit int) ([]map[string]interface{}, string, []interface{}, error) {
+	// use parameterized query; FTS5 MATCH and auxiliary functions need the
+	// table name itself, an alias is not accepted
+	from := " FROM packages p JOIN packages_fts ON p.id = packages_fts.rowid WHERE " + strings.Join(append([]string{"packages_fts MATCH ?"}, clauses...), " AND ")
+	whereArgs := append([]interface{}{match}, args...)
+	// bm25 weights follow the packages_fts column order: name, description, keywords, maintainers, readme
+	base := "SELECT p.id, p.name, p.description, p.license, p.download_count, p.vote_score, bm25(packages_fts, 10.0, 1.0, 4.0, 2.0, 0.5) AS score, highlight(packages_fts, 0, char(2), char(3)) AS name_highlight, snippet(packages_fts, 1, char(2), char(3), '…', 16) AS snippet" + from
+	switch sortBy {
+	case "relevance":
+		base += " ORDER BY score"
+	default:
+		base += searchOrder(sortBy)
+	}
+	base += " LIMIT ?"
+	queryArgs := append(append([]interface{}{}, whereArgs...), limit)
+	log.Printf("search fts query=%s args=%v", base, queryArgs)
+	rs, err := db.Query(base, queryArgs...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer rs.Close()
+	rows, err := scanRowMaps(rs)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	for _, m := range rows {
+		for _, col := range []string{"name_highlight", "snippet"} {
+			if s, ok := m[col].(string); ok {
+				m[col] = markHighlights(s)
 			}
-			if bucket != "" {
-				clauses = append(clauses, "id IN (SELECT package_id FROM package_buckets WHERE bucket_id = ?)")
-				args = append(args, bucket)
+		}
+	}
+	return rows, "SELECT p.id" + from, whereArgs, nil
+}
+
+func likeSearch(db *sqlx.DB, q string, clauses []string, args []interface{}, sortBy string, limit int) ([]map[string]interface{}, string, []interface{}, error) {
+	likeQ := "%" + q + "%"
+	from := " FROM packages p WHERE " + strings.Join(append([]string{"(p.name LIKE ? OR p.description LIKE ?)"}, clauses...), " AND ")
+	whereArgs := append([]interface{}{likeQ, likeQ}, args...)
+	alt := "SELECT p.id, p.name, p.description, p.license, p.download_count, p.vote_score" + from
+	queryArgs := append([]interface{}{}, whereArgs...)
+	switch sortBy {
+	case "relevance":
+		// without bm25, rank name hits above description-only hits
+		alt += " ORDER BY (p.name LIKE ?) DESC, p.download_count DESC"
+		queryArgs = append(queryArgs, likeQ)
+	default:
+		alt += searchOrder(sortBy)
+	}
+	alt += " LIMIT ?"
+	queryArgs = append(queryArgs, limit)
+	log.Printf("fts unavailable, falling back to LIKE query=%s args=%v", alt, queryArgs)
+	rs, err := db.Query(alt, queryArgs...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer rs.Close()
+	rows, err := scanRowMaps(rs)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return rows, "SELECT p.id" + from, whereArgs, nil
+}
+
+func browseSearch(db *sqlx.DB, clauses []string, args []interface{}, sortBy string, limit int) ([]map[string]interface{}, string, []interface{}, error) {
+	from := " FROM packages p WHERE " + strings.Join(clauses, " AND ")
+	base := "SELECT p.id, p.name, p.description, p.license, p.download_count, p.vote_score" + from + searchOrder(sortBy) + " LIMIT ?"
+	queryArgs := append(append([]interface{}{}, args...), limit)
+	log.Printf("search base query=%s args=%v", base, queryArgs)
+	rs, err := db.Query(base, queryArgs...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer rs.Close()
+	rows, err := scanRowMaps(rs)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return rows, "SELECT p.id" + from, args, nil
+}
+
+func searchOrder(sortBy string) string {
+	switch sortBy {
+	case "most_downloaded", "relevance":
+		return " ORDER BY p.download_count DESC"
+	case "top":
+		return " ORDER BY p.vote_score DESC, p.download_count DESC"
+	case "random":
+		return " ORDER BY RANDOM()"
+	default:
+		return " ORDER BY p.created_at DESC"
+	}
+}
+
+// searchFacets counts the packages matched by matchSQL per category, bucket and license.
+func searchFacets(db *sqlx.DB, matchSQL string, args []interface{}) (gin.H, error) {
+	categories := []searchFacet{}
+	if err := db.Select(&categories, `SELECT c.id, c.name, COUNT(*) AS count FROM package_categories pc JOIN categories c ON c.id = pc.category_id WHERE pc.package_id IN (`+matchSQL+`) GROUP BY c.id, c.name ORDER BY count DESC, c.name`, args...); err != nil {
+		return nil, err
+	}
+	buckets := []searchFacet{}
+	if err := db.Select(&buckets, `SELECT b.id, b.name, COUNT(*) AS count FROM package_buckets pb JOIN buckets b ON b.id = pb.bucket_id WHERE pb.package_id IN (`+matchSQL+`) GROUP BY b.id, b.name ORDER BY count DESC, b.name`, args...); err != nil {
+		return nil, err
+	}
+	licenses := []searchFacet{}
+	if err := db.Select(&licenses, `SELECT license AS name, COUNT(*) AS count FROM packages WHERE id IN (`+matchSQL+`) AND license IS NOT NULL AND license != '' GROUP BY license ORDER BY count DESC, license`, args...); err != nil {
+		return nil, err
+	}
+	return gin.H{"category": categories, "bucket": buckets, "license": licenses}, nil
+}
+
+func isFTSUnavailable(err error) bool {
+	return strings.Contains(err.Error(), "fts5") || strings.Contains(err.Error(), "no such module")
+}
+
+// searchTerms splits a free-text query into lowercase word tokens. Anything
+// that is not a letter or digit is a separator, so user input can never
+// inject FTS5 query syntax.
+func searchTerms(q string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// ftsMatchExpr builds an FTS5 MATCH expression requiring every term, each
+// as a prefix, OR'd with any close alternatives found in the vocabulary.
+func ftsMatchExpr(terms []string, alts map[string][]string) string {
+	parts := make([]string, 0, len(terms))
+	for _, t := range terms {
+		expr := `"` + t + `"*`
+		if len(alts[t]) > 0 {
+			opts := []string{expr}
+			for _, a := range alts[t] {
+				opts = append(opts, `"`+a+`"`)
 			}
-			if len(clauses) > 0 {
-				base = base + " WHERE " + strings.Join(clauses, " AND ")
+			expr = "(" + strings.Join(opts, " OR ") + ")"
+		}
+		parts = append(parts, expr)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Fuzzy matching bounds: at most fuzzyMaxTerms query terms are corrected and
+// each scans at most fuzzyMaxVocab index terms, so a zero-result search
+// costs the same however large the vocabulary grows.
+const (
+	fuzzyMaxTerms = 4
+	fuzzyMaxVocab = 2000
+)
+
+// fuzzyAlternatives looks up indexed terms within a small edit distance of
+// each query term. Short terms are left alone since almost anything is
+// within one edit of them. Candidates must share the term's first letter,
+// which keeps the vocabulary scan to one range of the index; a typo in the
+// first letter is not corrected.
+func fuzzyAlternatives(db *sqlx.DB, terms []string) (map[string][]string, error) {
+	alts := map[string][]string{}
+	looked := map[string]bool{}
+	for _, t := range terms {
+		rs := []rune(t)
+		n := len(rs)
+		if n < 4 || looked[t] {
+			continue
+		}
+		if len(looked) == fuzzyMaxTerms {
+			break
+		}
+		looked[t] = true
+		maxDist := 1
+		if n > 6 {
+			maxDist = 2
+		}
+		var vocab []string
+		err := db.Select(&vocab, `SELECT term FROM packages_fts_vocab WHERE term >= ? AND term < ? AND length(term) BETWEEN ? AND ? LIMIT ?`,
+			string(rs[0]), string(rs[0]+1), n-maxDist, n+maxDist, fuzzyMaxVocab)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		type cand struct {
+			term string
+			dist int
+		}
+		var cands []cand
+		for _, v := range vocab {
+			if d := levenshtein(t, v); d > 0 && d <= maxDist {
+				cands = append(cands, cand{v, d})
 			}
-			switch sort {
-			case "most_downloaded":
-				base += " ORDER BY download_count DESC"
-			case "random":
-				base += " ORDER BY RANDOM()"
-			default:
-				base += " ORDER BY created_at DESC"
+		}
+		sort.Slice(cands, func(i, j int) bool {
+			if cands[i].dist != cands[j].dist {
+				return cands[i].dist < cands[j].dist
 			}
-			base += " LIMIT ?"
-			args = append(args, limit)
-			log.Printf("search base query=%s args=%v", base, args)
-			rs, err := db.Query(base, args...)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+			return cands[i].term < cands[j].term
+		})
+		for i := 0; i < len(cands) && i < 3; i++ {
+			alts[t] = append(alts[t], cands[i].term)
+		}
+	}
+	return alts, nil
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
 			}
-			defer rs.Close()
-			cols, _ := rs.Columns()
-			for rs.Next() {
-				vals := make([]interface{}, len(cols))
-				valPtrs := make([]interface{}, len(cols))
-				for i := range vals {
-					valPtrs[i] = &vals[i]
-				}
-				if err := rs.Scan(valPtrs...); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				m := map[string]interface{}{}
-				for i, col := range cols {
-					v := vals[i]
-					if b, ok := v.([]byte); ok {
-						m[col] = string(b)
-					} else {
-						m[col] = v
-					}
-				}
-				rows = append(rows, m)
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// markHighlights escapes s for HTML and turns the FTS5 markers into <mark> tags.
+func markHighlights(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, hlStart, "<mark>")
+	return strings.ReplaceAll(s, hlEnd, "</mark>")
+}
+
+func scanRowMaps(rs *sql.Rows) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	cols, _ := rs.Columns()
+	for rs.Next() {
+		vals := make([]interface{}, len(cols))
+		valPtrs := make([]interface{}, len(cols))
+		for i := range vals {
+			valPtrs[i] = &vals[i]
+		}
+		if err := rs.Scan(valPtrs...); err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		for i, col := range cols {
+			v := vals[i]
+			if b, ok := v.([]byte); ok {
+				m[col] = string(b)
+			} else {
+				m[col] = v
 			}
 		}
-		c.JSON(http.StatusOK, gin.H{"results": rows})
+		rows = append(rows, m)
 	}
+	return rows, rs.Err()
 }
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFuzzyAlternatives(t *testing.T) {
+	db := authDB(t)
+	if _, err := db.Exec(`CREATE VIRTUAL TABLE packages_fts USING fts5(name)`); err != nil {
+		t.Skipf("no FTS5: %v", err)
+	}
+	db.MustExec(`CREATE VIRTUAL TABLE packages_fts_vocab USING fts5vocab(packages_fts, row)`)
+	db.MustExec(`INSERT INTO packages_fts (name) VALUES ('library'), ('zlib'), ('xibrary')`)
+	// more terms of the same length and first letter than one lookup scans
+	for i := 0; i < 2*fuzzyMaxVocab; i++ {
+		db.MustExec(`INSERT INTO packages_fts (name) VALUES (?)`, fmt.Sprintf("c%09d", i))
+	}
+
+	alts, err := fuzzyAlternatives(db, []string{"librery", "c00000000x", "zlb", "yibrary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"librery": {"library"},
+		// "yibrary" is one edit from "xibrary", but the first letter differs
+	}
+	if n := len(alts["c00000000x"]); n == 0 || n > 3 {
+		t.Errorf("alternatives for c00000000x = %v, want 1 to 3", alts["c00000000x"])
+	}
+	delete(alts, "c00000000x")
+	if !reflect.DeepEqual(alts, want) {
+		t.Errorf("fuzzyAlternatives = %v, want %v", alts, want)
+	}
+
+	many := []string{"aaaaa", "bbbbb", "ccccc", "ddddd", "libraryy"}
+	if alts, err := fuzzyAlternatives(db, many); err != nil || alts["libraryy"] != nil {
+		t.Errorf("fuzzyAlternatives looked up more than %d terms: %v, %v", fuzzyMaxTerms, alts, err)
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+
+	"ebuild/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// refreshTTL is how long a refresh token lives; a session that is not
+// refreshed within it has ended.
+const refreshTTL = 30 * 24 * time.Hour
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// userAgent is the request's User-Agent, trimmed for storage.
+func userAgent(c *gin.Context) string {
+	ua := c.Request.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	return ua
+}
+
+// sessionActive reports whether the family still holds a live refresh
+// token. Errors count as ended.
+func sessionActive(db *sqlx.DB, sid string) bool {
+	var one int
+	return db.Get(&one, `SELECT 1 FROM tokens WHERE family_id = ? AND scopes = 'refresh' AND revoked_at IS NULL LIMIT 1`, sid) == nil
+}
+
+// revokeSession revokes the user's refresh tokens in the family and records
+// why in token_audit. It returns how many were revoked.
+func revokeSession(db *sqlx.DB, userID int64, sid, reason string) (int, error) {
+	var revoked []string
+	if err := db.Select(&revoked, `UPDATE tokens SET revoked_at = datetime('now') WHERE owner_user_id = ? AND family_id = ? AND revoked_at IS NULL RETURNING token_hash`, userID, sid); err != nil {
+		return 0, err
+	}
+	for _, h := range revoked {
+		_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, meta) VALUES (?, ?, ?, ?, ?)`, "refresh_revoked", h, userID, userID, reason)
+	}
+	return len(revoked), nil
+}
+
+// clearSessionCookies signs this browser out.
+func clearSessionCookies(c *gin.Context) {
+	secure := os.Getenv("EBUILD_COOKIE_SECURE") == "1"
+	domain := os.Getenv("EBUILD_COOKIE_DOMAIN")
+	samesite := http.SameSiteStrictMode
+	if os.Getenv("EBUILD_COOKIE_SAMESITE") == "Lax" {
+		samesite = http.SameSiteLaxMode
+	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: "ebuild_refresh", Value: "", Path: "/", HttpOnly: true, Secure: secure, SameSite: samesite, Domain: domain, MaxAge: -1})
+	http.SetCookie(c.Writer, &http.Cookie{Name: "ebuild_csrf", Value: "", Path: "/", HttpOnly: false, Secure: secure, SameSite: samesite, Domain: domain, MaxAge: -1})
+}
+
+// ListSessionsHandler lists the caller's signed-in browsers, one per refresh
+// token family, newest activity first.
+func ListSessionsHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		type session struct {
+			ID         string     `db:"id" json:"id"`
+			UserAgent  string     `db:"user_agent" json:"user_agent"`
+			IP         string     `db:"ip" json:"ip"`
+			StartedAt  time.Time  `db:"started_at" json:"started_at"`
+			LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+			Current    bool       `db:"-" json:"current"`
+		}
+		sessions := []session{}
+		// the family's first token marks when the session started
+		err := db.Select(&sessions, `SELECT t.family_id AS id, t.user_agent, t.ip, t.last_used_at, f.created_at AS started_at
+			FROM tokens t
+			JOIN tokens f ON f.id = (SELECT MIN(id) FROM tokens WHERE family_id = t.family_id)
+			WHERE t.owner_user_id = ? AND t.scopes = 'refresh' AND t.revoked_at IS NULL AND t.family_id IS NOT NULL
+				AND t.created_at > ?
+			ORDER BY COALESCE(t.last_used_at, t.created_at) DESC`, claims.UserID, time.Now().Add(-refreshTTL).UTC().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == claims.SessionID
+		}
+		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	}
+}
+
+func RevokeSessionHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		sid := c.Param("id")
+		n, err := revokeSession(db, claims.UserID, sid, "session_revoked")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		if sid == claims.SessionID {
+			clearSessionCookies(c)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+	}
+}
+
+// RevokeAllSessionsHandler signs the caller out everywhere, this browser
+// included. Access tokens of those sessions stop working with them; API
+// tokens are not affected.
+func RevokeAllSessionsHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		// each live session holds exactly one unrevoked refresh token
+		var revoked []string
+		if err := db.Select(&revoked, `UPDATE tokens SET revoked_at = datetime('now') WHERE owner_user_id = ? AND scopes = 'refresh' AND revoked_at IS NULL RETURNING token_hash`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, h := range revoked {
+			_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id, meta) VALUES (?, ?, ?, ?, ?)`, "refresh_revoked", h, claims.UserID, claims.UserID, "signed_out_everywhere")
+		}
+		clearSessionCookies(c)
+		auditEvent(db, c, "signed_out_everywhere", "user", claims.UserID, "")
+		c.JSON(http.StatusOK, gin.H{"status": "revoked", "sessions_revoked": len(revoked)})
+	}
+}
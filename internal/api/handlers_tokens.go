@@ -4,8 +4,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +17,36 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// maxTokenTTL is the lifetime of generated tokens, and the longest a
+// caller may ask for.
+const maxTokenTTL = time.Hour * 24 * 365 * 10
+
+// validScopes checks that scopes is non-empty and lists only allowed
+// scopes, so a generated token cannot claim "refresh" or "mfa".
+func validScopes(scopes []string, allowed ...string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("scopes must list one or more of %s", strings.Join(allowed, ", "))
+	}
+	for _, s := range scopes {
+		if !containsString(allowed, s) {
+			return fmt.Errorf("unknown scope %q: use %s", s, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// tokenTTL is the lifetime asked for with expires_in_days, or maxTokenTTL.
+func tokenTTL(days int) (time.Duration, error) {
+	if days == 0 {
+		return maxTokenTTL, nil
+	}
+	maxDays := int(maxTokenTTL / (24 * time.Hour))
+	if days < 0 || days > maxDays {
+		return 0, fmt.Errorf("expires_in_days must be between 1 and %d", maxDays)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
 func CreateTokenHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ci, exists := c.Get(string(CtxClaims))
@@ -23,22 +55,74 @@ func CreateTokenHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 			return
 		}
 		claims := ci.(*auth.Claims)
+		if claims.TrustedPublisher {
+			c.JSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
+			return
+		}
 
 		var req struct {
-			Scopes []string `json:"scopes" binding:"required"`
+			Scopes     []string `json:"scopes" binding:"required"`
+			PackageIDs []int64  `json:"package_ids"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		ttl := time.Hour * 24 * 365 * 10
-		tokenStr, err := auth.NewToken(signingKey, claims.UserID, req.Scopes, ttl)
+		if err := validScopes(req.Scopes, "read", "maintain", auth.ScopeAdmin); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// a token can only be narrowed, never widened, by minting from it
+		if len(claims.PackageIDs) > 0 && len(req.PackageIDs) == 0 {
+			req.PackageIDs = claims.PackageIDs
+		}
+		for _, s := range req.Scopes {
+			if s != auth.ScopeAdmin && !claims.HasScope(s) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "token lacks scope " + s})
+				return
+			}
+		}
+		if containsString(req.Scopes, auth.ScopeAdmin) {
+			if len(req.PackageIDs) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "admin tokens cannot be limited to packages"})
+				return
+			}
+			admin, err := isSiteAdmin(db, claims)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !admin {
+				c.JSON(http.StatusForbidden, gin.H{"error": "only site admins can create admin tokens"})
+				return
+			}
+		}
+		var allowed []string
+		for _, id := range req.PackageIDs {
+			ok, err := canRead(db, claims, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !ok || !claims.AllowsPackage(id) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("package %d not found", id)})
+				return
+			}
+			allowed = append(allowed, strconv.FormatInt(id, 10))
+		}
+		ttl := maxTokenTTL
+		// tokens minted from an org token stay bound to that org
+		tokenStr, err := auth.NewTokenFromClaims(signingKey, auth.Claims{UserID: claims.UserID, Scopes: req.Scopes, OrgID: claims.OrgID, PackageIDs: req.PackageIDs}, ttl)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
 			return
 		}
 		hash := fmtHash(tokenStr)
-		_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, created_at) VALUES (?, ?, 1, ?, datetime('now'))`, claims.UserID, hash, strings.Join(req.Scopes, ","))
+		var orgID interface{}
+		if claims.OrgID != 0 {
+			orgID = claims.OrgID
+		}
+		_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, allowed_package_ids, org_id, created_at) VALUES (?, ?, 1, ?, ?, ?, datetime('now'))`, claims.UserID, hash, strings.Join(req.Scopes, ","), strings.Join(allowed, ","), orgID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/models"
+	"ebuild/internal/oidc"
+	"ebuild/internal/pkgname"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// trustedPublishTTL is the lifetime of tokens issued by the exchange; long
+// enough for a publish job, short enough not to be worth stealing.
+const trustedPublishTTL = 15 * time.Minute
+
+// trustedIssuers reads EBUILD_TRUSTED_ISSUERS, the CI providers whose tokens
+// may be exchanged. Only these are ever contacted for discovery, so callers
+// cannot point the server at arbitrary URLs.
+func trustedIssuers() []string {
+	if v := strings.Fields(strings.ReplaceAll(os.Getenv("EBUILD_TRUSTED_ISSUERS"), ",", " ")); len(v) > 0 {
+		return v
+	}
+	return []string{"https://token.actions.githubusercontent.com", "https://gitlab.com"}
+}
+
+func isTrustedIssuer(iss string) bool {
+	for _, t := range trustedIssuers() {
+		if t == iss {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedPublishingAudience is the aud CI tokens must be minted for, from
+// EBUILD_TRUSTED_PUBLISHING_AUDIENCE.
+func trustedPublishingAudience() string {
+	if v := os.Getenv("EBUILD_TRUSTED_PUBLISHING_AUDIENCE"); v != "" {
+		return v
+	}
+	return "ebuild"
+}
+
+// repositoryClaim is the CI repository a token was issued for: GitHub's
+// repository claim or GitLab's project_path.
+func repositoryClaim(tok *oidc.IDToken) string {
+	for _, k := range []string{"repository", "project_path"} {
+		if v, ok := tok.Claims[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// trustedPublisherPackage resolves :id for the management routes, which
+// need the same rights as publishing.
+func trustedPublisherPackage(c *gin.Context, db *sqlx.DB) (*auth.Claims, int64, bool) {
+	ci, exists := c.Get(string(CtxClaims))
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return nil, 0, false
+	}
+	claims := ci.(*auth.Claims)
+	if claims.TrustedPublisher {
+		c.JSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
+		return nil, 0, false
+	}
+	pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+		return nil, 0, false
+	}
+	ok, err := canPublish(db, claims, pkgID)
+	if err != nil {
+		publishError(c, err)
+		return nil, 0, false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
+		return nil, 0, false
+	}
+	return claims, pkgID, true
+}
+
+func ListTrustedPublishersHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, pkgID, ok := trustedPublisherPackage(c, db)
+		if !ok {
+			return
+		}
+		tps := []models.TrustedPublisher{}
+		if err := db.Select(&tps, `SELECT id, package_id, issuer, subject, repository, created_by, created_at FROM trusted_publishers WHERE package_id = ? ORDER BY id`, pkgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, tps)
+	}
+}
+
+func CreateTrustedPublisherHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, pkgID, ok := trustedPublisherPackage(c, db)
+		if !ok {
+			return
+		}
+		var req struct {
+			Issuer     string `json:"issuer" binding:"required"`
+			Subject    string `json:"subject"`
+			Repository string `json:"repository"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Issuer = strings.TrimSpace(req.Issuer)
+		req.Subject = strings.TrimSpace(req.Subject)
+		req.Repository = strings.TrimSpace(req.Repository)
+		if !isTrustedIssuer(req.Issuer) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "issuer is not trusted; allowed: " + strings.Join(trustedIssuers(), ", ")})
+			return
+		}
+		// matching on the issuer alone would let every workload of the CI
+		// provider publish
+		if req.Subject == "" && req.Repository == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "subject or repository is required"})
+			return
+		}
+		var tp models.TrustedPublisher
+		err := db.Get(&tp, `INSERT INTO trusted_publishers (package_id, issuer, subject, repository, created_by) VALUES (?, ?, ?, ?, ?)
+			RETURNING id, package_id, issuer, subject, repository, created_by, created_at`, pkgID, req.Issuer, req.Subject, req.Repository, claims.UserID)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				c.JSON(http.StatusConflict, gin.H{"error": "trusted publisher already exists"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "trusted_publisher_added", "package", pkgID, fmt.Sprintf("id=%d issuer=%s subject=%s repository=%s", tp.ID, tp.Issuer, tp.Subject, tp.Repository))
+		c.JSON(http.StatusCreated, tp)
+	}
+}
+
+func DeleteTrustedPublisherHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, pkgID, ok := trustedPublisherPackage(c, db)
+		if !ok {
+			return
+		}
+		tpID, err := strconv.ParseInt(c.Param("tp_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid trusted publisher id"})
+			return
+		}
+		res, err := db.Exec(`DELETE FROM trusted_publishers WHERE id = ? AND package_id = ?`, tpID, pkgID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "trusted publisher not found"})
+			return
+		}
+		auditEvent(db, c, "trusted_publisher_removed", "package", pkgID, fmt.Sprintf("id=%d", tpID))
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
+
+// errNoTrustedPublisher is the single answer for every mismatch, so the
+// exchange does not reveal which packages exist or how they are configured.
+const errNoTrustedPublisher = "no trusted publisher matches this token"
+
+// TrustedPublishExchangeHandler trades a CI workload's OIDC token for a
+// short-lived token that can publish only the named package. The token acts
+// as the maintainer who configured the trusted publisher and stops working
+// if they lose publish rights.
+func TrustedPublishExchangeHandler(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token   string `json:"token" binding:"required"`
+			Package string `json:"package" binding:"required"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// the issuer picks the keys to verify with, so check it against the
+		// allowlist before fetching anything
+		unverified := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(req.Token, unverified); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "malformed token"})
+			return
+		}
+		iss, _ := unverified["iss"].(string)
+		if !isTrustedIssuer(iss) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "token issuer is not trusted"})
+			return
+		}
+		p, err := oidc.Cached(c.Request.Context(), iss)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		tok, err := p.Verify(c.Request.Context(), req.Token, trustedPublishingAudience())
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		repo := repositoryClaim(tok)
+
+		var pkgID int64
+		if err := db.Get(&pkgID, `SELECT id FROM packages WHERE normalized_name = ? LIMIT 1`, pkgname.Normalize(req.Package)); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusForbidden, gin.H{"error": errNoTrustedPublisher})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var tp models.TrustedPublisher
+		err = db.Get(&tp, `SELECT id, package_id, issuer, subject, repository, created_by, created_at FROM trusted_publishers
+			WHERE package_id = ? AND issuer = ? AND (subject = '' OR subject = ?) AND (repository = '' OR repository = ?)
+			ORDER BY id LIMIT 1`, pkgID, tok.Issuer, tok.Subject, repo)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusForbidden, gin.H{"error": errNoTrustedPublisher})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		claims := auth.Claims{UserID: tp.CreatedBy, Scopes: []string{"read", "maintain"}, PackageIDs: []int64{pkgID}, TrustedPublisher: true}
+		ok, err := canPublish(db, &claims, pkgID)
+		if err != nil {
+			publishError(c, err)
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "the maintainer who configured this trusted publisher can no longer publish the package"})
+			return
+		}
+		tokenStr, err := auth.NewTokenFromClaims(signingKey, claims, trustedPublishTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+		// stored like any generated token so it can be revoked
+		hash := fmtHash(tokenStr)
+		_, err = db.Exec(`INSERT INTO tokens (owner_user_id, token_hash, is_generated, scopes, allowed_package_ids, created_at) VALUES (?, ?, 1, ?, ?, datetime('now'))`, tp.CreatedBy, hash, strings.Join(claims.Scopes, ","), strconv.FormatInt(pkgID, 10))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, _ = db.Exec(`INSERT INTO token_audit (action, token_hash, owner_user_id, actor_user_id) VALUES (?, ?, ?, ?)`, "token_generated", hash, tp.CreatedBy, nil)
+		auditEvent(db, c, "trusted_publish_exchange", "package", pkgID, fmt.Sprintf("publisher=%d issuer=%s subject=%s repository=%s", tp.ID, tok.Issuer, tok.Subject, repo))
+		c.JSON(http.StatusOK, gin.H{"token": tokenStr, "expires_in": int(trustedPublishTTL.Seconds())})
+	}
+}
@@ -1,8 +1,17 @@
 package api
 
 import (
+	"database/sql"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"ebuild/internal/auth"
+	"ebuild/internal/markdown"
+
+	"github.com/Masterminds/semver/v3"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
@@ -11,7 +20,7 @@ func ListVersionsHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		pkgID := c.Param("id")
 		var versions []map[string]interface{}
-		rows, err := db.Query(`SELECT id, version, metadata, released_by, released_at, is_deprecated FROM package_versions WHERE package_id = ? ORDER BY released_at DESC`, pkgID)
+		rows, err := db.Query(`SELECT id, version, metadata, released_by, released_at, is_deprecated, quarantined_at IS NOT NULL AS quarantined, quarantine_reason, yanked_at IS NOT NULL AS yanked, yank_reason FROM package_versions WHERE package_id = ? ORDER BY released_at DESC`, pkgID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -47,7 +56,7 @@ func GetVersionHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		pkgID := c.Param("id")
 		ver := c.Param("ver")
-		rows, err := db.Query(`SELECT id, package_id, version, metadata, released_by, released_at, is_deprecated FROM package_versions WHERE package_id = ? AND version = ? LIMIT 1`, pkgID, ver)
+		rows, err := db.Query(`SELECT id, package_id, version, metadata, released_by, released_at, is_deprecated, quarantined_at IS NOT NULL AS quarantined, quarantine_reason, yanked_at IS NOT NULL AS yanked, yank_reason, release_notes, release_notes_html, release_notes_updated_at FROM package_versions WHERE package_id = ? AND version = ? LIMIT 1`, pkgID, ver)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -79,3 +88,259 @@ func GetVersionHandler(db *sqlx.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"version": m})
 	}
 }
+
+// YankVersionHandler marks a release as one that should not be used. It
+// stays downloadable, so existing lockfiles keep working, but is no longer
+// resolved as latest. UnyankVersionHandler reverses it.
+func YankVersionHandler(db *sqlx.DB) gin.HandlerFunc {
+	return yankHandler(db, true)
+}
+
+func UnyankVersionHandler(db *sqlx.DB) gin.HandlerFunc {
+	return yankHandler(db, false)
+}
+
+func yankHandler(db *sqlx.DB, yank bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		ok, err := canPublish(db, claims, pkgID)
+		if err != nil {
+			publishError(c, err)
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		// the body is optional
+		if c.Request.ContentLength > 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		ver := c.Param("ver")
+		var res sql.Result
+		if yank {
+			res, err = db.Exec(`UPDATE package_versions SET yanked_at = datetime('now'), yank_reason = ? WHERE package_id = ? AND version = ? AND yanked_at IS NULL`, req.Reason, pkgID, ver)
+		} else {
+			res, err = db.Exec(`UPDATE package_versions SET yanked_at = NULL, yank_reason = '' WHERE package_id = ? AND version = ? AND yanked_at IS NOT NULL`, pkgID, ver)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists int
+			if err := db.Get(&exists, `SELECT 1 FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, ver); err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "unchanged", "yanked": yank})
+			return
+		}
+		if yank {
+			auditEvent(db, c, "version_yanked", "package", pkgID, strings.TrimSpace("version="+ver+" "+req.Reason))
+			recordEvent(db, EventVersionYanked, pkgID, gin.H{"version": ver, "reason": req.Reason})
+		} else {
+			auditEvent(db, c, "version_unyanked", "package", pkgID, "version="+ver)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "yanked": yank})
+	}
+}
+
+// DeprecateVersionHandler flags a release as deprecated; unlike a yanked one
+// it is still resolved as latest. UndeprecateVersionHandler clears the flag.
+func DeprecateVersionHandler(db *sqlx.DB) gin.HandlerFunc {
+	return deprecateHandler(db, true)
+}
+
+func UndeprecateVersionHandler(db *sqlx.DB) gin.HandlerFunc {
+	return deprecateHandler(db, false)
+}
+
+func deprecateHandler(db *sqlx.DB, deprecate bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		ok, err := canPublish(db, claims, pkgID)
+		if err != nil {
+			publishError(c, err)
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
+			return
+		}
+		ver := c.Param("ver")
+		res, err := db.Exec(`UPDATE package_versions SET is_deprecated = ? WHERE package_id = ? AND version = ? AND is_deprecated <> ?`, deprecate, pkgID, ver, deprecate)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists int
+			if err := db.Get(&exists, `SELECT 1 FROM package_versions WHERE package_id = ? AND version = ?`, pkgID, ver); err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "unchanged", "deprecated": deprecate})
+			return
+		}
+		if deprecate {
+			auditEvent(db, c, "version_deprecated", "package", pkgID, "version="+ver)
+			recordEvent(db, EventVersionDeprecated, pkgID, gin.H{"version": ver})
+		} else {
+			auditEvent(db, c, "version_undeprecated", "package", pkgID, "version="+ver)
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "deprecated": deprecate})
+	}
+}
+
+// UpdateVersionHandler edits a published version's release notes, the only
+// part of a release that may change after publishing.
+func UpdateVersionHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		ok, err := canPublish(db, claims, pkgID)
+		if err != nil {
+			publishError(c, err)
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a maintainer"})
+			return
+		}
+		var req struct {
+			ReleaseNotes *string `json:"release_notes"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.ReleaseNotes == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+			return
+		}
+		if len(*req.ReleaseNotes) > maxReleaseNotesBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "release notes too large"})
+			return
+		}
+		ver := c.Param("ver")
+		notesHTML := markdown.Render(*req.ReleaseNotes)
+		res, err := db.Exec(`UPDATE package_versions SET release_notes = ?, release_notes_html = ?, release_notes_updated_at = datetime('now') WHERE package_id = ? AND version = ?`, *req.ReleaseNotes, notesHTML, pkgID, ver)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+			return
+		}
+		auditEvent(db, c, "release_notes_updated", "package", pkgID, "version="+ver)
+		c.JSON(http.StatusOK, gin.H{"version": ver, "release_notes": *req.ReleaseNotes, "release_notes_html": notesHTML})
+	}
+}
+
+type changelogEntry struct {
+	Version          string    `db:"version" json:"version"`
+	ReleasedAt       time.Time `db:"released_at" json:"released_at"`
+	Yanked           bool      `db:"yanked" json:"yanked"`
+	ReleaseNotes     string    `db:"release_notes" json:"release_notes"`
+	ReleaseNotesHTML string    `db:"release_notes_html" json:"release_notes_html"`
+	semver           *semver.Version
+}
+
+// ChangelogHandler collects the release notes of the versions after from up
+// to and including to, newest first, for reviewing an upgrade. Versions are
+// ordered by semver, not release time; without to every newer version is
+// included. Quarantined versions are left out and yanked ones flagged.
+// markdown and html hold the whole changelog as one document.
+func ChangelogHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, err := semver.NewVersion(c.Query("from"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a semver version"})
+			return
+		}
+		var to *semver.Version
+		if v := c.Query("to"); v != "" {
+			if to, err = semver.NewVersion(v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a semver version"})
+				return
+			}
+			if to.LessThan(from) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to is older than from"})
+				return
+			}
+		}
+		var rows []changelogEntry
+		err = db.Select(&rows, `SELECT version, released_at, yanked_at IS NOT NULL AS yanked, release_notes, release_notes_html FROM package_versions WHERE package_id = ? AND quarantined_at IS NULL`, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entries := []changelogEntry{}
+		for _, e := range rows {
+			v, err := semver.NewVersion(e.Version)
+			if err != nil || !v.GreaterThan(from) || (to != nil && v.GreaterThan(to)) {
+				continue
+			}
+			e.semver = v
+			entries = append(entries, e)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].semver.GreaterThan(entries[j].semver) })
+
+		var b strings.Builder
+		for _, e := range entries {
+			b.WriteString("## " + e.Version)
+			if e.Yanked {
+				b.WriteString(" (yanked)")
+			}
+			b.WriteString("\n\n")
+			if notes := strings.TrimSpace(e.ReleaseNotes); notes != "" {
+				b.WriteString(notes + "\n\n")
+			} else {
+				b.WriteString("_No release notes._\n\n")
+			}
+		}
+		toStr := ""
+		if to != nil {
+			toStr = to.Original()
+		}
+		c.JSON(http.StatusOK, gin.H{"from": from.Original(), "to": toStr, "versions": entries, "markdown": b.String(), "html": markdown.Render(b.String())})
+	}
+}
@@ -1,13 +1,39 @@
 package api
 
 import (
+	"database/sql"
 	"ebuild/internal/auth"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
+// voteSummary is a package's vote aggregate plus the caller's own vote, 0
+// when they have not voted or are anonymous.
+type voteSummary struct {
+	Score int `db:"vote_score" json:"score"`
+	Up    int `db:"vote_up" json:"up"`
+	Down  int `db:"vote_down" json:"down"`
+	Vote  int `db:"-" json:"vote"`
+}
+
+func loadVoteSummary(db *sqlx.DB, pkgID int64, claims *auth.Claims) (*voteSummary, error) {
+	var s voteSummary
+	if err := db.Get(&s, `SELECT vote_score, vote_up, vote_down FROM packages WHERE id = ?`, pkgID); err != nil {
+		return nil, err
+	}
+	if claims != nil {
+		if err := db.Get(&s.Vote, `SELECT value FROM votes WHERE user_id = ? AND package_id = ?`, claims.UserID, pkgID); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// VoteHandler sets the caller's vote on a package: 1 up, -1 down, 0 to take
+// the vote back. The packages' counts follow through triggers.
 func VoteHandler(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ci, exists := c.Get(string(CtxClaims))
@@ -16,19 +42,57 @@ func VoteHandler(db *sqlx.DB) gin.HandlerFunc {
 			return
 		}
 		claims := ci.(*auth.Claims)
-		pkgID := c.Param("id")
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		// a pointer so that 0 passes the required check
 		var req struct {
-			Value int `json:"value" binding:"required"`
+			Value *int `json:"value" binding:"required"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		_, err := db.Exec(`INSERT INTO votes (user_id, package_id, value, created_at) VALUES (?, ?, ?, datetime('now')) ON CONFLICT(user_id, package_id) DO UPDATE SET value = excluded.value, created_at = datetime('now')`, claims.UserID, pkgID, req.Value)
+		switch *req.Value {
+		case 0:
+			_, err = db.Exec(`DELETE FROM votes WHERE user_id = ? AND package_id = ?`, claims.UserID, pkgID)
+		case 1, -1:
+			_, err = db.Exec(`INSERT INTO votes (user_id, package_id, value, created_at) VALUES (?, ?, ?, datetime('now')) ON CONFLICT(user_id, package_id) DO UPDATE SET value = excluded.value, created_at = datetime('now')`, claims.UserID, pkgID, *req.Value)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value must be -1, 0 or 1"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		s, err := loadVoteSummary(db, pkgID, claims)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+func GetVotesHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid package id"})
+			return
+		}
+		s, err := loadVoteSummary(db, pkgID, claimsFrom(c))
 		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		c.JSON(http.StatusOK, s)
 	}
 }
@@ -0,0 +1,385 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ebuild/internal/auth"
+	"ebuild/internal/models"
+	"ebuild/internal/pkgname"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+const webhookColumns = `id, owner_user_id, package_id, org_id, url, events, active, created_at`
+
+const deliveryColumns = `id, webhook_id, event_id, event, payload, status, attempts, next_attempt_at, response_status, error, redelivery_of, created_at, delivered_at`
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validWebhookURL accepts absolute http and https URLs without credentials.
+// Where they may point is checked when delivering.
+func validWebhookURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// validWebhookEvents normalizes events and reports whether all are known.
+func validWebhookEvents(events []string) (models.StringList, bool) {
+	var out models.StringList
+	for _, e := range events {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !webhookEvents[e] {
+			return nil, false
+		}
+		if !containsString(out, e) {
+			out = append(out, e)
+		}
+	}
+	return out, len(out) > 0
+}
+
+// webhookCaller returns the caller's claims for the webhook routes, which
+// trusted publishing tokens may not use. On failure the response has been
+// written.
+func webhookCaller(c *gin.Context) (*auth.Claims, bool) {
+	claims := claimsFrom(c)
+	if claims == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return nil, false
+	}
+	if claims.TrustedPublisher {
+		c.JSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// callerWebhook loads the :id webhook if the caller owns it. Site admins
+// may manage any webhook.
+func callerWebhook(c *gin.Context, db *sqlx.DB) (*models.Webhook, bool) {
+	claims, ok := webhookCaller(c)
+	if !ok {
+		return nil, false
+	}
+	admin, err := isSiteAdmin(db, claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	var w models.Webhook
+	err = db.Get(&w, `SELECT `+webhookColumns+` FROM webhooks WHERE id = ? AND (owner_user_id = ? OR ?)`, c.Param("id"), claims.UserID, admin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return &w, true
+}
+
+// CreateWebhookHandler subscribes url to events of one package (package_id;
+// anyone who can read it), of an org's packages (org; org admins) or of the
+// whole registry (global; site admins). Without a secret one is generated;
+// it is returned only here.
+func CreateWebhookHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := webhookCaller(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			URL       string   `json:"url" binding:"required"`
+			Events    []string `json:"events" binding:"required"`
+			PackageID *int64   `json:"package_id"`
+			Org       string   `json:"org"`
+			Global    bool     `json:"global"`
+			Secret    string   `json:"secret"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.URL = strings.TrimSpace(req.URL)
+		if !validWebhookURL(req.URL) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an http or https URL"})
+			return
+		}
+		events, ok := validWebhookEvents(req.Events)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "events must list one or more of version.published, version.yanked, version.deprecated, artifact.added, maintainer.changed"})
+			return
+		}
+		scopes := 0
+		for _, set := range []bool{req.PackageID != nil, req.Org != "", req.Global} {
+			if set {
+				scopes++
+			}
+		}
+		if scopes != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "set exactly one of package_id, org or global"})
+			return
+		}
+		var orgID *int64
+		switch {
+		case req.PackageID != nil:
+			ok, err := canRead(db, claims, *req.PackageID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "package not found"})
+				return
+			}
+		case req.Org != "":
+			var org models.Organization
+			if err := db.Get(&org, `SELECT `+orgColumns+` FROM organizations WHERE normalized_name = ?`, pkgname.Normalize(req.Org)); err != nil {
+				if err == sql.ErrNoRows {
+					c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			role, err := effectiveOrgRole(db, org.ID, claims.UserID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !role.AtLeast(models.OrgRoleAdmin) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "requires organization role admin"})
+				return
+			}
+			orgID = &org.ID
+		default:
+			admin, err := isSiteAdmin(db, claims)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !admin {
+				c.JSON(http.StatusForbidden, gin.H{"error": "admin only"})
+				return
+			}
+		}
+		secret := req.Secret
+		if secret == "" {
+			var err error
+			if secret, err = newWebhookSecret(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		} else if len(secret) < 16 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "secret must be at least 16 characters"})
+			return
+		}
+		var w models.Webhook
+		err := db.Get(&w, `INSERT INTO webhooks (owner_user_id, package_id, org_id, url, secret, events) VALUES (?, ?, ?, ?, ?, ?) RETURNING `+webhookColumns,
+			claims.UserID, req.PackageID, orgID, req.URL, secret, events)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "webhook_created", "webhook", w.ID, fmt.Sprintf("url=%s events=%s", w.URL, strings.Join(w.Events, ",")))
+		c.JSON(http.StatusCreated, gin.H{"webhook": w, "secret": secret})
+	}
+}
+
+func ListWebhooksHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := webhookCaller(c)
+		if !ok {
+			return
+		}
+		hooks := []models.Webhook{}
+		if err := db.Select(&hooks, `SELECT `+webhookColumns+` FROM webhooks WHERE owner_user_id = ? ORDER BY id`, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+	}
+}
+
+func GetWebhookHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := callerWebhook(c, db)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, w)
+	}
+}
+
+// UpdateWebhookHandler changes the url, events or active flag, and rotates
+// the secret when rotate_secret is set.
+func UpdateWebhookHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := callerWebhook(c, db)
+		if !ok {
+			return
+		}
+		var req struct {
+			URL          *string  `json:"url"`
+			Events       []string `json:"events"`
+			Active       *bool    `json:"active"`
+			RotateSecret bool     `json:"rotate_secret"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.URL != nil {
+			w.URL = strings.TrimSpace(*req.URL)
+			if !validWebhookURL(w.URL) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an http or https URL"})
+				return
+			}
+		}
+		if req.Events != nil {
+			if w.Events, ok = validWebhookEvents(req.Events); !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "events must list one or more of version.published, version.yanked, version.deprecated, artifact.added, maintainer.changed"})
+				return
+			}
+		}
+		if req.Active != nil {
+			w.Active = *req.Active
+		}
+		if _, err := db.Exec(`UPDATE webhooks SET url = ?, events = ?, active = ? WHERE id = ?`, w.URL, w.Events, w.Active, w.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp := gin.H{"webhook": w}
+		if req.RotateSecret {
+			secret, err := newWebhookSecret()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if _, err := db.Exec(`UPDATE webhooks SET secret = ? WHERE id = ?`, secret, w.ID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			auditEvent(db, c, "webhook_secret_rotated", "webhook", w.ID, "")
+			resp["secret"] = secret
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func DeleteWebhookHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := callerWebhook(c, db)
+		if !ok {
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM webhooks WHERE id = ?`, w.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		auditEvent(db, c, "webhook_deleted", "webhook", w.ID, "url="+w.URL)
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
+
+// ListWebhookDeliveriesHandler is the delivery log, newest first. status
+// filters to pending, succeeded or failed.
+func ListWebhookDeliveriesHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := callerWebhook(c, db)
+		if !ok {
+			return
+		}
+		where, args := "webhook_id = ?", []interface{}{w.ID}
+		switch status := c.Query("status"); status {
+		case "":
+		case "pending", "succeeded", "failed":
+			where += " AND status = ?"
+			args = append(args, status)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, succeeded or failed"})
+			return
+		}
+		limit := 50
+		if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 200 {
+			limit = v
+		}
+		offset := 0
+		if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+			offset = v
+		}
+		var total int
+		if err := db.Get(&total, `SELECT COUNT(*) FROM webhook_deliveries WHERE `+where, args...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		deliveries := []models.WebhookDelivery{}
+		if err := db.Select(&deliveries, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE `+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "total": total, "limit": limit, "offset": offset})
+	}
+}
+
+// RedeliverWebhookHandler queues the payload of an earlier delivery again
+// as a new delivery, whatever became of the original.
+func RedeliverWebhookHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := callerWebhook(c, db)
+		if !ok {
+			return
+		}
+		var id int64
+		err := db.Get(&id, `INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload, redelivery_of)
+			SELECT webhook_id, event_id, event, payload, id FROM webhook_deliveries WHERE id = ? AND webhook_id = ? RETURNING id`, c.Param("delivery_id"), w.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"delivery_id": id, "status": "pending"})
+	}
+}
+
+// PingWebhookHandler queues a ping event, to check the receiver and its
+// signature verification.
+func PingWebhookHandler(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w, ok := callerWebhook(c, db)
+		if !ok {
+			return
+		}
+		body, err := json.Marshal(gin.H{"event": "ping", "webhook_id": w.ID, "created_at": time.Now().UTC().Truncate(time.Second)})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var id int64
+		if err := db.Get(&id, `INSERT INTO webhook_deliveries (webhook_id, event, payload) VALUES (?, 'ping', ?) RETURNING id`, w.ID, string(body)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"delivery_id": id, "status": "pending"})
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Failed logins are counted per username and per client IP over
+// loginFailureWindow. Past loginDelayAfter failures every further attempt is
+// slowed down; loginLockoutAfter failures for one username lock the account,
+// for longer each time it is locked again within a day, and
+// loginIPBlockAfter failures from one IP block that IP until they age out.
+// The IP is gin's ClientIP, which only follows X-Forwarded-For from
+// EBUILD_TRUSTED_PROXIES, so clients cannot pick a fresh one per attempt.
+const (
+	loginFailureWindow = 15 * time.Minute
+	loginDelayAfter    = 3
+	loginMaxDelay      = 5 * time.Second
+	loginLockoutAfter  = 10
+	loginLockout       = 15 * time.Minute
+	loginMaxLockout    = 24 * time.Hour
+	loginIPBlockAfter  = 50
+)
+
+// loginWindowModifier is the SQLite datetime modifier for loginFailureWindow.
+var loginWindowModifier = fmt.Sprintf("-%d seconds", int(loginFailureWindow.Seconds()))
+
+type loginGuard struct {
+	db *sqlx.DB
+}
+
+func loginKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// failures returns the recent failure counts for the username and the IP.
+func (g loginGuard) failures(username, ip string) (byUser, byIP int, err error) {
+	if err = g.db.Get(&byUser, `SELECT COUNT(*) FROM login_failures WHERE username = ? AND created_at > datetime('now', ?)`, loginKey(username), loginWindowModifier); err != nil {
+		return
+	}
+	err = g.db.Get(&byIP, `SELECT COUNT(*) FROM login_failures WHERE ip = ? AND created_at > datetime('now', ?)`, ip, loginWindowModifier)
+	return
+}
+
+// delay is the pause imposed before checking credentials, doubling with
+// every failure past loginDelayAfter.
+func (g loginGuard) delay(byUser, byIP int) time.Duration {
+	n := byUser
+	if byIP > n {
+		n = byIP
+	}
+	if n < loginDelayAfter {
+		return 0
+	}
+	d := 250 * time.Millisecond << uint(min(n-loginDelayAfter, 8))
+	return min(d, loginMaxDelay)
+}
+
+// lockedFor returns how long the account stays locked, or zero.
+func (g loginGuard) lockedFor(userID int64) (time.Duration, error) {
+	var secs sql.NullInt64
+	err := g.db.Get(&secs, `SELECT CAST(strftime('%s', locked_until) - strftime('%s', 'now') AS INTEGER) FROM users WHERE id = ? AND locked_until > datetime('now')`, userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !secs.Valid {
+		return 0, nil
+	}
+	return time.Duration(secs.Int64) * time.Second, nil
+}
+
+// recordFailure stores a failed attempt. When it pushes a known user over
+// the threshold the account is locked and the returned duration is non-zero.
+// Failures that no longer count are pruned here, since those for unknown
+// usernames are never cleared by a success or an unlock.
+func (g loginGuard) recordFailure(username, ip string, userID int64) (time.Duration, error) {
+	if _, err := g.db.Exec(`DELETE FROM login_failures WHERE created_at <= datetime('now', ?)`, loginWindowModifier); err != nil {
+		return 0, err
+	}
+	if _, err := g.db.Exec(`INSERT INTO login_failures (username, ip) VALUES (?, ?)`, loginKey(username), ip); err != nil {
+		return 0, err
+	}
+	if userID == 0 {
+		return 0, nil
+	}
+	byUser, _, err := g.failures(username, ip)
+	if err != nil || byUser < loginLockoutAfter {
+		return 0, err
+	}
+	var previous int
+	if err := g.db.Get(&previous, `SELECT COUNT(*) FROM audit_log WHERE action = 'account_locked' AND target_type = 'user' AND target_id = ? AND created_at > datetime('now', '-1 day')`, userID); err != nil {
+		return 0, err
+	}
+	d := min(loginLockout<<uint(min(previous, 8)), loginMaxLockout)
+	if _, err := g.db.Exec(`UPDATE users SET locked_until = datetime('now', ?) WHERE id = ?`, fmt.Sprintf("+%d seconds", int(d.Seconds())), userID); err != nil {
+		return 0, err
+	}
+	// start counting afresh once the lock expires
+	if _, err := g.db.Exec(`DELETE FROM login_failures WHERE username = ?`, loginKey(username)); err != nil {
+		return 0, err
+	}
+	return d, nil
+}
+
+func (g loginGuard) recordSuccess(username string) {
+	_, _ = g.db.Exec(`DELETE FROM login_failures WHERE username = ?`, loginKey(username))
+}
+
+// unlock clears the lock and the failure history of the user.
+func (g loginGuard) unlock(userID int64) error {
+	var username string
+	if err := g.db.Get(&username, `UPDATE users SET locked_until = NULL WHERE id = ? RETURNING username`, userID); err != nil {
+		return err
+	}
+	_, err := g.db.Exec(`DELETE FROM login_failures WHERE username = ?`, loginKey(username))
+	return err
+}
@@ -4,10 +4,13 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"ebuild/internal/auth"
+	"ebuild/internal/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
@@ -34,16 +37,22 @@ func AuthMiddleware(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 		}
 		tokenRaw := parts[1]
 		claims, err := auth.ParseToken(signingKey, tokenRaw)
-		if err != nil {
+		if err != nil || claims.HasScope(auth.ScopeMFA) {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 			return
 		}
-		hash := sha256.Sum256([]byte(tokenRaw))
-		hashS := hex.EncodeToString(hash[:])
-		var revokedAt sql.NullString
-		err = db.Get(&revokedAt, `SELECT revoked_at FROM tokens WHERE token_hash = ? LIMIT 1`, hashS)
-		if err == nil && revokedAt.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token revoked"})
+		if err := checkToken(db, claims, tokenRaw); err != nil {
+			switch err {
+			case errTokenRevoked, errSessionEnded:
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			default:
+				accountError(c, err)
+			}
+			c.Abort()
+			return
+		}
+		if claims.TrustedPublisher && !trustedPublisherAllowed(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "trusted publishing tokens can only publish"})
 			return
 		}
 		c.Set(string(CtxClaims), claims)
@@ -52,6 +61,77 @@ func AuthMiddleware(db *sqlx.DB, signingKey []byte) gin.HandlerFunc {
 	}
 }
 
+// trustedPublisherRoutes are the writes a token exchanged through trusted
+// publishing may make; besides these it may only read.
+var trustedPublisherRoutes = map[string]bool{
+	"/packages/:id/versions":                true,
+	"/packages/:id/versions/:ver/artifacts": true,
+}
+
+func trustedPublisherAllowed(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return trustedPublisherRoutes[c.FullPath()]
+	}
+	return false
+}
+
+var (
+	errAccountSuspended = errors.New("account suspended")
+	errAccountDeleted   = errors.New("account deleted")
+	errTokenRevoked     = errors.New("token revoked")
+	errSessionEnded     = errors.New("session ended")
+)
+
+// checkToken returns why a validly signed token may no longer be used: it
+// was revoked, its session ended or its account cannot act. Long-lived
+// requests repeat it to notice any of these mid-stream.
+func checkToken(db *sqlx.DB, claims *auth.Claims, tokenRaw string) error {
+	hash := sha256.Sum256([]byte(tokenRaw))
+	var revokedAt sql.NullString
+	err := db.Get(&revokedAt, `SELECT revoked_at FROM tokens WHERE token_hash = ? LIMIT 1`, hex.EncodeToString(hash[:]))
+	if err == nil && revokedAt.Valid {
+		return errTokenRevoked
+	}
+	if claims.SessionID != "" && !sessionActive(db, claims.SessionID) {
+		return errSessionEnded
+	}
+	return checkAccount(db, claims.UserID)
+}
+
+// checkAccount returns errAccountSuspended or errAccountDeleted for users
+// who may no longer act, so existing tokens stop working at once.
+func checkAccount(db *sqlx.DB, userID int64) error {
+	var st struct {
+		Suspended bool `db:"suspended"`
+		Deleted   bool `db:"deleted"`
+	}
+	err := db.Get(&st, `SELECT suspended_at IS NOT NULL AS suspended, deleted_at IS NOT NULL AS deleted FROM users WHERE id = ?`, userID)
+	switch {
+	case err == sql.ErrNoRows || err == nil && st.Deleted:
+		return errAccountDeleted
+	case err != nil:
+		return err
+	case st.Suspended:
+		return errAccountSuspended
+	}
+	return nil
+}
+
+// accountError answers for a failed checkAccount.
+func accountError(c *gin.Context, err error) {
+	switch err {
+	case errAccountSuspended:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errAccountDeleted:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func RequireScope(scope string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ci, exists := c.Get(string(CtxClaims))
@@ -60,16 +140,170 @@ func RequireScope(scope string) gin.HandlerFunc {
 			return
 		}
 		claims := ci.(*auth.Claims)
-		for _, s := range claims.Scopes {
-			if s == scope {
-				c.Next()
-				return
-			}
+		if claims.HasScope(scope) {
+			c.Next()
+			return
 		}
 		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient scope"})
 	}
 }
 
+// RequireSession admits only access tokens of a browser session, for
+// account changes a leaked API or CI token must not be able to make.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		if claims == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		if claims.SessionID == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "sign in to do this; API tokens cannot"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePackageAccess answers 404 for the :id package unless the caller may
+// read it, so private package names and ids do not leak.
+func RequirePackageAccess(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pkgID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		ok, err := canRead(db, claimsFrom(c), pkgID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// claimsFrom returns the caller's claims, or nil for anonymous requests.
+func claimsFrom(c *gin.Context) *auth.Claims {
+	ci, exists := c.Get(string(CtxClaims))
+	if !exists {
+		return nil
+	}
+	return ci.(*auth.Claims)
+}
+
+// canRead reports whether the caller may see the package. Missing packages
+// are reported as unreadable.
+func canRead(db *sqlx.DB, claims *auth.Claims, pkgID int64) (bool, error) {
+	clause, args, err := readablePackagesClause(db, claims)
+	if err != nil {
+		return false, err
+	}
+	var exists int
+	err = db.Get(&exists, `SELECT 1 FROM packages p WHERE p.id = ? AND `+clause, append([]interface{}{pkgID}, args...)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// readablePackagesClause returns a condition over packages aliased p that
+// holds for public packages and for private ones the caller may read: with
+// a read-scoped token, as site admin, creator or maintainer of a personal
+// package, member of the owning org or of one of its teams granted the
+// package. Package or org
+// restrictions on the token narrow this further.
+func readablePackagesClause(db *sqlx.DB, claims *auth.Claims) (string, []interface{}, error) {
+	const public = "p.token_required = 0"
+	if claims == nil || !claims.HasScope("read") {
+		return public, nil, nil
+	}
+	var role string
+	if err := db.Get(&role, `SELECT role FROM users WHERE id = ?`, claims.UserID); err != nil && err != sql.ErrNoRows {
+		return "", nil, err
+	}
+	var access string
+	var args []interface{}
+	if role == string(models.RoleAdmin) {
+		access = "1"
+	} else {
+		// creators and maintainers lose access once a package moves to an
+		// org, where only org and team membership count
+		access = `(p.org_id IS NULL AND (p.created_by = ? OR p.id IN (SELECT package_id FROM package_maintainers WHERE user_id = ?))
+			OR p.org_id IN (SELECT org_id FROM org_members WHERE user_id = ?)
+			OR p.id IN (SELECT tp.package_id FROM team_packages tp JOIN team_members tm ON tm.team_id = tp.team_id JOIN teams t ON t.id = tp.team_id WHERE tm.user_id = ? AND t.org_id = p.org_id))`
+		args = append(args, claims.UserID, claims.UserID, claims.UserID, claims.UserID)
+	}
+	if len(claims.PackageIDs) > 0 {
+		access += " AND p.id IN (?" + strings.Repeat(", ?", len(claims.PackageIDs)-1) + ")"
+		for _, id := range claims.PackageIDs {
+			args = append(args, id)
+		}
+	}
+	if claims.OrgID != 0 {
+		access += " AND p.org_id = ?"
+		args = append(args, claims.OrgID)
+	}
+	return "(" + public + " OR (" + access + "))", args, nil
+}
+
+// RequireVerifiedEmail rejects callers whose account email is unverified.
+// It guards every route that publishes.
+func RequireVerifiedEmail(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := claimsFrom(c)
+		if claims == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		var verified sql.NullString
+		if err := db.Get(&verified, `SELECT email_verified_at FROM users WHERE id = ?`, claims.UserID); err != nil && err != sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !verified.Valid {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "verify your email address before publishing"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAdmin admits site admins calling with a session token or one
+// granted the admin scope; package, org and trusted publishing tokens are
+// refused whoever owns them.
+func RequireAdmin(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ci, exists := c.Get(string(CtxClaims))
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		claims := ci.(*auth.Claims)
+		if !claims.AdminCapable() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token cannot be used for admin actions"})
+			return
+		}
+		admin, err := isSiteAdmin(db, claims)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !admin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin only"})
+			return
+		}
+		c.Next()
+	}
+}
+
 func CSRFMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		m := c.Request.Method
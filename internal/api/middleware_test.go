@@ -0,0 +1,141 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ebuild/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+var testSigningKey = []byte("test-signing-key")
+
+// authDB is an in-memory database with the tables AuthMiddleware and
+// RequireAdmin use and user 1, an admin.
+func authDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	db.MustExec(`CREATE TABLE users (id INTEGER PRIMARY KEY, role TEXT NOT NULL DEFAULT 'user', suspended_at DATETIME, deleted_at DATETIME)`)
+	db.MustExec(`CREATE TABLE tokens (id INTEGER PRIMARY KEY AUTOINCREMENT, token_hash TEXT, scopes TEXT, family_id TEXT, revoked_at DATETIME)`)
+	db.MustExec(`INSERT INTO users (id, role) VALUES (1, 'admin')`)
+	return db
+}
+
+func testToken(t *testing.T, claims auth.Claims) string {
+	t.Helper()
+	tok, err := auth.NewTokenFromClaims(testSigningKey, claims, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func serve(r *gin.Engine, method, path, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestTrustedPublisherRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := authDB(t)
+	r := gin.New()
+	r.Use(AuthMiddleware(db, testSigningKey))
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.GET("/packages/:id", ok)
+	r.PATCH("/packages/:id", ok)
+	r.POST("/packages/:id/versions", ok)
+	r.POST("/packages/:id/versions/:ver/artifacts", ok)
+	r.POST("/packages/:id/versions/:ver/yank", ok)
+	r.POST("/packages/:id/votes", ok)
+	r.PUT("/me/password", ok)
+	r.DELETE("/me/sessions", ok)
+
+	tp := testToken(t, auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}, PackageIDs: []int64{7}, TrustedPublisher: true})
+	plain := testToken(t, auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}})
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/packages/7", http.StatusNoContent},
+		{"POST", "/packages/7/versions", http.StatusNoContent},
+		{"POST", "/packages/7/versions/1.0.0/artifacts", http.StatusNoContent},
+		{"PATCH", "/packages/7", http.StatusForbidden},
+		{"POST", "/packages/7/versions/1.0.0/yank", http.StatusForbidden},
+		{"POST", "/packages/7/votes", http.StatusForbidden},
+		{"PUT", "/me/password", http.StatusForbidden},
+		{"DELETE", "/me/sessions", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := serve(r, tt.method, tt.path, tp); got != tt.want {
+			t.Errorf("trusted publisher %s %s = %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+		if got := serve(r, tt.method, tt.path, plain); got != http.StatusNoContent {
+			t.Errorf("API token %s %s = %d, want %d", tt.method, tt.path, got, http.StatusNoContent)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := authDB(t)
+	db.MustExec(`INSERT INTO users (id, role) VALUES (2, 'maintainer')`)
+	db.MustExec(`INSERT INTO tokens (token_hash, scopes, family_id) VALUES ('h', 'refresh', 'sess')`)
+	r := gin.New()
+	r.Use(AuthMiddleware(db, testSigningKey))
+	r.GET("/admin/users", RequireAdmin(db), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		name   string
+		claims auth.Claims
+		want   int
+	}{
+		{"session", auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}, SessionID: "sess"}, http.StatusNoContent},
+		{"admin scope", auth.Claims{UserID: 1, Scopes: []string{"read", auth.ScopeAdmin}}, http.StatusNoContent},
+		{"api token", auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}}, http.StatusForbidden},
+		{"package token", auth.Claims{UserID: 1, Scopes: []string{auth.ScopeAdmin}, PackageIDs: []int64{7}}, http.StatusForbidden},
+		{"org token", auth.Claims{UserID: 1, Scopes: []string{auth.ScopeAdmin}, OrgID: 3}, http.StatusForbidden},
+		{"trusted publisher", auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}, SessionID: "sess", TrustedPublisher: true}, http.StatusForbidden},
+		{"not an admin", auth.Claims{UserID: 2, Scopes: []string{auth.ScopeAdmin}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := serve(r, "GET", "/admin/users", testToken(t, tt.claims)); got != tt.want {
+			t.Errorf("%s: GET /admin/users = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := authDB(t)
+	db.MustExec(`INSERT INTO tokens (token_hash, scopes, family_id) VALUES ('h', 'refresh', 'sess')`)
+	r := gin.New()
+	r.Use(AuthMiddleware(db, testSigningKey))
+	r.POST("/me/2fa/totp", RequireSession(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		name   string
+		claims auth.Claims
+		want   int
+	}{
+		{"session", auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}, SessionID: "sess"}, http.StatusNoContent},
+		{"api token", auth.Claims{UserID: 1, Scopes: []string{"read", "maintain"}}, http.StatusForbidden},
+		{"org token", auth.Claims{UserID: 1, Scopes: []string{"maintain"}, OrgID: 3}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := serve(r, "POST", "/me/2fa/totp", testToken(t, tt.claims)); got != tt.want {
+			t.Errorf("%s: POST /me/2fa/totp = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
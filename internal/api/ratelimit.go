@@ -0,0 +1,99 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ebuild/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateKey selects what a policy counts requests against.
+type rateKey int
+
+const (
+	// keyIP counts per client address.
+	keyIP rateKey = iota
+	// keyUser counts per authenticated user, falling back to the client
+	// address for anonymous requests.
+	keyUser
+	// keyToken counts per bearer token, falling back to the client address.
+	keyToken
+)
+
+type ratePolicy struct {
+	ratelimit.Policy
+	Key rateKey
+}
+
+// ratePolicies is the single place where limits are configured. Routes refer
+// to them by name through RateLimit.
+var ratePolicies = map[string]ratePolicy{
+	// each route that checks a password or a second factor has its own
+	// bucket, so failing one step does not use up the budget of another
+	"login":           {ratelimit.Policy{Limit: 10, Period: time.Minute}, keyIP},
+	"login-mfa":       {ratelimit.Policy{Limit: 10, Period: time.Minute}, keyIP},
+	"oidc-login":      {ratelimit.Policy{Limit: 20, Period: time.Minute}, keyIP},
+	"password-change": {ratelimit.Policy{Limit: 5, Period: time.Minute}, keyUser},
+	"password-reset":  {ratelimit.Policy{Limit: 10, Period: time.Hour}, keyIP},
+	"2fa":             {ratelimit.Policy{Limit: 5, Period: time.Minute}, keyUser},
+	"register":        {ratelimit.Policy{Limit: 5, Period: time.Hour}, keyIP},
+	"vote":            {ratelimit.Policy{Limit: 30, Period: time.Minute, Burst: 10}, keyUser},
+	"comment":         {ratelimit.Policy{Limit: 10, Period: time.Minute, Burst: 5}, keyUser},
+	"report":          {ratelimit.Policy{Limit: 20, Period: time.Hour, Burst: 5}, keyUser},
+	"tokens":          {ratelimit.Policy{Limit: 20, Period: time.Hour}, keyToken},
+	"mail":            {ratelimit.Policy{Limit: 5, Period: time.Hour}, keyIP},
+	"exchange":        {ratelimit.Policy{Limit: 60, Period: time.Hour, Burst: 20}, keyIP},
+	"search":          {ratelimit.Policy{Limit: 60, Period: time.Minute, Burst: 20}, keyUser},
+	"webhook-send":    {ratelimit.Policy{Limit: 30, Period: time.Hour, Burst: 10}, keyUser}, // pings and redeliveries
+}
+
+// RateLimit enforces the named policy from ratePolicies. It sets the
+// RateLimit-* headers on every response and answers 429 with Retry-After once
+// the bucket is empty. Store errors fail open.
+func RateLimit(store ratelimit.Store, name string) gin.HandlerFunc {
+	rp, ok := ratePolicies[name]
+	if !ok {
+		panic("unknown rate limit policy " + name)
+	}
+	rp.Name = name
+	return func(c *gin.Context) {
+		res, err := store.Take(rateLimitKey(c, rp.Key), rp.Policy, time.Now())
+		if err != nil {
+			log.Printf("rate limit %s: %v", name, err)
+			c.Next()
+			return
+		}
+		c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(res.Reset))
+		if !res.Allowed {
+			c.Header("Retry-After", ceilSeconds(res.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func rateLimitKey(c *gin.Context, k rateKey) string {
+	switch k {
+	case keyUser:
+		if claims := claimsFrom(c); claims != nil {
+			return "user:" + strconv.FormatInt(claims.UserID, 10)
+		}
+	case keyToken:
+		if raw, ok := c.Get(string(CtxRawToken)); ok {
+			return "token:" + hashTokenRaw(raw.(string))
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
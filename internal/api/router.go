@@ -2,13 +2,26 @@ package api
 
 import (
 	"net/http"
+	"os"
+	"strings"
+
+	"ebuild/internal/mail"
+	"ebuild/internal/ratelimit"
+	"ebuild/internal/store"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 )
 
-func SetupRouter(db *sqlx.DB, signingKey []byte) *gin.Engine {
+// SetupRouter builds the HTTP handler. downloads receives download counts;
+// the caller owns it and closes it after the server has stopped.
+func SetupRouter(db *sqlx.DB, signingKey []byte, mailer mail.Mailer, downloads *store.DownloadQueue) *gin.Engine {
 	r := gin.Default()
+	// ClientIP, which rate limits and lockouts key on, only honors
+	// X-Forwarded-For from these proxies; by default none
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		panic("EBUILD_TRUSTED_PROXIES: " + err.Error())
+	}
 	// serve static test UI
 	r.Static("/static", "./static")
 	r.GET("/", func(c *gin.Context) { c.Redirect(http.StatusFound, "/static/index.html") })
@@ -16,39 +29,137 @@ func SetupRouter(db *sqlx.DB, signingKey []byte) *gin.Engine {
 	r.Use(AuthMiddleware(db, signingKey))
 	//r.Use(CSRFMiddleware())
 
+	// rate limits are in process for now; see ratePolicies for the limits
+	limiter := ratelimit.NewMemoryStore()
+
 	// health
 	r.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"status": "ok"}) })
 
 	// auth
-	r.POST("/register", RegisterHandler(db))
-	r.POST("/login", LoginHandler(db, signingKey))
-	r.POST("/tokens", CreateTokenHandler(db, signingKey))
+	r.POST("/register", RateLimit(limiter, "register"), RegisterHandler(db, mailer))
+	r.POST("/login", RateLimit(limiter, "login"), LoginHandler(db, signingKey))
+	r.POST("/tokens", RateLimit(limiter, "tokens"), CreateTokenHandler(db, signingKey))
 	r.POST("/tokens/revoke", RevokeTokenHandler(db))
 	r.POST("/refresh", RefreshHandler(db, signingKey))
 	r.GET("/me", MeHandler(db))
+	r.POST("/me/password", RateLimit(limiter, "password-change"), ChangePasswordHandler(db))
+	r.GET("/me/sessions", ListSessionsHandler(db))
+	r.DELETE("/me/sessions", RequireSession(), RevokeAllSessionsHandler(db))
+	r.DELETE("/me/sessions/:id", RequireSession(), RevokeSessionHandler(db))
+	r.POST("/login/mfa", RateLimit(limiter, "login-mfa"), LoginMFAHandler(db, signingKey))
+	r.GET("/oidc/login", RateLimit(limiter, "oidc-login"), OIDCLoginHandler(signingKey))
+	r.GET("/oidc/callback", OIDCCallbackHandler(db, signingKey))
+	r.POST("/me/2fa/totp", RequireSession(), BeginTOTPHandler(db))
+	r.POST("/me/2fa/totp/confirm", RequireSession(), ConfirmTOTPHandler(db))
+	r.DELETE("/me/2fa", RateLimit(limiter, "2fa"), DisableTOTPHandler(db))
+	r.POST("/me/2fa/recovery-codes", RateLimit(limiter, "2fa"), RegenerateRecoveryCodesHandler(db))
+	r.POST("/verify-email", VerifyEmailHandler(db))
+	r.POST("/verify-email/resend", RateLimit(limiter, "mail"), ResendVerificationHandler(db, mailer))
+	r.POST("/password/forgot", RateLimit(limiter, "mail"), ForgotPasswordHandler(db, mailer))
+	r.POST("/password/reset", RateLimit(limiter, "password-reset"), ResetPasswordHandler(db))
 
-	// packages
-	r.POST("/packages", RequireScope("maintain"), CreatePackageHandler(db))
-	r.GET("/packages/:id", GetPackageHandler(db))
+	// packages; routes on a package id answer 404 for private packages the
+	// caller cannot read
+	pkgAccess := RequirePackageAccess(db)
+	verified := RequireVerifiedEmail(db)
+	r.POST("/packages", RequireScope("maintain"), verified, CreatePackageHandler(db))
+	r.GET("/packages/:id", pkgAccess, GetPackageHandler(db))
+	r.GET("/packages/by-name/*path", PackageByNameHandler(db))
+	r.PATCH("/packages/:id", RequireScope("maintain"), pkgAccess, UpdatePackageHandler(db))
+	r.POST("/packages/:id/transfer", RequireScope("maintain"), pkgAccess, TransferPackageHandler(db))
+	// trusted publishing: CI exchanges its OIDC token for a short-lived
+	// token scoped to one package
+	r.GET("/packages/:id/trusted-publishers", RequireScope("maintain"), pkgAccess, ListTrustedPublishersHandler(db))
+	r.POST("/packages/:id/trusted-publishers", RequireScope("maintain"), pkgAccess, CreateTrustedPublisherHandler(db))
+	r.DELETE("/packages/:id/trusted-publishers/:tp_id", RequireScope("maintain"), pkgAccess, DeleteTrustedPublisherHandler(db))
+	r.POST("/trusted-publishing/exchange", RateLimit(limiter, "exchange"), TrustedPublishExchangeHandler(db, signingKey))
 	// versions
-	r.POST("/packages/:id/versions", RequireScope("maintain"), CreateVersionHandler(db, signingKey))
-	r.GET("/packages/:id/versions", ListVersionsHandler(db))
-	r.GET("/packages/:id/versions/:ver", GetVersionHandler(db))
+	r.POST("/packages/:id/versions", RequireScope("maintain"), verified, pkgAccess, CreateVersionHandler(db, signingKey))
+	r.GET("/packages/:id/versions", pkgAccess, ListVersionsHandler(db))
+	r.GET("/packages/:id/versions/:ver", pkgAccess, GetVersionHandler(db))
+	r.PATCH("/packages/:id/versions/:ver", RequireScope("maintain"), pkgAccess, UpdateVersionHandler(db))
+	r.GET("/packages/:id/changelog", pkgAccess, ChangelogHandler(db))
+	r.GET("/packages/:id/releases.atom", pkgAccess, PackageFeedHandler(db))
+	r.POST("/packages/:id/versions/:ver/yank", RequireScope("maintain"), pkgAccess, YankVersionHandler(db))
+	r.POST("/packages/:id/versions/:ver/unyank", RequireScope("maintain"), pkgAccess, UnyankVersionHandler(db))
+	r.POST("/packages/:id/versions/:ver/deprecate", RequireScope("maintain"), pkgAccess, DeprecateVersionHandler(db))
+	r.POST("/packages/:id/versions/:ver/undeprecate", RequireScope("maintain"), pkgAccess, UndeprecateVersionHandler(db))
 
 	// artifacts
-	r.POST("/packages/:id/versions/:ver/artifacts", RequireScope("maintain"), AddArtifactHandler(db))
-	r.GET("/packages/:id/versions/:ver/artifacts", ListArtifactsHandler(db))
-	r.GET("/artifacts/:artifact_id/download", DownloadArtifactHandler(db))
+	r.POST("/packages/:id/versions/:ver/artifacts", RequireScope("maintain"), verified, pkgAccess, AddArtifactHandler(db))
+	r.GET("/packages/:id/versions/:ver/artifacts", pkgAccess, ListArtifactsHandler(db))
+	r.GET("/packages/:id/downloads", pkgAccess, DownloadStatsHandler(db))
+	r.GET("/artifacts/:artifact_id/download", DownloadArtifactHandler(db, downloads))
+
+	// organizations
+	r.POST("/orgs", RequireScope("maintain"), CreateOrgHandler(db))
+	r.GET("/orgs/:org", GetOrgHandler(db))
+	r.PATCH("/orgs/:org", RequireScope("maintain"), UpdateOrgHandler(db))
+	r.PUT("/orgs/:org/members/:username", RequireScope("maintain"), SetOrgMemberHandler(db))
+	r.DELETE("/orgs/:org/members/:username", RequireScope("maintain"), RemoveOrgMemberHandler(db))
+	r.POST("/orgs/:org/teams", RequireScope("maintain"), CreateTeamHandler(db))
+	r.DELETE("/orgs/:org/teams/:team", RequireScope("maintain"), DeleteTeamHandler(db))
+	r.PUT("/orgs/:org/teams/:team/members/:username", RequireScope("maintain"), SetTeamMemberHandler(db))
+	r.DELETE("/orgs/:org/teams/:team/members/:username", RequireScope("maintain"), RemoveTeamMemberHandler(db))
+	r.PUT("/orgs/:org/teams/:team/packages/:package_id", RequireScope("maintain"), SetTeamPackageHandler(db))
+	r.DELETE("/orgs/:org/teams/:team/packages/:package_id", RequireScope("maintain"), RemoveTeamPackageHandler(db))
+	r.POST("/orgs/:org/tokens", RequireScope("maintain"), CreateOrgTokenHandler(db, signingKey))
 
 	// votes
-	r.POST("/packages/:id/votes", VoteHandler(db))
+	r.POST("/packages/:id/votes", RateLimit(limiter, "vote"), pkgAccess, VoteHandler(db))
+	r.GET("/packages/:id/votes", pkgAccess, GetVotesHandler(db))
 
 	// comments
-	r.POST("/packages/:id/comments", CreateCommentHandler(db))
-	r.GET("/packages/:id/comments", ListCommentsHandler(db))
+	r.POST("/packages/:id/comments", RateLimit(limiter, "comment"), pkgAccess, CreateCommentHandler(db))
+	r.GET("/packages/:id/comments", pkgAccess, ListCommentsHandler(db))
+	r.PATCH("/packages/:id/comments/:comment_id", RateLimit(limiter, "comment"), pkgAccess, UpdateCommentHandler(db))
+	r.DELETE("/packages/:id/comments/:comment_id", pkgAccess, DeleteCommentHandler(db))
+	r.GET("/packages/:id/comments/:comment_id/edits", pkgAccess, CommentEditsHandler(db))
+
+	// reports
+	r.POST("/packages/:id/reports", RateLimit(limiter, "report"), pkgAccess, CreateReportHandler(db))
+
+	// Atom feeds of releases
+	r.GET("/feeds/releases.atom", RecentReleasesFeedHandler(db))
+	r.GET("/feeds/categories/:id/releases.atom", CategoryFeedHandler(db))
+	r.GET("/feeds/buckets/:id/releases.atom", BucketFeedHandler(db))
+
+	// registry events as Server-Sent Events
+	r.GET("/events/stream", EventStreamHandler(db))
+
+	// webhooks
+	r.POST("/webhooks", RequireScope("maintain"), CreateWebhookHandler(db))
+	r.GET("/webhooks", RequireScope("maintain"), ListWebhooksHandler(db))
+	r.GET("/webhooks/:id", RequireScope("maintain"), GetWebhookHandler(db))
+	r.PATCH("/webhooks/:id", RequireScope("maintain"), UpdateWebhookHandler(db))
+	r.DELETE("/webhooks/:id", RequireScope("maintain"), DeleteWebhookHandler(db))
+	r.GET("/webhooks/:id/deliveries", RequireScope("maintain"), ListWebhookDeliveriesHandler(db))
+	r.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", RequireScope("maintain"), RateLimit(limiter, "webhook-send"), RedeliverWebhookHandler(db))
+	r.POST("/webhooks/:id/ping", RequireScope("maintain"), RateLimit(limiter, "webhook-send"), PingWebhookHandler(db))
 
 	// search
-	r.GET("/search", SearchHandler(db))
+	r.GET("/search", RateLimit(limiter, "search"), SearchHandler(db))
+
+	// admin
+	r.POST("/admin/search/reindex", RequireAdmin(db), RebuildSearchIndexHandler(db))
+	r.GET("/admin/users", RequireAdmin(db), ListUsersHandler(db))
+	r.GET("/admin/users/:id", RequireAdmin(db), GetUserHandler(db))
+	r.PATCH("/admin/users/:id/role", RequireAdmin(db), SetUserRoleHandler(db))
+	r.POST("/admin/users/:id/suspend", RequireAdmin(db), SuspendUserHandler(db))
+	r.POST("/admin/users/:id/unsuspend", RequireAdmin(db), UnsuspendUserHandler(db))
+	r.DELETE("/admin/users/:id", RequireAdmin(db), DeleteUserHandler(db))
+	r.POST("/admin/users/:id/unlock", RequireAdmin(db), UnlockUserHandler(db))
+	r.PATCH("/admin/comments/:comment_id", RequireAdmin(db), ModerateCommentHandler(db))
+	r.GET("/admin/reports", RequireAdmin(db), ListReportsHandler(db))
+	r.POST("/admin/reports/:report_id/resolve", RequireAdmin(db), ResolveReportHandler(db, mailer))
+	r.POST("/admin/packages/:id/quarantine", RequireAdmin(db), QuarantinePackageHandler(db, mailer))
+	r.POST("/admin/packages/:id/unquarantine", RequireAdmin(db), UnquarantinePackageHandler(db, mailer))
 
 	return r
 }
+
+// trustedProxies lists the reverse proxies in EBUILD_TRUSTED_PROXIES, IPs or
+// CIDRs separated by commas or spaces.
+func trustedProxies() []string {
+	return strings.Fields(strings.ReplaceAll(os.Getenv("EBUILD_TRUSTED_PROXIES"), ",", " "))
+}
@@ -0,0 +1,76 @@
+// Package atom writes Atom 1.0 (RFC 4287) feeds.
+package atom
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const ContentType = "application/atom+xml; charset=utf-8"
+
+type Feed struct {
+	XMLName xml.Name  `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated time.Time `xml:"updated"`
+	Links   []Link    `xml:"link"`
+	Entries []Entry   `xml:"entry"`
+}
+
+type Entry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   time.Time  `xml:"updated"`
+	Published *time.Time `xml:"published,omitempty"`
+	Author    *Person    `xml:"author,omitempty"`
+	Links     []Link     `xml:"link"`
+	Summary   string     `xml:"summary,omitempty"`
+	// Content is HTML, escaped as text; empty content is left out.
+	Content *Text `xml:"content,omitempty"`
+}
+
+type Link struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type Person struct {
+	Name string `xml:"name"`
+}
+
+type Text struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// HTML returns content of type html, or nil for an empty body.
+func HTML(body string) *Text {
+	if body == "" {
+		return nil
+	}
+	return &Text{Type: "html", Body: body}
+}
+
+// Marshal encodes the feed with an XML declaration. Times are written in
+// UTC to the second.
+func Marshal(f *Feed) ([]byte, error) {
+	f.Updated = stamp(f.Updated)
+	for i := range f.Entries {
+		e := &f.Entries[i]
+		e.Updated = stamp(e.Updated)
+		if e.Published != nil {
+			t := stamp(*e.Published)
+			e.Published = &t
+		}
+	}
+	b, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func stamp(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -11,20 +13,48 @@ var (
 	ErrInvalidToken = errors.New("invalid token")
 )
 
+// ScopeMFA marks the challenge token handed out between the password and
+// the second factor. It is not an access token.
+const ScopeMFA = "mfa"
+
+// ScopeAdmin lets a generated token use its owner's site admin role. Browser
+// session tokens have it implicitly.
+const ScopeAdmin = "admin"
+
 type Claims struct {
 	UserID int64    `json:"user_id"`
 	Scopes []string `json:"scopes"`
+	// OrgID is set on tokens issued on behalf of an organization; they act
+	// only on that organization's packages.
+	OrgID int64 `json:"org_id,omitempty"`
+	// PackageIDs, when set, limits the token to those packages.
+	PackageIDs []int64 `json:"package_ids,omitempty"`
+	// SessionID is the refresh token family a browser session's access
+	// tokens belong to; they stop working when the session is revoked.
+	SessionID string `json:"sid,omitempty"`
+	// TrustedPublisher marks short-lived tokens obtained by exchanging a CI
+	// workload's OIDC token; they can publish but not manage tokens,
+	// organizations or package ownership.
+	TrustedPublisher bool `json:"trusted_publisher,omitempty"`
 	jwt.RegisteredClaims
 }
 
 func NewToken(signingKey []byte, userID int64, scopes []string, ttl time.Duration) (string, error) {
-	claims := Claims{
-		UserID: userID,
-		Scopes: scopes,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	return NewTokenFromClaims(signingKey, Claims{UserID: userID, Scopes: scopes}, ttl)
+}
+
+// NewTokenFromClaims signs claims, overwriting their expiry and issue time.
+// Every token gets a random ID, so two tokens minted in the same second
+// never share a hash in the tokens table.
+func NewTokenFromClaims(signingKey []byte, claims Claims, ttl time.Duration) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(jti),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
 	}
 	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return tok.SignedString(signingKey)
@@ -41,3 +71,36 @@ func ParseToken(signingKey []byte, tokenStr string) (*Claims, error) {
 	}
 	return &claims, nil
 }
+
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminCapable reports whether the token may act with its owner's site admin
+// role: session tokens and tokens granted ScopeAdmin can, unless they are
+// trusted publishing tokens or restricted to packages or an organization.
+func (c *Claims) AdminCapable() bool {
+	if c.TrustedPublisher || len(c.PackageIDs) > 0 || c.OrgID != 0 {
+		return false
+	}
+	return c.SessionID != "" || c.HasScope(ScopeAdmin)
+}
+
+// AllowsPackage reports whether a package restriction on the token, if any,
+// includes pkgID.
+func (c *Claims) AllowsPackage(pkgID int64) bool {
+	if len(c.PackageIDs) == 0 {
+		return true
+	}
+	for _, id := range c.PackageIDs {
+		if id == pkgID {
+			return true
+		}
+	}
+	return false
+}
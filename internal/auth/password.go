@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password too short")
+	ErrPasswordTooLong  = errors.New("password too long")
+	ErrPasswordUsername = errors.New("password must not match the username")
+	ErrPasswordBreached = errors.New("password appears in a list of breached passwords")
+)
+
+const (
+	AlgBcrypt   = "bcrypt"
+	AlgArgon2id = "argon2id"
+)
+
+// PasswordConfig is the password policy and the hashing parameters for new
+// hashes. Existing hashes made with other parameters keep verifying and are
+// reported for rehashing.
+type PasswordConfig struct {
+	MinLength int
+	MaxLength int
+	// BreachedPath is either a directory of k-anonymity range files, named
+	// by the first five hex digits of the SHA-1 and holding "SUFFIX:COUNT"
+	// lines as served by the Pwned Passwords range API, or a single file of
+	// full "HASH:COUNT" lines. Empty disables the check.
+	BreachedPath string
+
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+}
+
+// PasswordConfigFromEnv reads
+//
+//	EBUILD_PASSWORD_MIN_LENGTH   default 10
+//	EBUILD_PASSWORD_MAX_LENGTH   default 128
+//	EBUILD_BREACHED_PASSWORDS    see BreachedPath
+//	EBUILD_PASSWORD_HASH         bcrypt (default) or argon2id
+//	EBUILD_BCRYPT_COST           default bcrypt.DefaultCost
+//	EBUILD_ARGON2_TIME, EBUILD_ARGON2_MEMORY_KIB, EBUILD_ARGON2_THREADS
+func PasswordConfigFromEnv() PasswordConfig {
+	pc := PasswordConfig{
+		MinLength:     envInt("EBUILD_PASSWORD_MIN_LENGTH", 10),
+		MaxLength:     envInt("EBUILD_PASSWORD_MAX_LENGTH", 128),
+		BreachedPath:  os.Getenv("EBUILD_BREACHED_PASSWORDS"),
+		Algorithm:     os.Getenv("EBUILD_PASSWORD_HASH"),
+		BcryptCost:    envInt("EBUILD_BCRYPT_COST", bcrypt.DefaultCost),
+		Argon2Time:    uint32(envInt("EBUILD_ARGON2_TIME", 3)),
+		Argon2Memory:  uint32(envInt("EBUILD_ARGON2_MEMORY_KIB", 64*1024)),
+		Argon2Threads: uint8(envInt("EBUILD_ARGON2_THREADS", 2)),
+	}
+	if pc.Algorithm != AlgArgon2id {
+		pc.Algorithm = AlgBcrypt
+	}
+	return pc
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// Validate checks pw against the policy.
+func (pc PasswordConfig) Validate(pw, username string) error {
+	n := utf8.RuneCountInString(pw)
+	if n < pc.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrPasswordTooShort, pc.MinLength)
+	}
+	// bcrypt ignores everything past 72 bytes
+	if n > pc.MaxLength || (pc.Algorithm == AlgBcrypt && len(pw) > 72) {
+		return ErrPasswordTooLong
+	}
+	if username != "" && strings.EqualFold(pw, username) {
+		return ErrPasswordUsername
+	}
+	breached, err := pc.breached(pw)
+	if err != nil {
+		return err
+	}
+	if breached {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+func (pc PasswordConfig) breached(pw string) (bool, error) {
+	if pc.BreachedPath == "" {
+		return false, nil
+	}
+	sum := sha1.Sum([]byte(pw))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	fi, err := os.Stat(pc.BreachedPath)
+	if err != nil {
+		return false, err
+	}
+	path, want := pc.BreachedPath, hash
+	if fi.IsDir() {
+		// only the range for the five-digit prefix is read
+		path, want = filepath.Join(pc.BreachedPath, hash[:5]), hash[5:]
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path += ".txt"
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		if strings.EqualFold(line, want) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// Hash hashes pw with the configured algorithm. Argon2id hashes use the PHC
+// string format.
+func (pc PasswordConfig) Hash(pw string) (string, error) {
+	if pc.Algorithm == AlgArgon2id {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pw), salt, pc.Argon2Time, pc.Argon2Memory, pc.Argon2Threads, 32)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, pc.Argon2Memory, pc.Argon2Time, pc.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), pc.BcryptCost)
+	return string(h), err
+}
+
+// Verify reports whether pw matches hash and, if so, whether hash should be
+// replaced because it was made with another algorithm or parameters.
+func (pc PasswordConfig) Verify(hash, pw string) (ok, rehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		var version int
+		var m, t uint32
+		var p uint8
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+		got := argon2.IDKey([]byte(pw), salt, t, m, p, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false
+		}
+		return true, pc.Algorithm != AlgArgon2id || m != pc.Argon2Memory || t != pc.Argon2Time || p != pc.Argon2Threads
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, pc.Algorithm != AlgBcrypt || err != nil || cost != pc.BcryptCost
+}
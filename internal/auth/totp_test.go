@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of RFC 6238 appendix B, "12345678901234567890",
+// in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// the RFC lists 8-digit codes; ours are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("TOTPCode(%d): %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	got, err := TOTPCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil || got != "287082" {
+		t.Errorf("TOTPCode with lowercase secret = %q, %v; want 287082", got, err)
+	}
+}
+
+func TestTOTPCodeBadSecret(t *testing.T) {
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Error("TOTPCode accepted an invalid secret")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	cur := now.Unix() / totpPeriod
+	code := func(counter int64) string {
+		c, err := TOTPCode(rfc6238Secret, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		code    string
+		after   int64
+		want    bool
+		counter int64
+	}{
+		{"current", code(cur), 0, true, cur},
+		{"previous period", code(cur - 1), 0, true, cur - 1},
+		{"next period", code(cur + 1), 0, true, cur + 1},
+		{"two periods old", code(cur - 2), 0, false, 0},
+		{"two periods ahead", code(cur + 2), 0, false, 0},
+		{"spaces", code(cur)[:3] + " " + code(cur)[3:], 0, true, cur},
+		{"replayed", code(cur), cur, false, 0},
+		{"newer than last use", code(cur + 1), cur, true, cur + 1},
+		{"too short", code(cur)[:5], 0, false, 0},
+		{"wrong", "000000", 0, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := ValidateTOTP(rfc6238Secret, tt.code, now, tt.after)
+			if ok != tt.want || counter != tt.counter {
+				t.Errorf("ValidateTOTP(%q, after %d) = %d, %v; want %d, %v", tt.code, tt.after, counter, ok, tt.counter, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Package hll estimates how many distinct items were seen with HyperLogLog.
+//
+// A Sketch takes a fixed 1 KiB however many items are added, can be stored
+// as a BLOB through Bytes and FromBytes, and merges losslessly with other
+// sketches, so per-day sketches add up to the distinct count of a range.
+// Estimates are within about 3% (standard error 1.04/sqrt(1024)). Items are
+// hashed before use; a sketch does not reveal what was added to it.
+package hll
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	precision = 10
+	registers = 1 << precision
+)
+
+type Sketch struct {
+	reg []byte
+}
+
+func New() *Sketch {
+	return &Sketch{reg: make([]byte, registers)}
+}
+
+// FromBytes restores a sketch saved with Bytes. Empty input is an empty
+// sketch.
+func FromBytes(b []byte) (*Sketch, error) {
+	if len(b) == 0 {
+		return New(), nil
+	}
+	if len(b) != registers {
+		return nil, fmt.Errorf("hll: sketch is %d bytes, want %d", len(b), registers)
+	}
+	return &Sketch{reg: append([]byte(nil), b...)}, nil
+}
+
+func (s *Sketch) Bytes() []byte {
+	return append([]byte(nil), s.reg...)
+}
+
+func (s *Sketch) Add(item string) {
+	sum := sha256.Sum256([]byte(item))
+	h := binary.BigEndian.Uint64(sum[:8])
+	idx := h >> (64 - precision)
+	// the guard bit caps the run of zeros at 64-precision
+	rank := byte(bits.LeadingZeros64(h<<precision|1<<(precision-1)) + 1)
+	if rank > s.reg[idx] {
+		s.reg[idx] = rank
+	}
+}
+
+// Merge adds everything seen by o to s.
+func (s *Sketch) Merge(o *Sketch) {
+	for i, r := range o.reg {
+		if r > s.reg[i] {
+			s.reg[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct items added.
+func (s *Sketch) Estimate() uint64 {
+	const m = float64(registers)
+	sum, zeros := 0.0, 0
+	for _, r := range s.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	// small cardinalities are counted far better from the empty registers
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
@@ -0,0 +1,93 @@
+package hll
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// within reports whether got is within three standard errors of want.
+func within(got uint64, want int) bool {
+	return math.Abs(float64(got)-float64(want)) <= 3*0.0325*float64(want)+1
+}
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.Add(fmt.Sprintf("client-%d", i))
+		}
+		if got := s.Estimate(); !within(got, n) {
+			t.Errorf("Estimate after %d distinct items = %d", n, got)
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	s := New()
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 500; i++ {
+			s.Add(fmt.Sprintf("client-%d", i))
+		}
+	}
+	if got := s.Estimate(); !within(got, 500) {
+		t.Errorf("Estimate of 500 items added 20 times = %d", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	// two days with 3000 clients in common
+	a, b, all := New(), New(), New()
+	for i := 0; i < 8000; i++ {
+		item := fmt.Sprintf("client-%d", i)
+		if i < 5000 {
+			a.Add(item)
+		}
+		if i >= 2000 {
+			b.Add(item)
+		}
+		all.Add(item)
+	}
+	a.Merge(b)
+	if !bytes.Equal(a.Bytes(), all.Bytes()) {
+		t.Error("merged sketch differs from one that saw every item")
+	}
+	if got := a.Estimate(); !within(got, 8000) {
+		t.Errorf("Estimate of the merge = %d, want about 8000", got)
+	}
+}
+
+func TestBytesRoundTrip(t *testing.T) {
+	s := New()
+	for i := 0; i < 2500; i++ {
+		s.Add(fmt.Sprintf("client-%d", i))
+	}
+	b := s.Bytes()
+	if len(b) != registers {
+		t.Fatalf("Bytes is %d bytes, want %d", len(b), registers)
+	}
+	r, err := FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Estimate() != s.Estimate() {
+		t.Errorf("restored estimate %d, want %d", r.Estimate(), s.Estimate())
+	}
+	// neither sketch may share storage with the slices passed around
+	b[0] ^= 0xff
+	if r.Bytes()[0] == b[0] || s.Bytes()[0] == b[0] {
+		t.Error("a sketch shares its registers with a byte slice")
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	if s, err := FromBytes(nil); err != nil || s.Estimate() != 0 {
+		t.Errorf("FromBytes(nil) = %v, %v; want an empty sketch", s, err)
+	}
+	for _, n := range []int{1, registers - 1, registers + 1} {
+		if _, err := FromBytes(make([]byte, n)); err == nil {
+			t.Errorf("FromBytes accepted %d bytes", n)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Package mail sends the registry's outbound email.
+//
+// Production deployments use SMTPMailer. For local development FileMailer
+// appends every message to a file (or the log) instead of delivering it, so
+// verification and reset links can be copied from there.
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// FromEnv builds the mailer configured by the environment:
+//
+//	EBUILD_SMTP_ADDR      host:port of the SMTP server; without it mail goes to FileMailer
+//	EBUILD_SMTP_USER      username for PLAIN auth (optional)
+//	EBUILD_SMTP_PASSWORD  password for PLAIN auth
+//	EBUILD_MAIL_FROM      sender address, default no-reply@localhost
+//	EBUILD_MAIL_FILE      file FileMailer appends to; empty logs instead
+func FromEnv() Mailer {
+	from := os.Getenv("EBUILD_MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	if addr := os.Getenv("EBUILD_SMTP_ADDR"); addr != "" {
+		return &SMTPMailer{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("EBUILD_SMTP_USER"),
+			Password: os.Getenv("EBUILD_SMTP_PASSWORD"),
+		}
+	}
+	return &FileMailer{Path: os.Getenv("EBUILD_MAIL_FILE"), From: from}
+}
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+}
+
+// FileMailer writes messages to Path, or to the standard logger when Path is
+// empty. It never delivers anything.
+type FileMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	raw := format(m.From, msg)
+	if m.Path == "" {
+		log.Printf("mail to %s:\n%s", msg.To, raw)
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(raw, '\n'))
+	return err
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", "").Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
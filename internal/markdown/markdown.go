@@ -0,0 +1,217 @@
+// Package markdown renders a conservative subset of Markdown to HTML.
+//
+// The renderer never passes raw HTML through: all text is escaped before any
+// markup is produced, and link/image targets are limited to http(s), mailto
+// and relative URLs. Its output is therefore safe to embed in a page without
+// a separate sanitizing pass.
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	headingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	ulItemRe   = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	olItemRe   = regexp.MustCompile(`^\s{0,3}\d{1,9}[.)]\s+(.*)$`)
+	hrRe       = regexp.MustCompile(`^\s{0,3}(-\s*){3,}$|^\s{0,3}(\*\s*){3,}$|^\s{0,3}(_\s*){3,}$`)
+	fenceRe    = regexp.MustCompile("^\\s{0,3}(```|~~~)\\s*([A-Za-z0-9_+-]*)")
+	imageRe    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	linkRe     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	strongRe   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	emRe       = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+	strikeRe   = regexp.MustCompile(`~~([^~]+)~~`)
+	holeRe     = regexp.MustCompile("\x00(\\d+)\x00")
+	langSafeRe = regexp.MustCompile(`^[A-Za-z0-9_+-]+$`)
+)
+
+// Render converts Markdown source to sanitized HTML.
+func Render(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	renderBlocks(&b, lines)
+	return b.String()
+}
+
+func renderBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+		case fenceRe.MatchString(line):
+			m := fenceRe.FindStringSubmatch(line)
+			fence := m[1]
+			var code []string
+			i++
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence
+			b.WriteString("<pre><code")
+			if m[2] != "" && langSafeRe.MatchString(m[2]) {
+				b.WriteString(` class="language-` + m[2] + `"`)
+			}
+			b.WriteString(">")
+			b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			b.WriteString("</code></pre>\n")
+		case strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"):
+			var code []string
+			for i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.HasPrefix(lines[i], "\t") || strings.TrimSpace(lines[i]) == "") {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    "))
+				i++
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case headingRe.MatchString(trimmed):
+			m := headingRe.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+			i++
+		case hrRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			var inner []string
+			for i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">") {
+				l := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				inner = append(inner, strings.TrimPrefix(l, " "))
+				i++
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, inner)
+			b.WriteString("</blockquote>\n")
+		case ulItemRe.MatchString(line):
+			i = renderList(b, lines, i, ulItemRe, "ul")
+		case olItemRe.MatchString(line):
+			i = renderList(b, lines, i, olItemRe, "ol")
+		default:
+			var para []string
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]) {
+				para = append(para, strings.TrimSpace(lines[i]))
+				i++
+			}
+			if len(para) == 0 {
+				// a line that looks like a block start but did not match above
+				para = append(para, trimmed)
+				i++
+			}
+			b.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+}
+
+func renderList(b *strings.Builder, lines []string, i int, itemRe *regexp.Regexp, tag string) int {
+	var items []string
+	for i < len(lines) {
+		if m := itemRe.FindStringSubmatch(lines[i]); m != nil {
+			items = append(items, m[1])
+			i++
+			continue
+		}
+		// indented continuation of the previous item
+		if len(items) > 0 && strings.TrimSpace(lines[i]) != "" && (strings.HasPrefix(lines[i], "  ") || strings.HasPrefix(lines[i], "\t")) {
+			items[len(items)-1] += "\n" + strings.TrimSpace(lines[i])
+			i++
+			continue
+		}
+		break
+	}
+	b.WriteString("<" + tag + ">\n")
+	for _, it := range items {
+		b.WriteString("<li>" + renderInline(it) + "</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return fenceRe.MatchString(line) || headingRe.MatchString(trimmed) || hrRe.MatchString(line) ||
+		strings.HasPrefix(trimmed, ">") || ulItemRe.MatchString(line) || olItemRe.MatchString(line)
+}
+
+// renderInline handles code spans, links, images and emphasis. Rendered
+// fragments that must not be touched by later passes (code, links) are
+// parked in holes and spliced back at the end.
+func renderInline(s string) string {
+	var holes []string
+	hole := func(h string) string {
+		holes = append(holes, h)
+		return "\x00" + strconv.Itoa(len(holes)-1) + "\x00"
+	}
+	s = strings.ReplaceAll(s, "\x00", "")
+
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(s, '`')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start+1:], '`')
+		if end < 0 {
+			break
+		}
+		out.WriteString(s[:start])
+		out.WriteString(hole("<code>" + html.EscapeString(s[start+1:start+1+end]) + "</code>"))
+		s = s[start+1+end+1:]
+	}
+	out.WriteString(s)
+	s = html.EscapeString(out.String())
+
+	s = imageRe.ReplaceAllStringFunc(s, func(m string) string {
+		sm := imageRe.FindStringSubmatch(m)
+		u, ok := safeURL(sm[2])
+		if !ok || !(strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) {
+			return sm[1]
+		}
+		return hole(`<img src="` + html.EscapeString(u) + `" alt="` + sm[1] + `">`)
+	})
+	s = linkRe.ReplaceAllStringFunc(s, func(m string) string {
+		sm := linkRe.FindStringSubmatch(m)
+		u, ok := safeURL(sm[2])
+		if !ok {
+			return sm[1]
+		}
+		return hole(`<a href="`+html.EscapeString(u)+`" rel="nofollow noopener">`) + sm[1] + hole("</a>")
+	})
+	s = strongRe.ReplaceAllString(s, "<strong>$1$2</strong>")
+	s = emRe.ReplaceAllString(s, "<em>$1$2</em>")
+	s = strikeRe.ReplaceAllString(s, "<del>$1</del>")
+	s = strings.ReplaceAll(s, "\n", "<br>\n")
+
+	return holeRe.ReplaceAllStringFunc(s, func(m string) string {
+		n, _ := strconv.Atoi(strings.Trim(m, "\x00"))
+		if n < len(holes) {
+			return holes[n]
+		}
+		return ""
+	})
+}
+
+// safeURL unescapes an already HTML-escaped link target and reports whether
+// it is allowed.
+func safeURL(escaped string) (string, bool) {
+	u := html.UnescapeString(escaped)
+	lower := strings.ToLower(u)
+	for _, p := range []string{"http://", "https://", "mailto:"} {
+		if strings.HasPrefix(lower, p) {
+			return u, true
+		}
+	}
+	if strings.HasPrefix(u, "/") || strings.HasPrefix(u, "#") {
+		return u, true
+	}
+	// relative path without a scheme
+	if i := strings.IndexAny(u, ":/?#"); i < 0 || u[i] != ':' {
+		return u, true
+	}
+	return "", false
+}
@@ -0,0 +1,48 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"script tag", `<script>alert(1)</script>`, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"inline handler", `<img src=x onerror=alert(1)>`, "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"javascript link", `[click](javascript:alert(1))`, "<p>click)</p>\n"},
+		{"mixed case scheme", `[click](JaVaScRiPt:alert)`, "<p>click</p>\n"},
+		// the entity stays escaped, leaving a harmless relative link
+		{"entity encoded scheme", `[click](&#106;avascript:alert)`, `<p><a href="&amp;#106;avascript:alert" rel="nofollow noopener">click</a></p>` + "\n"},
+		{"data link", `[click](data:text/html;base64,PHNjcmlwdD4=)`, "<p>click</p>\n"},
+		{"javascript image", `![x](javascript:alert)`, "<p>x</p>\n"},
+		{"relative image", `![x](/logo.png)`, "<p>x</p>\n"},
+		{"attribute breakout in href", `[a](https://e.com/"onmouseover="alert)`, `<p><a href="https://e.com/&#34;onmouseover=&#34;alert" rel="nofollow noopener">a</a></p>` + "\n"},
+		{"attribute breakout in alt", `![" onerror="alert](https://e.com/x.png)`, `<p><img src="https://e.com/x.png" alt="&#34; onerror=&#34;alert"></p>` + "\n"},
+		{"html in link text", `[<b>hi</b>](https://e.com)`, `<p><a href="https://e.com" rel="nofollow noopener">&lt;b&gt;hi&lt;/b&gt;</a></p>` + "\n"},
+		{"html in code span", "`<script>`", "<p><code>&lt;script&gt;</code></p>\n"},
+		{"html in code block", "```\n<script>\n```", "<pre><code>&lt;script&gt;</code></pre>\n"},
+		{"fence language breakout", "```js\"><script>\nx\n```", "<pre><code class=\"language-js\">x</code></pre>\n"},
+		{"heading", `# <i>t</i>`, "<h1>&lt;i&gt;t&lt;/i&gt;</h1>\n"},
+		{"forged hole", "\x000\x00[a](https://e.com)", `<p>0<a href="https://e.com" rel="nofollow noopener">a</a></p>` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderAllowedLinks(t *testing.T) {
+	for _, u := range []string{"https://e.com/a?b=c", "http://e.com", "mailto:a@e.com", "/docs", "#usage", "docs/readme.md"} {
+		got := Render("[x](" + u + ")")
+		if !strings.Contains(got, `<a href="`) {
+			t.Errorf("Render link to %q dropped it: %q", u, got)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package models
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 type Role string
 
@@ -10,6 +16,27 @@ const (
 	RoleAdmin      Role = "admin"
 )
 
+// Valid reports whether r is one of the site roles.
+func (r Role) Valid() bool {
+	return r == RolePublic || r == RoleMaintainer || r == RoleAdmin
+}
+
+type OrgRole string
+
+const (
+	OrgRoleOwner     OrgRole = "owner"
+	OrgRoleAdmin     OrgRole = "admin"
+	OrgRolePublisher OrgRole = "publisher"
+	OrgRoleViewer    OrgRole = "viewer"
+)
+
+var orgRoleRank = map[OrgRole]int{OrgRoleViewer: 1, OrgRolePublisher: 2, OrgRoleAdmin: 3, OrgRoleOwner: 4}
+
+func (r OrgRole) Valid() bool { return orgRoleRank[r] > 0 }
+
+// AtLeast reports whether r grants everything min does.
+func (r OrgRole) AtLeast(min OrgRole) bool { return orgRoleRank[r] >= orgRoleRank[min] && r.Valid() }
+
 type User struct {
 	ID        int64     `db:"id" json:"id"`
 	Username  string    `db:"username" json:"username"`
@@ -19,13 +46,69 @@ type User struct {
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
+// UserAccount is a user as site admins see it.
+type UserAccount struct {
+	User
+	EmailVerified   bool       `db:"email_verified" json:"email_verified"`
+	TwoFactor       bool       `db:"two_factor" json:"two_factor"`
+	SuspendedAt     *time.Time `db:"suspended_at" json:"suspended_at"`
+	SuspendedReason string     `db:"suspended_reason" json:"suspended_reason,omitempty"`
+	DeletedAt       *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+}
+
 type Package struct {
-	ID            int64     `db:"id" json:"id"`
-	Name          string    `db:"name" json:"name"`
-	Description   string    `db:"description" json:"description"`
-	CreatedBy     int64     `db:"created_by" json:"created_by"`
-	TokenRequired bool      `db:"token_required" json:"token_required"`
-	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+	ID            int64      `db:"id" json:"id"`
+	Name          string     `db:"name" json:"name"`
+	Description   string     `db:"description" json:"description"`
+	CreatedBy     int64      `db:"created_by" json:"created_by"`
+	TokenRequired bool       `db:"token_required" json:"token_required"`
+	OrgID         *int64     `db:"org_id" json:"org_id"`
+	License       string     `db:"license" json:"license"`
+	Homepage      string     `db:"homepage" json:"homepage"`
+	RepositoryURL string     `db:"repository_url" json:"repository_url"`
+	Keywords      StringList `db:"keywords" json:"keywords"`
+	Readme        string     `db:"readme" json:"readme"`
+	ReadmeHTML    string     `db:"readme_html" json:"readme_html"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	// QuarantinedAt is set while admins have taken the package down; its
+	// artifacts are not served.
+	QuarantinedAt    *time.Time `db:"quarantined_at" json:"quarantined_at,omitempty"`
+	QuarantineReason string     `db:"quarantine_reason" json:"quarantine_reason,omitempty"`
+}
+
+type Organization struct {
+	ID             int64     `db:"id" json:"id"`
+	Name           string    `db:"name" json:"name"`
+	NormalizedName string    `db:"normalized_name" json:"-"`
+	DisplayName    string    `db:"display_name" json:"display_name"`
+	Require2FA     bool      `db:"require_2fa" json:"require_2fa"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+}
+
+type OrgMember struct {
+	UserID   int64   `db:"user_id" json:"user_id"`
+	Username string  `db:"username" json:"username"`
+	Role     OrgRole `db:"role" json:"role"`
+}
+
+type Team struct {
+	ID        int64     `db:"id" json:"id"`
+	OrgID     int64     `db:"org_id" json:"org_id"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// TrustedPublisher lets CI workloads exchange OIDC tokens from Issuer whose
+// sub and repository claims match for short-lived publish tokens. An empty
+// Subject or Repository matches any value.
+type TrustedPublisher struct {
+	ID         int64     `db:"id" json:"id"`
+	PackageID  int64     `db:"package_id" json:"package_id"`
+	Issuer     string    `db:"issuer" json:"issuer"`
+	Subject    string    `db:"subject" json:"subject"`
+	Repository string    `db:"repository" json:"repository"`
+	CreatedBy  int64     `db:"created_by" json:"created_by"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
 }
 
 type PackageVersion struct {
@@ -36,6 +119,12 @@ type PackageVersion struct {
 	ReleasedBy   int64     `db:"released_by" json:"released_by"`
 	ReleasedAt   time.Time `db:"released_at" json:"released_at"`
 	IsDeprecated bool      `db:"is_deprecated" json:"is_deprecated"`
+	// QuarantinedAt is set on versions taken down on their own; see
+	// Package.QuarantinedAt for whole packages.
+	QuarantinedAt    *time.Time `db:"quarantined_at" json:"quarantined_at,omitempty"`
+	QuarantineReason string     `db:"quarantine_reason" json:"quarantine_reason,omitempty"`
+	ReleaseNotes     string     `db:"release_notes" json:"release_notes"`
+	ReleaseNotesHTML string     `db:"release_notes_html" json:"release_notes_html"`
 }
 
 type Artifact struct {
@@ -55,11 +144,116 @@ type Vote struct {
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
+// Comment is a package comment. Replies hang off ParentID; RootID is the
+// thread's top-level comment. Body is the Markdown source and BodyHTML its
+// sanitized rendering; both are blanked for deleted and hidden comments
+// when listed.
 type Comment struct {
-	ID               int64     `db:"id" json:"id"`
-	UserID           int64     `db:"user_id" json:"user_id"`
-	PackageID        int64     `db:"package_id" json:"package_id"`
-	PackageVersionID *int64    `db:"package_version_id" json:"package_version_id"`
-	Body             string    `db:"body" json:"body"`
-	CreatedAt        time.Time `db:"created_at" json:"created_at"`
+	ID               int64      `db:"id" json:"id"`
+	UserID           int64      `db:"user_id" json:"user_id"`
+	Username         string     `db:"username" json:"username"`
+	PackageID        int64      `db:"package_id" json:"package_id"`
+	PackageVersionID *int64     `db:"package_version_id" json:"package_version_id"`
+	ParentID         *int64     `db:"parent_id" json:"parent_id"`
+	RootID           *int64     `db:"root_id" json:"-"`
+	Body             string     `db:"body" json:"body"`
+	BodyHTML         string     `db:"body_html" json:"body_html"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt        *time.Time `db:"updated_at" json:"updated_at,omitempty"`
+	Deleted          bool       `db:"deleted" json:"deleted"`
+	Hidden           bool       `db:"hidden" json:"hidden"`
+	Locked           bool       `db:"locked" json:"locked"`
+	Replies          []*Comment `db:"-" json:"replies"`
+}
+
+type CommentEdit struct {
+	Body     string    `db:"body" json:"body"`
+	EditedBy *int64    `db:"edited_by" json:"edited_by"`
+	EditedAt time.Time `db:"edited_at" json:"edited_at"`
+}
+
+// Report is a user's flag on a package, version or comment. TargetID is the
+// id of the package, package_versions row or comment named by TargetType.
+type Report struct {
+	ID             int64      `db:"id" json:"id"`
+	ReporterID     int64      `db:"reporter_id" json:"reporter_id"`
+	Reporter       string     `db:"reporter" json:"reporter"`
+	PackageID      int64      `db:"package_id" json:"package_id"`
+	PackageName    string     `db:"package_name" json:"package_name"`
+	TargetType     string     `db:"target_type" json:"target_type"`
+	TargetID       int64      `db:"target_id" json:"target_id"`
+	Reason         string     `db:"reason" json:"reason"`
+	Details        string     `db:"details" json:"details"`
+	Status         string     `db:"status" json:"status"`
+	Resolution     *string    `db:"resolution" json:"resolution"`
+	ResolutionNote string     `db:"resolution_note" json:"resolution_note,omitempty"`
+	ResolvedBy     *int64     `db:"resolved_by" json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time `db:"resolved_at" json:"resolved_at,omitempty"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	OpenOnTarget   int        `db:"open_on_target" json:"open_on_target"`
+}
+
+// Webhook is a subscription to registry events. PackageID or OrgID limit it
+// to one package or to an org's packages; with neither it is global. The
+// signing secret is only returned when the webhook is created.
+type Webhook struct {
+	ID          int64      `db:"id" json:"id"`
+	OwnerUserID int64      `db:"owner_user_id" json:"owner_user_id"`
+	PackageID   *int64     `db:"package_id" json:"package_id"`
+	OrgID       *int64     `db:"org_id" json:"org_id"`
+	URL         string     `db:"url" json:"url"`
+	Events      StringList `db:"events" json:"events"`
+	Active      bool       `db:"active" json:"active"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64      `db:"id" json:"id"`
+	WebhookID      int64      `db:"webhook_id" json:"webhook_id"`
+	EventID        *int64     `db:"event_id" json:"event_id"`
+	Event          string     `db:"event" json:"event"`
+	Payload        string     `db:"payload" json:"payload"`
+	Status         string     `db:"status" json:"status"`
+	Attempts       int        `db:"attempts" json:"attempts"`
+	NextAttemptAt  *time.Time `db:"next_attempt_at" json:"next_attempt_at,omitempty"`
+	ResponseStatus *int       `db:"response_status" json:"response_status"`
+	Error          string     `db:"error" json:"error,omitempty"`
+	RedeliveryOf   *int64     `db:"redelivery_of" json:"redelivery_of,omitempty"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time `db:"delivered_at" json:"delivered_at,omitempty"`
+}
+
+// StringList is stored as a comma-separated TEXT column and encoded as a
+// JSON array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *StringList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", src)
+	}
+	*l = nil
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
+func (l StringList) MarshalJSON() ([]byte, error) {
+	if l == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(l))
 }
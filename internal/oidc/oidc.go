@@ -0,0 +1,315 @@
+// Package oidc is a small OpenID Connect relying party: provider discovery,
+// the authorization-code flow with PKCE, and ID token verification against
+// the provider's published keys (RS256 and ES256).
+//
+// It serves both browser logins and CI workload tokens, which are ordinary
+// ID tokens issued by the CI system's provider.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnknownKey = errors.New("oidc: token signed with unknown key")
+
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Provider is a discovered OpenID provider.
+type Provider struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// keyRefreshInterval bounds how often an unknown kid triggers a JWKS fetch.
+const keyRefreshInterval = time.Minute
+
+// providerTTL is how long Cached keeps a discovery document.
+const providerTTL = time.Hour
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]cachedProvider{}
+)
+
+type cachedProvider struct {
+	p       *Provider
+	expires time.Time
+}
+
+// Cached returns the provider for issuer, running discovery at most once an
+// hour. Keys are cached with the provider.
+func Cached(ctx context.Context, issuer string) (*Provider, error) {
+	cacheMu.Lock()
+	cp, ok := cache[issuer]
+	cacheMu.Unlock()
+	if ok && time.Now().Before(cp.expires) {
+		return cp.p, nil
+	}
+	p, err := Discover(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	cacheMu.Lock()
+	cache[issuer] = cachedProvider{p: p, expires: time.Now().Add(providerTTL)}
+	cacheMu.Unlock()
+	return p, nil
+}
+
+// Discover fetches issuer's /.well-known/openid-configuration.
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	var p Provider
+	if err := getJSON(ctx, strings.TrimRight(issuer, "/")+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("oidc: discovery for %s: %w", issuer, err)
+	}
+	// the document must describe the issuer it was fetched for
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("oidc: discovery returned issuer %q, want %q", p.Issuer, issuer)
+	}
+	if p.JWKSURL == "" {
+		return nil, errors.New("oidc: discovery document has no jwks_uri")
+	}
+	return &p, nil
+}
+
+// NewPKCE returns a code verifier and its S256 challenge.
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns n random bytes, base64url encoded.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL is where the browser is sent to sign in.
+func (p *Provider) AuthCodeURL(clientID, redirectURL, state, nonce, challenge string, scopes []string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", clientID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// Exchange redeems an authorization code and returns the raw ID token.
+func (p *Provider) Exchange(ctx context.Context, clientID, clientSecret, redirectURL, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", clientID)
+	form.Set("code_verifier", verifier)
+	if clientSecret != "" {
+		form.Set("client_secret", clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return "", fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || out.Error != "" {
+		return "", fmt.Errorf("oidc: token endpoint: %s %s", out.Error, out.Desc)
+	}
+	if out.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token")
+	}
+	return out.IDToken, nil
+}
+
+// IDToken holds the verified claims of an ID token. Claims has every claim,
+// including provider-specific ones.
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Nonce             string
+	Claims            map[string]interface{}
+}
+
+// Verify checks the signature, issuer, audience and expiry of raw.
+func (p *Provider) Verify(ctx context.Context, raw, audience string) (*IDToken, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %w", err)
+	}
+	tok := &IDToken{Issuer: p.Issuer, Claims: claims}
+	tok.Subject, _ = claims["sub"].(string)
+	tok.Email, _ = claims["email"].(string)
+	tok.PreferredUsername, _ = claims["preferred_username"].(string)
+	tok.Nonce, _ = claims["nonce"].(string)
+	// some providers send email_verified as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		tok.EmailVerified = v
+	case string:
+		tok.EmailVerified = v == "true"
+	}
+	if tok.Subject == "" {
+		return nil, errors.New("oidc: token has no subject")
+	}
+	return tok, nil
+}
+
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+	// an unknown kid usually means the provider rotated its keys
+	if time.Since(p.fetched) < keyRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+	keys, err := fetchJWKS(ctx, p.JWKSURL)
+	p.fetched = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup finds kid, or the only key when the token names none.
+func (p *Provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+func fetchJWKS(ctx context.Context, u string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, u, &set); err != nil {
+		return nil, fmt.Errorf("oidc: jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,109 @@
+// Package pkgname parses, validates and normalizes package names.
+//
+// A name is either plain ("libfoo") or scoped ("@team/libfoo"). Two names
+// that differ only in case or in the choice and repetition of the separators
+// '-', '_' and '.' normalize to the same key, and only one of them may be
+// registered, so "Lib_Foo" cannot squat next to "lib-foo".
+package pkgname
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const MaxLen = 214
+
+var (
+	ErrInvalid  = errors.New("invalid package name: use letters, digits, '-', '_' and '.', starting with a letter or digit")
+	ErrTooLong  = errors.New("package name too long")
+	ErrReserved = errors.New("package name is reserved")
+
+	partRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	sepRe  = regexp.MustCompile(`[-_.]+`)
+)
+
+// reserved holds normalized base names that may not be registered, either
+// because they collide with routes and tooling or because they invite
+// impersonation.
+var reserved = map[string]bool{
+	"admin": true, "administrator": true, "api": true, "by-name": true, "ebuild": true,
+	"feeds": true, "help": true, "login": true, "logout": true, "me": true,
+	"node-modules": true, "official": true, "packages": true, "register": true,
+	"registry": true, "root": true, "search": true, "security": true, "static": true,
+	"support": true, "system": true, "tokens": true, "www": true,
+}
+
+type Name struct {
+	// Scope is the part after '@' for scoped names, empty otherwise.
+	Scope string
+	Base  string
+}
+
+// Parse validates raw and splits it into scope and base.
+func Parse(raw string) (Name, error) {
+	if len(raw) > MaxLen {
+		return Name{}, ErrTooLong
+	}
+	var n Name
+	if strings.HasPrefix(raw, "@") {
+		scope, base, ok := strings.Cut(raw[1:], "/")
+		if !ok || !partRe.MatchString(scope) {
+			return Name{}, ErrInvalid
+		}
+		n.Scope = scope
+		raw = base
+	}
+	if !partRe.MatchString(raw) {
+		return Name{}, ErrInvalid
+	}
+	n.Base = raw
+	return n, nil
+}
+
+func (n Name) String() string {
+	if n.Scope != "" {
+		return "@" + n.Scope + "/" + n.Base
+	}
+	return n.Base
+}
+
+// Normalized is the key used for uniqueness and lookups.
+func (n Name) Normalized() string {
+	s := normalizePart(n.Base)
+	if n.Scope != "" {
+		return "@" + normalizePart(n.Scope) + "/" + s
+	}
+	return s
+}
+
+// NormalizedScope is the normalized scope, or empty for unscoped names.
+func (n Name) NormalizedScope() string {
+	if n.Scope == "" {
+		return ""
+	}
+	return normalizePart(n.Scope)
+}
+
+// Reserved reports whether the name may not be registered. Scoped names are
+// only checked on their scope, since the scope owner controls its contents.
+func (n Name) Reserved() bool {
+	if n.Scope != "" {
+		return reserved[normalizePart(n.Scope)]
+	}
+	return reserved[normalizePart(n.Base)]
+}
+
+// Normalize returns the lookup key for raw without validating it.
+func Normalize(raw string) string {
+	if strings.HasPrefix(raw, "@") {
+		if scope, base, ok := strings.Cut(raw[1:], "/"); ok {
+			return "@" + normalizePart(scope) + "/" + normalizePart(base)
+		}
+	}
+	return normalizePart(raw)
+}
+
+func normalizePart(s string) string {
+	return sepRe.ReplaceAllString(strings.ToLower(s), "-")
+}
@@ -0,0 +1,112 @@
+package pkgname
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeConfusables(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"libfoo", "LibFoo"},
+		{"lib-foo", "lib_foo"},
+		{"lib-foo", "lib.foo"},
+		{"lib-foo", "Lib__Foo"},
+		{"lib-foo", "lib-._foo"},
+		{"foo-bar-utils", "Foo.Bar_Utils"},
+		{"@team/lib-foo", "@Team/lib_foo"},
+		{"@my-team/lib-foo", "@my.team/LIB.FOO"},
+	}
+	for _, tt := range tests {
+		if na, nb := Normalize(tt.a), Normalize(tt.b); na != nb {
+			t.Errorf("Normalize(%q) = %q, Normalize(%q) = %q; want equal", tt.a, na, tt.b, nb)
+		}
+	}
+}
+
+func TestNormalizeDistinct(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"libfoo", "lib-foo"},
+		{"libfoo", "libfoo2"},
+		{"@team/libfoo", "libfoo"},
+		{"@team/libfoo", "@other/libfoo"},
+		{"team/libfoo", "@team/libfoo"},
+	}
+	for _, tt := range tests {
+		if Normalize(tt.a) == Normalize(tt.b) {
+			t.Errorf("Normalize(%q) == Normalize(%q) = %q; want distinct", tt.a, tt.b, Normalize(tt.a))
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw   string
+		want  Name
+		err   error
+		normd string
+	}{
+		{"libfoo", Name{Base: "libfoo"}, nil, "libfoo"},
+		{"Lib_Foo.js", Name{Base: "Lib_Foo.js"}, nil, "lib-foo-js"},
+		{"@Team/lib.foo", Name{Scope: "Team", Base: "lib.foo"}, nil, "@team/lib-foo"},
+		{"", Name{}, ErrInvalid, ""},
+		{"-libfoo", Name{}, ErrInvalid, ""},
+		{".libfoo", Name{}, ErrInvalid, ""},
+		{"lib foo", Name{}, ErrInvalid, ""},
+		{"lib/foo", Name{}, ErrInvalid, ""},
+		{"@team", Name{}, ErrInvalid, ""},
+		{"@/libfoo", Name{}, ErrInvalid, ""},
+		{"@team/", Name{}, ErrInvalid, ""},
+		{"@team/lib/foo", Name{}, ErrInvalid, ""},
+		// lookalikes of ASCII letters would dodge normalization
+		{"l\u0456bfoo", Name{}, ErrInvalid, ""},       // Cyrillic i
+		{"libfo\u043e", Name{}, ErrInvalid, ""},       // Cyrillic o
+		{"\uff4cibfoo", Name{}, ErrInvalid, ""},       // fullwidth l
+		{"lib\u200bfoo", Name{}, ErrInvalid, ""},      // zero-width space
+		{"@t\u0435am/libfoo", Name{}, ErrInvalid, ""}, // Cyrillic e in the scope
+		{strings.Repeat("a", MaxLen), Name{Base: strings.Repeat("a", MaxLen)}, nil, strings.Repeat("a", MaxLen)},
+		{strings.Repeat("a", MaxLen+1), Name{}, ErrTooLong, ""},
+	}
+	for _, tt := range tests {
+		n, err := Parse(tt.raw)
+		if !errors.Is(err, tt.err) || n != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v, %v", tt.raw, n, err, tt.want, tt.err)
+			continue
+		}
+		if err == nil && n.Normalized() != tt.normd {
+			t.Errorf("Parse(%q).Normalized() = %q, want %q", tt.raw, n.Normalized(), tt.normd)
+		}
+		if err == nil && n.String() != tt.raw {
+			t.Errorf("Parse(%q).String() = %q", tt.raw, n.String())
+		}
+	}
+}
+
+func TestReserved(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{"admin", true},
+		{"Admin", true},
+		{"by_name", true},
+		{"node.modules", true},
+		{"administrators", false},
+		{"libfoo", false},
+		{"@admin/libfoo", true},
+		{"@team/admin", false},
+	}
+	for _, tt := range tests {
+		n, err := Parse(tt.raw)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.raw, err)
+		}
+		if got := n.Reserved(); got != tt.want {
+			t.Errorf("Parse(%q).Reserved() = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
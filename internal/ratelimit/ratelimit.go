@@ -0,0 +1,152 @@
+// Package ratelimit implements token-bucket rate limiting.
+//
+// A Policy describes a bucket: it holds up to Burst tokens and refills at
+// Limit tokens per Period. Buckets live in a Store, keyed by whatever the
+// caller chooses (client IP, user, token). MemoryStore keeps them in process;
+// a shared backend only has to implement Store.
+package ratelimit
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Policy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	// Burst is the bucket size; zero means Limit.
+	Burst int
+}
+
+func (p Policy) burst() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Limit)
+}
+
+// rate is the refill rate in tokens per second.
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request would be allowed; zero
+	// when Allowed.
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	// Take removes one token from the bucket for key under p.
+	Take(key string, p Policy, now time.Time) (Result, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled; from then on it is the
+	// same as a new one and can be dropped.
+	full time.Time
+}
+
+// DefaultMaxBuckets bounds a MemoryStore's memory when MaxBuckets is zero.
+const DefaultMaxBuckets = 100000
+
+type MemoryStore struct {
+	// MaxBuckets caps the number of buckets kept. When a new key would
+	// exceed it, full buckets are dropped and then the ones closest to
+	// full, so a flood of keys cannot exhaust memory.
+	MaxBuckets int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+// pruneEvery is how many takes pass between sweeps for idle buckets.
+const pruneEvery = 10000
+
+func (s *MemoryStore) Take(key string, p Policy, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%pruneEvery == 0 {
+		s.prune(now)
+	}
+
+	key = p.Name + ":" + key
+	b, ok := s.buckets[key]
+	if !ok {
+		s.makeRoom(now)
+		b = &bucket{tokens: p.burst(), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(p.burst(), b.tokens+now.Sub(b.last).Seconds()*p.rate())
+	b.last = now
+
+	res := Result{Limit: int(p.burst())}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.tokens) / p.rate())
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = seconds((p.burst() - b.tokens) / p.rate())
+	b.full = now.Add(res.Reset)
+	return res, nil
+}
+
+// prune drops buckets that have refilled completely.
+func (s *MemoryStore) prune(now time.Time) {
+	for k, b := range s.buckets {
+		if !b.full.After(now) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// makeRoom ensures a new bucket fits under MaxBuckets. When pruning is not
+// enough it evicts the buckets closest to full, a tenth of the cap at a
+// time so the scan is rare.
+func (s *MemoryStore) makeRoom(now time.Time) {
+	max := s.MaxBuckets
+	if max <= 0 {
+		max = DefaultMaxBuckets
+	}
+	if len(s.buckets) < max {
+		return
+	}
+	s.prune(now)
+	for len(s.buckets) >= max {
+		evict := max/10 + 1
+		keys := make([]string, 0, len(s.buckets))
+		for k := range s.buckets {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return s.buckets[keys[i]].full.Before(s.buckets[keys[j]].full) })
+		if evict > len(keys) {
+			evict = len(keys)
+		}
+		for _, k := range keys[:evict] {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second))
+}
@@ -0,0 +1,179 @@
+// Package spdx validates SPDX license expressions such as "MIT",
+// "Apache-2.0 OR MIT" or "GPL-2.0-or-later WITH Classpath-exception-2.0".
+//
+// Only the commonly used subset of the SPDX license list is known; anything
+// else must be written as a LicenseRef-<idstring>.
+package spdx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrEmpty = errors.New("empty license expression")
+
+var licenseIDs = []string{
+	"0BSD", "AFL-3.0", "AGPL-3.0-only", "AGPL-3.0-or-later", "Apache-1.1", "Apache-2.0",
+	"APSL-2.0", "Artistic-1.0", "Artistic-2.0", "BlueOak-1.0.0", "BSD-1-Clause",
+	"BSD-2-Clause", "BSD-2-Clause-Patent", "BSD-3-Clause", "BSD-3-Clause-Clear",
+	"BSD-4-Clause", "BSL-1.0", "CC-BY-4.0", "CC-BY-SA-4.0", "CC0-1.0", "CDDL-1.0",
+	"CDDL-1.1", "CECILL-2.1", "ECL-2.0", "EPL-1.0", "EPL-2.0", "EUPL-1.1", "EUPL-1.2",
+	"GPL-1.0-only", "GPL-1.0-or-later", "GPL-2.0-only", "GPL-2.0-or-later",
+	"GPL-3.0-only", "GPL-3.0-or-later", "ISC", "LGPL-2.0-only", "LGPL-2.0-or-later",
+	"LGPL-2.1-only", "LGPL-2.1-or-later", "LGPL-3.0-only", "LGPL-3.0-or-later",
+	"LPPL-1.3c", "MIT", "MIT-0", "MPL-1.1", "MPL-2.0", "MPL-2.0-no-copyleft-exception",
+	"MS-PL", "MS-RL", "MulanPSL-2.0", "NCSA", "ODbL-1.0", "OFL-1.1", "OpenSSL",
+	"OSL-3.0", "PHP-3.01", "PostgreSQL", "Python-2.0", "Ruby", "Unicode-3.0",
+	"Unicode-DFS-2016", "Unlicense", "UPL-1.0", "Vim", "W3C", "WTFPL", "X11",
+	"Zlib", "ZPL-2.1",
+}
+
+var exceptionIDs = []string{
+	"Autoconf-exception-3.0", "Bison-exception-2.2", "Classpath-exception-2.0",
+	"GCC-exception-3.1", "LLVM-exception", "OpenJDK-assembly-exception-1.0",
+	"Qt-LGPL-exception-1.1", "Swift-exception", "u-boot-exception-2.0",
+}
+
+var (
+	licenses   = index(licenseIDs)
+	exceptions = index(exceptionIDs)
+	refRe      = regexp.MustCompile(`^(DocumentRef-[A-Za-z0-9.-]+:)?LicenseRef-[A-Za-z0-9.-]+$`)
+)
+
+func index(ids []string) map[string]string {
+	m := make(map[string]string, len(ids))
+	for _, id := range ids {
+		m[strings.ToLower(id)] = id
+	}
+	return m
+}
+
+// Normalize parses expr and returns it with identifiers in their canonical
+// case and operators upper-cased, or an error describing the first problem.
+func Normalize(expr string) (string, error) {
+	toks := tokenize(expr)
+	if len(toks) == 0 {
+		return "", ErrEmpty
+	}
+	p := &parser{toks: toks}
+	out, err := p.or()
+	if err != nil {
+		return "", err
+	}
+	if p.pos != len(p.toks) {
+		return "", fmt.Errorf("unexpected %q in license expression", p.toks[p.pos])
+	}
+	return out, nil
+}
+
+func tokenize(expr string) []string {
+	expr = strings.ReplaceAll(expr, "(", " ( ")
+	expr = strings.ReplaceAll(expr, ")", " ) ")
+	return strings.Fields(expr)
+}
+
+// grammar (SPDX annex D):
+//
+//	or      = and { "OR" and }
+//	and     = with { "AND" with }
+//	with    = primary [ "WITH" exception ]
+//	primary = license [ "+" ] | "(" or ")"
+type parser struct {
+	toks []string
+	pos  int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) or() (string, error) {
+	left, err := p.and()
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return "", err
+		}
+		left += " OR " + right
+	}
+	return left, nil
+}
+
+func (p *parser) and() (string, error) {
+	left, err := p.with()
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		right, err := p.with()
+		if err != nil {
+			return "", err
+		}
+		left += " AND " + right
+	}
+	return left, nil
+}
+
+func (p *parser) with() (string, error) {
+	lic, err := p.primary()
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(p.peek(), "WITH") {
+		return lic, nil
+	}
+	p.next()
+	t := p.next()
+	exc, ok := exceptions[strings.ToLower(t)]
+	if !ok {
+		if t == "" {
+			return "", errors.New("missing exception after WITH")
+		}
+		return "", fmt.Errorf("unknown license exception %q", t)
+	}
+	return lic + " WITH " + exc, nil
+}
+
+func (p *parser) primary() (string, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return "", errors.New("unexpected end of license expression")
+	case t == "(":
+		inner, err := p.or()
+		if err != nil {
+			return "", err
+		}
+		if p.next() != ")" {
+			return "", errors.New("missing closing parenthesis")
+		}
+		return "(" + inner + ")", nil
+	case refRe.MatchString(t):
+		return t, nil
+	}
+	plus := strings.HasSuffix(t, "+")
+	id, ok := licenses[strings.ToLower(strings.TrimSuffix(t, "+"))]
+	if !ok {
+		return "", fmt.Errorf("unknown SPDX license identifier %q", t)
+	}
+	if plus {
+		id += "+"
+	}
+	return id, nil
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DownloadQueue records downloads in the background so a download does not
+// wait for SQLite's write lock. Pushed downloads are buffered and written
+// with RecordDownloads once a batch is full or the flush interval passes.
+// Failed batches are kept and retried; Close writes whatever is left.
+type DownloadQueue struct {
+	store    *Store
+	ch       chan Download
+	batch    int
+	interval time.Duration
+	done     chan struct{}
+
+	// mu guards closed; Push holds it for reading while it sends, so Close
+	// cannot close ch under a send in progress
+	mu     sync.RWMutex
+	closed bool
+	err    error
+}
+
+// maxPendingDownloads caps how many unwritten downloads are held while the
+// database keeps failing, so a broken database cannot exhaust memory.
+const maxPendingDownloads = 1_000_000
+
+// NewDownloadQueue starts the background writer. size is the buffer between
+// handlers and the writer; Push blocks only when it is full.
+func (s *Store) NewDownloadQueue(size, batch int, interval time.Duration) *DownloadQueue {
+	q := &DownloadQueue{
+		store:    s,
+		ch:       make(chan Download, size),
+		batch:    batch,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Push queues a download. Downloads pushed after Close, by requests still
+// finishing during shutdown, are logged and dropped.
+func (q *DownloadQueue) Push(d Download) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		log.Printf("download queue: closed, dropping download of artifact %d", d.ArtifactID)
+		return
+	}
+	q.ch <- d
+}
+
+// Close stops accepting downloads, writes everything still queued and
+// returns the error of that last write, if any.
+func (q *DownloadQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.mu.Unlock()
+	<-q.done
+	return q.err
+}
+
+func (q *DownloadQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	var pending []Download
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := q.store.RecordDownloads(pending); err != nil {
+			if len(pending) > maxPendingDownloads {
+				log.Printf("download queue: dropping %d downloads after write error: %v", len(pending), err)
+				pending = nil
+			}
+			return err
+		}
+		pending = pending[:0]
+		return nil
+	}
+	for {
+		select {
+		case d, ok := <-q.ch:
+			if !ok {
+				// a few attempts, in case the last batch hit a busy database
+				for i := 0; i < 3; i++ {
+					if q.err = flush(); q.err == nil {
+						return
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+				log.Printf("download queue: %d downloads not written at shutdown: %v", len(pending), q.err)
+				return
+			}
+			pending = append(pending, d)
+			// while writes fail, retry once per further batch, not per download
+			if len(pending)%q.batch == 0 {
+				if err := flush(); err != nil {
+					log.Printf("download queue: write failed, retrying with the next batch: %v", err)
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				log.Printf("download queue: write failed, retrying: %v", err)
+			}
+		}
+	}
+}
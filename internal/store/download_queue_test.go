@@ -0,0 +1,51 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDownloadQueuePushAfterClose(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q := New(db).NewDownloadQueue(1, 10, time.Hour)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// must neither panic nor block
+	q.Push(Download{ArtifactID: 1})
+	if err := q.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
+
+func TestDownloadQueueConcurrentClose(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// no table, so writes fail and nothing is recorded; only the channel
+	// handling is under test
+	q := New(db).NewDownloadQueue(4, 1000, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				q.Push(Download{ArtifactID: int64(j)})
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	q.Close()
+	wg.Wait()
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"ebuild/internal/hll"
+)
+
+// Download is one artifact download. Client identifies the downloader for
+// unique counts; only its hash ends up in the database.
+type Download struct {
+	ArtifactID       int64
+	PackageVersionID int64
+	PackageID        int64
+	Client           string
+	At               time.Time
+}
+
+const dayFormat = "2006-01-02"
+
+type dailyKey struct {
+	day        string
+	artifactID int64
+}
+
+type dailyRow struct {
+	versionID, pkgID int64
+	downloads        int64
+	clients          *hll.Sketch
+}
+
+// RecordDownloads adds the downloads to the running totals on packages and
+// package_versions and to the daily rollup, all in one transaction.
+func (s *Store) RecordDownloads(ds []Download) error {
+	if len(ds) == 0 {
+		return nil
+	}
+	versions := map[int64]int64{}
+	packages := map[int64]int64{}
+	daily := map[dailyKey]*dailyRow{}
+	for _, d := range ds {
+		versions[d.PackageVersionID]++
+		packages[d.PackageID]++
+		k := dailyKey{d.At.UTC().Format(dayFormat), d.ArtifactID}
+		row := daily[k]
+		if row == nil {
+			row = &dailyRow{versionID: d.PackageVersionID, pkgID: d.PackageID, clients: hll.New()}
+			daily[k] = row
+		}
+		row.downloads++
+		if d.Client != "" {
+			row.clients.Add(d.Client)
+		}
+	}
+
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, n := range versions {
+		if _, err := tx.Exec(`UPDATE package_versions SET download_count = download_count + ? WHERE id = ?`, n, id); err != nil {
+			return err
+		}
+	}
+	for id, n := range packages {
+		if _, err := tx.Exec(`UPDATE packages SET download_count = download_count + ? WHERE id = ?`, n, id); err != nil {
+			return err
+		}
+	}
+	for k, row := range daily {
+		var stored []byte
+		err := tx.Get(&stored, `SELECT clients FROM download_daily WHERE day = ? AND artifact_id = ?`, k.day, k.artifactID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		prev, err := hll.FromBytes(stored)
+		if err != nil {
+			return fmt.Errorf("download_daily %s artifact %d: %w", k.day, k.artifactID, err)
+		}
+		row.clients.Merge(prev)
+		_, err = tx.Exec(`INSERT INTO download_daily (day, artifact_id, package_version_id, package_id, downloads, clients) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(day, artifact_id) DO UPDATE SET downloads = downloads + excluded.downloads, clients = excluded.clients`,
+			k.day, k.artifactID, row.versionID, row.pkgID, row.downloads, row.clients.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type DownloadPoint struct {
+	Day           string `json:"date"`
+	Downloads     int64  `json:"downloads"`
+	UniqueClients uint64 `json:"unique_clients"`
+}
+
+type DownloadSeries struct {
+	From          string          `json:"from"`
+	To            string          `json:"to"`
+	Downloads     int64           `json:"downloads"`
+	UniqueClients uint64          `json:"unique_clients"`
+	Points        []DownloadPoint `json:"series"`
+}
+
+// DownloadFilter narrows a series to one version or artifact of the package.
+type DownloadFilter struct {
+	PackageVersionID *int64
+	ArtifactID       *int64
+}
+
+// DownloadSeries returns a package's daily downloads from from to to, both
+// inclusive UTC days, with a point for every day. UniqueClients over the
+// range is estimated from the merged sketches, so it is not the sum of the
+// daily values.
+func (s *Store) DownloadSeries(pkgID int64, f DownloadFilter, from, to time.Time) (*DownloadSeries, error) {
+	clauses := []string{"package_id = ?", "day >= ?", "day <= ?"}
+	args := []interface{}{pkgID, from.UTC().Format(dayFormat), to.UTC().Format(dayFormat)}
+	if f.PackageVersionID != nil {
+		clauses = append(clauses, "package_version_id = ?")
+		args = append(args, *f.PackageVersionID)
+	}
+	if f.ArtifactID != nil {
+		clauses = append(clauses, "artifact_id = ?")
+		args = append(args, *f.ArtifactID)
+	}
+	var rows []struct {
+		Day       string `db:"day"`
+		Downloads int64  `db:"downloads"`
+		Clients   []byte `db:"clients"`
+	}
+	if err := s.DB.Select(&rows, `SELECT day, downloads, clients FROM download_daily WHERE `+strings.Join(clauses, " AND ")+` ORDER BY day`, args...); err != nil {
+		return nil, err
+	}
+	type acc struct {
+		downloads int64
+		clients   *hll.Sketch
+	}
+	days := map[string]*acc{}
+	all := hll.New()
+	series := &DownloadSeries{From: args[1].(string), To: args[2].(string), Points: []DownloadPoint{}}
+	for _, r := range rows {
+		sk, err := hll.FromBytes(r.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("download_daily %s: %w", r.Day, err)
+		}
+		a := days[r.Day]
+		if a == nil {
+			a = &acc{clients: hll.New()}
+			days[r.Day] = a
+		}
+		a.downloads += r.Downloads
+		a.clients.Merge(sk)
+		all.Merge(sk)
+		series.Downloads += r.Downloads
+	}
+	series.UniqueClients = all.Estimate()
+	for d := from.UTC().Truncate(24 * time.Hour); !d.After(to.UTC()); d = d.AddDate(0, 0, 1) {
+		p := DownloadPoint{Day: d.Format(dayFormat)}
+		if a := days[p.Day]; a != nil {
+			p.Downloads, p.UniqueClients = a.downloads, a.clients.Estimate()
+		}
+		series.Points = append(series.Points, p)
+	}
+	return series, nil
+}
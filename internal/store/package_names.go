@@ -0,0 +1,123 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"ebuild/internal/pkgname"
+)
+
+// NameCollisionError lists packages whose names normalize to the same key.
+// Only one of each group may keep its name; the others must be renamed
+// before their normalized names can be stored.
+type NameCollisionError struct {
+	// Collisions maps each shared key to the "name (id N)" of its packages.
+	Collisions map[string][]string
+}
+
+func (e *NameCollisionError) Error() string {
+	keys := make([]string, 0, len(e.Collisions))
+	for k := range e.Collisions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("package names collide after normalization; rename all but one of each with `admin rename-package`:")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n  %s: %s", k, strings.Join(e.Collisions[k], ", "))
+	}
+	return b.String()
+}
+
+// NormalizePackageNames fills normalized_name for packages registered before
+// names were normalized, using pkgname.Normalize. If any of them would share
+// a key with another package nothing is written and a *NameCollisionError
+// lists every collision.
+func (s *Store) NormalizePackageNames() (int, error) {
+	var rows []struct {
+		ID         int64          `db:"id"`
+		Name       string         `db:"name"`
+		Normalized sql.NullString `db:"normalized_name"`
+	}
+	if err := s.DB.Select(&rows, `SELECT id, name, normalized_name FROM packages ORDER BY id`); err != nil {
+		return 0, err
+	}
+	groups := map[string][]string{}
+	pending := map[int64]string{}
+	touched := map[string]bool{}
+	for _, r := range rows {
+		key := r.Normalized.String
+		if !r.Normalized.Valid {
+			key = pkgname.Normalize(r.Name)
+			pending[r.ID] = key
+			touched[key] = true
+		}
+		groups[key] = append(groups[key], fmt.Sprintf("%s (id %d)", r.Name, r.ID))
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	collisions := map[string][]string{}
+	for key := range touched {
+		if len(groups[key]) > 1 {
+			collisions[key] = groups[key]
+		}
+	}
+	if len(collisions) > 0 {
+		return 0, &NameCollisionError{Collisions: collisions}
+	}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for id, key := range pending {
+		if _, err := tx.Exec(`UPDATE packages SET normalized_name = ? WHERE id = ?`, key, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), tx.Commit()
+}
+
+// RenamePackage gives a package a new, valid and unclaimed name and records
+// the change in the audit log. It is how admins resolve the collisions
+// NormalizePackageNames reports.
+func (s *Store) RenamePackage(id int64, newName string) error {
+	name, err := pkgname.Parse(newName)
+	if err != nil {
+		return err
+	}
+	if name.Reserved() {
+		return pkgname.ErrReserved
+	}
+	var old string
+	if err := s.DB.Get(&old, `SELECT name FROM packages WHERE id = ?`, id); err != nil {
+		return err
+	}
+	var others []struct {
+		Name       string         `db:"name"`
+		Normalized sql.NullString `db:"normalized_name"`
+	}
+	if err := s.DB.Select(&others, `SELECT name, normalized_name FROM packages WHERE id != ? AND (normalized_name = ? OR normalized_name IS NULL)`, id, name.Normalized()); err != nil {
+		return err
+	}
+	for _, o := range others {
+		if o.Normalized.String == name.Normalized() || !o.Normalized.Valid && pkgname.Normalize(o.Name) == name.Normalized() {
+			return fmt.Errorf("name %q is taken by %q", name.String(), o.Name)
+		}
+	}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE packages SET name = ?, normalized_name = ? WHERE id = ?`, name.String(), name.Normalized(), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO audit_log (action, target_type, target_id, meta) VALUES ('package_renamed', 'package', ?, ?)`, id, fmt.Sprintf("from=%s to=%s via=admin", old, name.String())); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
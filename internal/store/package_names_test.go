@@ -0,0 +1,84 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func namesDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	db.MustExec(`CREATE TABLE packages (id INTEGER PRIMARY KEY, name TEXT UNIQUE, normalized_name TEXT)`)
+	db.MustExec(`CREATE UNIQUE INDEX idx_packages_normalized_name ON packages(normalized_name)`)
+	db.MustExec(`CREATE TABLE audit_log (id INTEGER PRIMARY KEY AUTOINCREMENT, action TEXT, target_type TEXT, target_id INTEGER, meta TEXT)`)
+	return db
+}
+
+func TestNormalizePackageNames(t *testing.T) {
+	db := namesDB(t)
+	// separator runs longer than any fixed number of replace() calls
+	db.MustExec(`INSERT INTO packages (id, name, normalized_name) VALUES (1, 'libfoo', 'libfoo'), (2, 'Lib_________Bar', NULL), (3, 'Baz.Qux', NULL)`)
+	s := New(db)
+	n, err := s.NormalizePackageNames()
+	if err != nil || n != 2 {
+		t.Fatalf("NormalizePackageNames = %d, %v; want 2, nil", n, err)
+	}
+	var got []string
+	db.Select(&got, `SELECT normalized_name FROM packages ORDER BY id`)
+	if strings.Join(got, " ") != "libfoo lib-bar baz-qux" {
+		t.Errorf("normalized names = %v", got)
+	}
+	if n, err := s.NormalizePackageNames(); err != nil || n != 0 {
+		t.Errorf("second run = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestNormalizePackageNamesCollisions(t *testing.T) {
+	db := namesDB(t)
+	db.MustExec(`INSERT INTO packages (id, name, normalized_name) VALUES (1, 'foo-bar', 'foo-bar'), (2, 'Foo__Bar', NULL), (3, 'a.b', NULL), (4, 'A_B', NULL), (5, 'other', NULL)`)
+	s := New(db)
+	_, err := s.NormalizePackageNames()
+	var ce *NameCollisionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("NormalizePackageNames = %v, want a NameCollisionError", err)
+	}
+	if len(ce.Collisions) != 2 || len(ce.Collisions["foo-bar"]) != 2 || len(ce.Collisions["a-b"]) != 2 {
+		t.Errorf("collisions = %v", ce.Collisions)
+	}
+	var pending int
+	db.Get(&pending, `SELECT count(*) FROM packages WHERE normalized_name IS NULL`)
+	if pending != 4 {
+		t.Errorf("%d names left pending, want all 4: nothing may be written on a collision", pending)
+	}
+	var renamed string
+	db.Get(&renamed, `SELECT name FROM packages WHERE id = 2`)
+	if renamed != "Foo__Bar" {
+		t.Errorf("package 2 renamed to %q", renamed)
+	}
+
+	if err := s.RenamePackage(4, "a.b"); err == nil {
+		t.Error("RenamePackage to a name that collides with a pending one succeeded")
+	}
+	if err := s.RenamePackage(2, "foo-bar-legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenamePackage(4, "a-b-2"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.NormalizePackageNames(); err != nil || n != 2 {
+		t.Errorf("after renames NormalizePackageNames = %d, %v; want 2, nil", n, err)
+	}
+	var audits int
+	db.Get(&audits, `SELECT count(*) FROM audit_log WHERE action = 'package_renamed'`)
+	if audits != 2 {
+		t.Errorf("%d package_renamed audit entries, want 2", audits)
+	}
+}
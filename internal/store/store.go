@@ -4,9 +4,12 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"strings"
 
 	"ebuild/internal/models"
+	"ebuild/internal/pkgname"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -30,6 +33,34 @@ func (s *Store) CreateUser(u *models.User, passwordHash string) (int64, error) {
 	return res.LastInsertId()
 }
 
+// EnsureAdmin makes username a site admin, creating the account with a
+// verified email when it does not exist yet. created reports which happened.
+func (s *Store) EnsureAdmin(username, email, passwordHash string) (id int64, created bool, err error) {
+	var u struct {
+		ID      int64        `db:"id"`
+		Deleted sql.NullTime `db:"deleted_at"`
+	}
+	err = s.DB.Get(&u, `SELECT id, deleted_at FROM users WHERE username = ?`, username)
+	switch {
+	case err == nil && u.Deleted.Valid:
+		return 0, false, fmt.Errorf("user %s was deleted", username)
+	case err == nil:
+		_, err = s.DB.Exec(`UPDATE users SET role = ?, suspended_at = NULL, suspended_reason = '' WHERE id = ?`, models.RoleAdmin, u.ID)
+		return u.ID, false, err
+	case err != sql.ErrNoRows:
+		return 0, false, err
+	}
+	if passwordHash == "" {
+		return 0, false, fmt.Errorf("user %s does not exist; a password is needed to create it", username)
+	}
+	res, err := s.DB.Exec(`INSERT INTO users (username, email, password_hash, role, email_verified_at) VALUES (?, ?, ?, ?, datetime('now'))`, username, email, passwordHash, models.RoleAdmin)
+	if err != nil {
+		return 0, false, err
+	}
+	id, err = res.LastInsertId()
+	return id, true, err
+}
+
 func (s *Store) GetUserByUsername(username string) (*models.User, error) {
 	var u models.User
 	if err := s.DB.Get(&u, `SELECT id, username, email, password_hash, role, created_at FROM users WHERE username = ?`, username); err != nil {
@@ -51,7 +82,7 @@ func (s *Store) IsTokenRevoked(rawToken string) (bool, error) {
 }
 
 func (s *Store) CreatePackage(p *models.Package) (int64, error) {
-	res, err := s.DB.Exec(`INSERT INTO packages (name, description, created_by, token_required) VALUES (?, ?, ?, ?)`, p.Name, p.Description, p.CreatedBy, p.TokenRequired)
+	res, err := s.DB.Exec(`INSERT INTO packages (name, normalized_name, description, created_by, token_required) VALUES (?, ?, ?, ?, ?)`, p.Name, pkgname.Normalize(p.Name), p.Description, p.CreatedBy, p.TokenRequired)
 	if err != nil {
 		return 0, err
 	}
@@ -68,7 +99,7 @@ func (s *Store) CreateVersion(v *models.PackageVersion) (int64, error) {
 
 func (s *Store) GetPackageByID(id int64) (*models.Package, error) {
 	var p models.Package
-	if err := s.DB.Get(&p, `SELECT id, name, description, created_by, token_required, created_at FROM packages WHERE id = ?`, id); err != nil {
+	if err := s.DB.Get(&p, `SELECT id, name, description, created_by, token_required, org_id, COALESCE(license, '') AS license, homepage, repository_url, keywords, readme, readme_html, created_at FROM packages WHERE id = ?`, id); err != nil {
 		return nil, err
 	}
 	return &p, nil
@@ -101,7 +132,15 @@ func (s *Store) CreateArtifact(packageVersionID int64, blobURL, filename string,
 	return res.LastInsertId()
 }
 
+// UpsertVote records a -1 or +1 vote; 0 removes the user's vote.
 func (s *Store) UpsertVote(userID, packageID int64, value int) error {
+	if value == 0 {
+		_, err := s.DB.Exec(`DELETE FROM votes WHERE user_id = ? AND package_id = ?`, userID, packageID)
+		return err
+	}
+	if value != 1 && value != -1 {
+		return fmt.Errorf("vote value must be -1, 0 or 1, got %d", value)
+	}
 	_, err := s.DB.Exec(`INSERT INTO votes (user_id, package_id, value, created_at) VALUES (?, ?, ?, datetime('now')) ON CONFLICT(user_id, package_id) DO UPDATE SET value = excluded.value, created_at = datetime('now')`, userID, packageID, value)
 	return err
 }
@@ -128,3 +167,59 @@ func boolToInt(b bool) int {
 	}
 	return 0
 }
+
+type SearchIndexStats struct {
+	Packages int64 `json:"packages"`
+	Indexed  int64 `json:"indexed"`
+	Terms    int64 `json:"terms"`
+}
+
+// ErrNoFTS5 means the sqlite driver was compiled without FTS5. Triggers keep
+// packages_fts in sync on every package write, so such a binary cannot
+// create or update packages.
+var ErrNoFTS5 = errors.New("sqlite was built without FTS5; build with -tags sqlite_fts5 (see make build)")
+
+// CheckFTS5 returns ErrNoFTS5 unless the linked sqlite supports FTS5.
+// Binaries that write to the database call it at startup.
+func (s *Store) CheckFTS5() error {
+	var ok bool
+	if err := s.DB.Get(&ok, `SELECT sqlite_compileoption_used('ENABLE_FTS5')`); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoFTS5
+	}
+	return nil
+}
+
+// RebuildSearchIndex drops every packages_fts row and reindexes all packages
+// from packages_fts_source.
+func (s *Store) RebuildSearchIndex() (*SearchIndexStats, error) {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM packages_fts`); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`INSERT INTO packages_fts (rowid, name, description, keywords, maintainers, readme) SELECT id, name, description, keywords, maintainers, readme FROM packages_fts_source`)
+	if err != nil {
+		return nil, err
+	}
+	var stats SearchIndexStats
+	stats.Indexed, _ = res.RowsAffected()
+	if err := tx.Get(&stats.Packages, `SELECT COUNT(*) FROM packages`); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if _, err := s.DB.Exec(`INSERT INTO packages_fts (packages_fts) VALUES ('optimize')`); err != nil {
+		return nil, err
+	}
+	if err := s.DB.Get(&stats.Terms, `SELECT COUNT(*) FROM packages_fts_vocab`); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
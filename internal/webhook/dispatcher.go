@@ -0,0 +1,247 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MaxAttempts is how often a delivery is tried before it is marked failed.
+const MaxAttempts = 8
+
+// backoff is the wait after the nth failed attempt (1-based).
+func backoff(n int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < n && d < 6*time.Hour; i++ {
+		d *= 3
+	}
+	if d > 6*time.Hour {
+		d = 6 * time.Hour
+	}
+	return d
+}
+
+var errPrivateAddress = errors.New("webhook: refusing to connect to a private address")
+
+// deniedPrefixes are the special-purpose ranges (RFC 6890 and successors)
+// a receiver may not resolve to: local, private, shared, reserved and
+// documentation networks and the translation prefixes that could reach them.
+var deniedPrefixes = func() []netip.Prefix {
+	var ps []netip.Prefix
+	for _, s := range []string{
+		"0.0.0.0/8",       // "this network"
+		"10.0.0.0/8",      // private
+		"100.64.0.0/10",   // carrier-grade NAT
+		"127.0.0.0/8",     // loopback
+		"169.254.0.0/16",  // link-local, including cloud metadata
+		"172.16.0.0/12",   // private
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // documentation
+		"192.88.99.0/24",  // 6to4 relay anycast
+		"192.168.0.0/16",  // private
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // documentation
+		"203.0.113.0/24",  // documentation
+		"224.0.0.0/4",     // multicast
+		"240.0.0.0/4",     // reserved, including broadcast
+		"::/96",           // unspecified, loopback and IPv4-compatible
+		"64:ff9b::/96",    // NAT64
+		"64:ff9b:1::/48",  // local NAT64
+		"100::/64",        // discard
+		"2001::/23",       // IETF protocol assignments, including Teredo
+		"2001:db8::/32",   // documentation
+		"2002::/16",       // 6to4, which embeds an IPv4 address
+		"fc00::/7",        // unique local
+		"fe80::/10",       // link-local
+		"ff00::/8",        // multicast
+	} {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return ps
+}()
+
+// deniedAddr reports whether addr is in one of deniedPrefixes. IPv4-mapped
+// IPv6 addresses are checked as the IPv4 address they carry.
+func deniedAddr(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	for _, p := range deniedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeDialer refuses addresses in deniedPrefixes, checked after DNS
+// resolution so names cannot be pointed at internal services.
+func safeDialer(allowPrivate bool) *net.Dialer {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	if allowPrivate {
+		return d
+	}
+	d.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil || deniedAddr(addr) {
+			return errPrivateAddress
+		}
+		return nil
+	}
+	return d
+}
+
+type Options struct {
+	// Interval is how often due deliveries are polled for.
+	Interval time.Duration
+	// AllowPrivate permits loopback and private network receivers, for
+	// local development.
+	AllowPrivate bool
+	Timeout      time.Duration
+}
+
+// Dispatcher sends due deliveries in the background until Close.
+type Dispatcher struct {
+	db     *sqlx.DB
+	client *http.Client
+	opts   Options
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewDispatcher(db *sqlx.DB, opts Options) *Dispatcher {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	d := &Dispatcher{
+		db: db,
+		client: &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: &http.Transport{DialContext: safeDialer(opts.AllowPrivate).DialContext},
+			// a redirect could lead to an address the dialer would refuse by
+			// name; receivers must answer directly
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Close stops polling and waits for the delivery in progress. Pending
+// deliveries stay in the table and are sent after the next start.
+func (d *Dispatcher) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if err := d.deliverDue(); err != nil {
+				log.Printf("webhook dispatcher: %v", err)
+			}
+		}
+	}
+}
+
+type delivery struct {
+	ID        int64  `db:"id"`
+	WebhookID int64  `db:"webhook_id"`
+	Event     string `db:"event"`
+	Payload   string `db:"payload"`
+	Attempts  int    `db:"attempts"`
+	URL       string `db:"url"`
+	Secret    string `db:"secret"`
+}
+
+func (d *Dispatcher) deliverDue() error {
+	var due []delivery
+	err := d.db.Select(&due, `SELECT d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= datetime('now') AND w.active = 1
+		ORDER BY d.next_attempt_at, d.id LIMIT 50`)
+	if err != nil {
+		return err
+	}
+	for _, dl := range due {
+		select {
+		case <-d.stop:
+			return nil
+		default:
+		}
+		status, err := d.send(dl)
+		if err := d.record(dl, status, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) send(dl delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	body := []byte(dl.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ebuild-webhooks/1")
+	req.Header.Set("X-Ebuild-Event", dl.Event)
+	req.Header.Set("X-Ebuild-Delivery", strconv.FormatInt(dl.ID, 10))
+	req.Header.Set("X-Ebuild-Signature", Sign(dl.Secret, time.Now(), body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) record(dl delivery, status int, sendErr error) error {
+	var code interface{}
+	if status != 0 {
+		code = status
+	}
+	attempts := dl.Attempts + 1
+	if sendErr == nil {
+		_, err := d.db.Exec(`UPDATE webhook_deliveries SET status = 'succeeded', attempts = ?, response_status = ?, error = '', delivered_at = datetime('now') WHERE id = ?`, attempts, code, dl.ID)
+		return err
+	}
+	if attempts >= MaxAttempts {
+		_, err := d.db.Exec(`UPDATE webhook_deliveries SET status = 'failed', attempts = ?, response_status = ?, error = ? WHERE id = ?`, attempts, code, sendErr.Error(), dl.ID)
+		return err
+	}
+	next := time.Now().Add(backoff(attempts)).UTC().Format("2006-01-02 15:04:05")
+	_, err := d.db.Exec(`UPDATE webhook_deliveries SET attempts = ?, response_status = ?, error = ?, next_attempt_at = ? WHERE id = ?`, attempts, code, sendErr.Error(), next, dl.ID)
+	return err
+}
@@ -0,0 +1,69 @@
+// Package webhook delivers registry events to subscribers' HTTP endpoints.
+//
+// Deliveries are rows of webhook_deliveries. A Dispatcher polls for due
+// ones, POSTs their payload and records the outcome, retrying failures with
+// backoff until MaxAttempts. Every request carries
+//
+//	X-Ebuild-Event       the event name, e.g. version.published
+//	X-Ebuild-Delivery    the delivery id; redeliveries get a new one
+//	X-Ebuild-Signature   t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// keyed with the webhook's secret. Receivers check it with Verify.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sign returns the X-Ebuild-Signature value for body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+func mac(secret, ts string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts))
+	m.Write([]byte("."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+var (
+	ErrBadSignature = errors.New("webhook: signature mismatch")
+	ErrStale        = errors.New("webhook: signature timestamp outside tolerance")
+)
+
+// Verify checks an X-Ebuild-Signature header against body. Signatures older
+// or newer than tolerance are rejected so captured requests cannot be
+// replayed later.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return fmt.Errorf("webhook: malformed signature header")
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > tolerance || d < -tolerance {
+		return ErrStale
+	}
+	if !hmac.Equal([]byte(sig), []byte(mac(secret, ts, body))) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	const secret = "whsec_test"
+	body := []byte(`{"event":"version.published","package":"libfoo","version":"1.2.0"}`)
+	signedAt := time.Unix(1700000000, 0)
+	header := Sign(secret, signedAt, body)
+	sig := header[len("t=1700000000,v1="):]
+	tolerance := 5 * time.Minute
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		now    time.Time
+		want   error
+	}{
+		{"round trip", secret, header, body, signedAt, nil},
+		{"within tolerance", secret, header, body, signedAt.Add(tolerance), nil},
+		{"clock behind sender", secret, header, body, signedAt.Add(-tolerance), nil},
+		{"expired", secret, header, body, signedAt.Add(tolerance + time.Second), ErrStale},
+		{"from the future", secret, header, body, signedAt.Add(-tolerance - time.Second), ErrStale},
+		{"wrong secret", "whsec_other", header, body, signedAt, ErrBadSignature},
+		{"tampered body", secret, header, []byte(`{"event":"version.published","package":"libfoo","version":"6.6.6"}`), signedAt, ErrBadSignature},
+		{"moved timestamp", secret, "t=1700000001,v1=" + sig, body, signedAt, ErrBadSignature},
+		{"spaces after comma", secret, "t=1700000000, v1=" + sig, body, signedAt, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.secret, tt.header, tt.body, tolerance, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	for _, header := range []string{"", "v1=abc", "t=1700000000", "t=soon,v1=abc", "garbage"} {
+		err := Verify("s", header, nil, time.Minute, time.Unix(1700000000, 0))
+		if err == nil || errors.Is(err, ErrBadSignature) || errors.Is(err, ErrStale) {
+			t.Errorf("Verify(%q) = %v, want a malformed header error", header, err)
+		}
+	}
+}
+
+func TestDeniedAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"192.0.0.170", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"::", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:100.64.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"fd00::1", true},
+		{"fe80::1%eth0", true},
+		{"ff02::1", true},
+		{"93.184.216.34", false},
+		{"100.128.0.1", false},
+		{"198.20.0.1", false},
+		{"::ffff:93.184.216.34", false},
+		{"2606:4700::1111", false},
+	}
+	for _, tt := range tests {
+		if got := deniedAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("deniedAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE packages ADD COLUMN license TEXT;
+
+-- vocabulary view over the FTS index, used for typo-tolerant term expansion
+CREATE VIRTUAL TABLE IF NOT EXISTS packages_fts_vocab USING fts5vocab(packages_fts, row);
+
+-- +goose Down
+DROP TABLE IF EXISTS packages_fts_vocab;
+-- Note: SQLite doesn't support dropping columns easily; license will remain if downgrading.
@@ -0,0 +1,93 @@
+-- +goose Up
+-- packages_fts becomes a regular FTS5 table so it can carry columns that do
+-- not exist on packages (version keywords, maintainer names). It is kept in
+-- sync by the triggers below; packages_fts_source is the single definition
+-- of what gets indexed for a package.
+DROP TABLE IF EXISTS packages_fts;
+CREATE VIRTUAL TABLE packages_fts USING fts5(name, description, keywords, maintainers);
+
+CREATE VIEW IF NOT EXISTS packages_fts_source AS
+SELECT
+  p.id,
+  p.name,
+  COALESCE(p.description, '') AS description,
+  COALESCE((SELECT group_concat(json_extract(pv.metadata, '$.keywords'), ' ') FROM package_versions pv WHERE pv.package_id = p.id AND json_valid(pv.metadata)), '') AS keywords,
+  COALESCE((SELECT group_concat(u.username, ' ') FROM users u WHERE u.id = p.created_by OR u.id IN (SELECT pm.user_id FROM package_maintainers pm WHERE pm.package_id = p.id)), '') AS maintainers
+FROM packages p;
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS packages_fts_ai AFTER INSERT ON packages BEGIN
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = new.id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS packages_fts_au AFTER UPDATE OF name, description, created_by ON packages BEGIN
+  DELETE FROM packages_fts WHERE rowid = old.id;
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = new.id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS packages_fts_ad AFTER DELETE ON packages BEGIN
+  DELETE FROM packages_fts WHERE rowid = old.id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS package_versions_fts_ai AFTER INSERT ON package_versions BEGIN
+  DELETE FROM packages_fts WHERE rowid = new.package_id;
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = new.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS package_versions_fts_au AFTER UPDATE OF metadata ON package_versions BEGIN
+  DELETE FROM packages_fts WHERE rowid = new.package_id;
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = new.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS package_versions_fts_ad AFTER DELETE ON package_versions BEGIN
+  DELETE FROM packages_fts WHERE rowid = old.package_id;
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = old.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS package_maintainers_fts_ai AFTER INSERT ON package_maintainers BEGIN
+  DELETE FROM packages_fts WHERE rowid = new.package_id;
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = new.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS package_maintainers_fts_ad AFTER DELETE ON package_maintainers BEGIN
+  DELETE FROM packages_fts WHERE rowid = old.package_id;
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id = old.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS users_fts_au AFTER UPDATE OF username ON users BEGIN
+  DELETE FROM packages_fts WHERE rowid IN (SELECT id FROM packages WHERE created_by = new.id UNION SELECT package_id FROM package_maintainers WHERE user_id = new.id);
+  INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source WHERE id IN (SELECT id FROM packages WHERE created_by = new.id UNION SELECT package_id FROM package_maintainers WHERE user_id = new.id);
+END;
+-- +goose StatementEnd
+
+INSERT INTO packages_fts (rowid, name, description, keywords, maintainers) SELECT id, name, description, keywords, maintainers FROM packages_fts_source;
+
+-- +goose Down
+DROP TRIGGER IF EXISTS users_fts_au;
+DROP TRIGGER IF EXISTS package_maintainers_fts_ad;
+DROP TRIGGER IF EXISTS package_maintainers_fts_ai;
+DROP TRIGGER IF EXISTS package_versions_fts_ad;
+DROP TRIGGER IF EXISTS package_versions_fts_au;
+DROP TRIGGER IF EXISTS package_versions_fts_ai;
+DROP TRIGGER IF EXISTS packages_fts_ad;
+DROP TRIGGER IF EXISTS packages_fts_au;
+DROP TRIGGER IF EXISTS packages_fts_ai;
+DROP VIEW IF EXISTS packages_fts_source;
+DROP TABLE IF EXISTS packages_fts;
+CREATE VIRTUAL TABLE IF NOT EXISTS packages_fts USING fts5(name, description, content='packages', content_rowid='id');
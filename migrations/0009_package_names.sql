@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE packages ADD COLUMN normalized_name TEXT;
+-- Existing rows are left NULL, which the unique index allows any number of.
+-- The server fills them with pkgname.Normalize at startup (or run
+-- `admin normalize-names`) and refuses to start, listing the packages, if two
+-- names collide; resolve those with `admin rename-package`.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_packages_normalized_name ON packages(normalized_name);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_packages_normalized_name;
+-- Note: SQLite doesn't support dropping columns easily; normalized_name will remain if downgrading.
@@ -0,0 +1,59 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS organizations (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL UNIQUE,
+  -- shares the package scope namespace: @<normalized_name>/pkg
+  normalized_name TEXT NOT NULL UNIQUE,
+  display_name TEXT NOT NULL DEFAULT '',
+  created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS org_members (
+  org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'publisher', 'viewer')),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (org_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS teams (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (org_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS team_members (
+  team_id INTEGER NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  PRIMARY KEY (team_id, user_id)
+);
+
+-- per-package grants to a team; the package must belong to the team's org
+CREATE TABLE IF NOT EXISTS team_packages (
+  team_id INTEGER NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+  package_id INTEGER NOT NULL REFERENCES packages(id) ON DELETE CASCADE,
+  role TEXT NOT NULL CHECK (role IN ('admin', 'publisher', 'viewer')),
+  PRIMARY KEY (team_id, package_id)
+);
+
+ALTER TABLE packages ADD COLUMN org_id INTEGER REFERENCES organizations(id) ON DELETE SET NULL;
+-- set on tokens issued on behalf of an organization (CI tokens)
+ALTER TABLE tokens ADD COLUMN org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_org_members_user ON org_members(user_id);
+CREATE INDEX IF NOT EXISTS idx_team_members_user ON team_members(user_id);
+CREATE INDEX IF NOT EXISTS idx_packages_org ON packages(org_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_packages_org;
+DROP INDEX IF EXISTS idx_team_members_user;
+DROP INDEX IF EXISTS idx_org_members_user;
+DROP TABLE IF EXISTS team_packages;
+DROP TABLE IF EXISTS team_members;
+DROP TABLE IF EXISTS teams;
+DROP TABLE IF EXISTS org_members;
+DROP TABLE IF EXISTS organizations;
+-- Note: SQLite doesn't support dropping columns easily; packages.org_id and tokens.org_id will remain if downgrading.
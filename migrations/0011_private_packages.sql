@@ -0,0 +1,10 @@
+-- +goose Up
+-- token_required now marks a package as private. It was written as 1 for
+-- every package but never enforced, so existing packages are reset to public
+-- to keep them visible; owners opt in to privacy explicitly from now on.
+UPDATE packages SET token_required = 0;
+
+CREATE INDEX IF NOT EXISTS idx_package_maintainers_user ON package_maintainers(user_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_package_maintainers_user;
@@ -0,0 +1,30 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS login_failures (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  username TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_login_failures_username ON login_failures(username, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_failures_ip ON login_failures(ip, created_at);
+
+ALTER TABLE users ADD COLUMN locked_until DATETIME;
+
+-- audit_log records security-relevant events that are not about a single
+-- token (those stay in token_audit).
+CREATE TABLE IF NOT EXISTS audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  action TEXT NOT NULL,
+  actor_user_id INTEGER,
+  target_type TEXT,
+  target_id INTEGER,
+  ip TEXT,
+  meta TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS login_failures;
+-- Note: SQLite doesn't support dropping columns easily; locked_until will remain if downgrading.
@@ -0,0 +1,21 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
+-- accounts that predate verification keep their publish rights
+UPDATE users SET email_verified_at = COALESCE(created_at, CURRENT_TIMESTAMP);
+
+-- single-use tokens mailed to users; purpose is 'verify' or 'reset'
+CREATE TABLE IF NOT EXISTS email_tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  purpose TEXT NOT NULL CHECK (purpose IN ('verify', 'reset')),
+  token_hash TEXT NOT NULL UNIQUE,
+  email TEXT NOT NULL,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_email_tokens_user ON email_tokens(user_id, purpose);
+
+-- +goose Down
+DROP TABLE IF EXISTS email_tokens;
+-- Note: SQLite doesn't support dropping columns easily; email_verified_at will remain if downgrading.
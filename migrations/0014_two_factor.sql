@@ -0,0 +1,23 @@
+-- +goose Up
+-- totp_secret is set when enrollment starts and totp_enabled_at once the
+-- first code has been confirmed. totp_last_counter is the last accepted time
+-- step, so a code cannot be used twice.
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME;
+ALTER TABLE users ADD COLUMN totp_last_counter INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at DATETIME,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
+
+-- members who can publish an org's packages must have 2FA enabled
+ALTER TABLE organizations ADD COLUMN require_2fa INTEGER NOT NULL DEFAULT 0;
+
+-- +goose Down
+DROP TABLE IF EXISTS recovery_codes;
+-- Note: SQLite doesn't support dropping columns easily; the totp_* and require_2fa columns will remain if downgrading.
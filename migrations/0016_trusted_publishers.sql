@@ -0,0 +1,20 @@
+-- +goose Up
+-- A trusted publisher lets CI workloads whose OIDC token comes from issuer and
+-- matches subject and/or repository exchange it for a short-lived publish
+-- token for the package. Empty subject or repository match anything, but at
+-- least one of them is always set.
+CREATE TABLE IF NOT EXISTS trusted_publishers (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  package_id INTEGER NOT NULL REFERENCES packages(id) ON DELETE CASCADE,
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL DEFAULT '',
+  repository TEXT NOT NULL DEFAULT '',
+  created_by INTEGER NOT NULL REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  CHECK (subject != '' OR repository != ''),
+  UNIQUE(package_id, issuer, subject, repository)
+);
+CREATE INDEX IF NOT EXISTS idx_trusted_publishers_issuer ON trusted_publishers(issuer);
+
+-- +goose Down
+DROP TABLE IF EXISTS trusted_publishers;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Suspended users cannot sign in and their tokens stop working. Deleted
+-- users are kept as anonymized rows so packages keep their creator and the
+-- username cannot be taken over.
+ALTER TABLE users ADD COLUMN suspended_at DATETIME;
+ALTER TABLE users ADD COLUMN suspended_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN deleted_at DATETIME;
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_users_role;
+-- Note: SQLite doesn't support dropping columns easily; suspended_at, suspended_reason and deleted_at will remain if downgrading.
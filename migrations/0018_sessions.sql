@@ -0,0 +1,14 @@
+-- +goose Up
+-- A session is a family of refresh tokens: each refresh rotates the token
+-- and the new one inherits family_id. user_agent, ip and last_used_at
+-- describe the latest refresh, for listing sessions.
+ALTER TABLE tokens ADD COLUMN family_id TEXT;
+ALTER TABLE tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN last_used_at DATETIME;
+UPDATE tokens SET family_id = token_hash, last_used_at = created_at WHERE scopes = 'refresh' AND revoked_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_tokens_family ON tokens(family_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_tokens_family;
+-- Note: SQLite doesn't support dropping columns easily; family_id, user_agent, ip and last_used_at will remain if downgrading.
@@ -0,0 +1,52 @@
+-- +goose Up
+-- Votes are -1 or +1; removing a vote deletes the row. Existing values are
+-- reduced to their sign.
+DELETE FROM votes WHERE value = 0;
+UPDATE votes SET value = CASE WHEN value > 0 THEN 1 ELSE -1 END WHERE value NOT IN (-1, 1);
+
+-- vote_score is vote_up - vote_down, kept by triggers like packages_fts
+ALTER TABLE packages ADD COLUMN vote_up INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE packages ADD COLUMN vote_down INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE packages ADD COLUMN vote_score INTEGER NOT NULL DEFAULT 0;
+UPDATE packages SET
+  vote_up = (SELECT COUNT(*) FROM votes v WHERE v.package_id = packages.id AND v.value = 1),
+  vote_down = (SELECT COUNT(*) FROM votes v WHERE v.package_id = packages.id AND v.value = -1);
+UPDATE packages SET vote_score = vote_up - vote_down;
+CREATE INDEX IF NOT EXISTS idx_packages_vote_score ON packages(vote_score);
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS votes_count_ai AFTER INSERT ON votes BEGIN
+  UPDATE packages SET
+    vote_up = vote_up + (new.value = 1),
+    vote_down = vote_down + (new.value = -1),
+    vote_score = vote_score + new.value
+  WHERE id = new.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS votes_count_au AFTER UPDATE OF value ON votes BEGIN
+  UPDATE packages SET
+    vote_up = vote_up - (old.value = 1) + (new.value = 1),
+    vote_down = vote_down - (old.value = -1) + (new.value = -1),
+    vote_score = vote_score - old.value + new.value
+  WHERE id = new.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS votes_count_ad AFTER DELETE ON votes BEGIN
+  UPDATE packages SET
+    vote_up = vote_up - (old.value = 1),
+    vote_down = vote_down - (old.value = -1),
+    vote_score = vote_score - old.value
+  WHERE id = old.package_id;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TRIGGER IF EXISTS votes_count_ad;
+DROP TRIGGER IF EXISTS votes_count_au;
+DROP TRIGGER IF EXISTS votes_count_ai;
+DROP INDEX IF EXISTS idx_packages_vote_score;
+-- Note: SQLite doesn't support dropping columns easily; vote_up, vote_down and vote_score will remain if downgrading.
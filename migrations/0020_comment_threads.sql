@@ -0,0 +1,36 @@
+-- +goose Up
+-- Replies point at their parent; root_id is the top-level comment of the
+-- thread, which carries the thread's lock. body_html is the rendered,
+-- sanitized Markdown. Deleted and hidden comments keep their row so replies
+-- stay attached.
+ALTER TABLE comments ADD COLUMN parent_id INTEGER REFERENCES comments(id);
+ALTER TABLE comments ADD COLUMN root_id INTEGER REFERENCES comments(id);
+ALTER TABLE comments ADD COLUMN body_html TEXT NOT NULL DEFAULT '';
+ALTER TABLE comments ADD COLUMN updated_at DATETIME;
+ALTER TABLE comments ADD COLUMN deleted_at DATETIME;
+ALTER TABLE comments ADD COLUMN deleted_by INTEGER REFERENCES users(id);
+ALTER TABLE comments ADD COLUMN hidden_at DATETIME;
+ALTER TABLE comments ADD COLUMN hidden_by INTEGER REFERENCES users(id);
+ALTER TABLE comments ADD COLUMN locked_at DATETIME;
+CREATE INDEX IF NOT EXISTS idx_comments_package ON comments(package_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_comments_root ON comments(root_id);
+
+-- versions referring to another package's release are dropped
+UPDATE comments SET package_version_id = NULL WHERE package_version_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM package_versions pv WHERE pv.id = comments.package_version_id AND pv.package_id = comments.package_id);
+
+-- previous bodies, one row per edit
+CREATE TABLE IF NOT EXISTS comment_edits (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  comment_id INTEGER NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+  body TEXT NOT NULL,
+  edited_by INTEGER REFERENCES users(id),
+  edited_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_comment_edits_comment ON comment_edits(comment_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS comment_edits;
+DROP INDEX IF EXISTS idx_comments_root;
+DROP INDEX IF EXISTS idx_comments_package;
+-- Note: SQLite doesn't support dropping columns easily; the parent_id, root_id, body_html, updated_at, deleted_*, hidden_* and locked_at columns will remain if downgrading.
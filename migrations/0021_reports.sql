@@ -0,0 +1,35 @@
+-- +goose Up
+-- User reports against a package, one of its versions or one of its
+-- comments. package_id is always set so the queue can show what a report is
+-- about and reports go away with the package. Reports on the same target are
+-- resolved together.
+CREATE TABLE IF NOT EXISTS reports (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  reporter_id INTEGER NOT NULL REFERENCES users(id),
+  package_id INTEGER NOT NULL REFERENCES packages(id) ON DELETE CASCADE,
+  target_type TEXT NOT NULL CHECK (target_type IN ('package', 'version', 'comment')),
+  target_id INTEGER NOT NULL,
+  reason TEXT NOT NULL CHECK (reason IN ('spam', 'malware', 'abuse', 'impersonation', 'other')),
+  details TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved')),
+  resolution TEXT CHECK (resolution IN ('dismissed', 'hidden', 'quarantined')),
+  resolution_note TEXT NOT NULL DEFAULT '',
+  resolved_by INTEGER REFERENCES users(id),
+  resolved_at DATETIME,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+-- one open report per reporter and target
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_open ON reports(reporter_id, target_type, target_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_reports_target ON reports(target_type, target_id);
+
+-- a quarantined package's artifacts are no longer served
+ALTER TABLE packages ADD COLUMN quarantined_at DATETIME;
+ALTER TABLE packages ADD COLUMN quarantine_reason TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_reports_target;
+DROP INDEX IF EXISTS idx_reports_status;
+DROP INDEX IF EXISTS idx_reports_open;
+DROP TABLE IF EXISTS reports;
+-- Note: SQLite doesn't support dropping columns easily; quarantined_at and quarantine_reason will remain if downgrading.
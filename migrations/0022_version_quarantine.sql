@@ -0,0 +1,12 @@
+-- +goose Up
+-- Versions can be quarantined on their own; a quarantined package covers all
+-- of its versions. quarantined_by records the admin for both.
+ALTER TABLE packages ADD COLUMN quarantined_by INTEGER REFERENCES users(id);
+ALTER TABLE package_versions ADD COLUMN quarantined_at DATETIME;
+ALTER TABLE package_versions ADD COLUMN quarantine_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE package_versions ADD COLUMN quarantined_by INTEGER REFERENCES users(id);
+CREATE INDEX IF NOT EXISTS idx_packages_quarantined ON packages(quarantined_at) WHERE quarantined_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_packages_quarantined;
+-- Note: SQLite doesn't support dropping columns easily; the quarantine columns will remain if downgrading.
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Daily download rollup, one row per artifact and UTC day. package_id and
+-- package_version_id are copied from the artifact so series for a package or
+-- version need no joins. clients is a HyperLogLog sketch (internal/hll) of
+-- the clients that downloaded that day; sketches of several rows merge into
+-- the distinct count over all of them.
+CREATE TABLE IF NOT EXISTS download_daily (
+  day TEXT NOT NULL,
+  artifact_id INTEGER NOT NULL REFERENCES artifacts(id) ON DELETE CASCADE,
+  package_version_id INTEGER NOT NULL REFERENCES package_versions(id) ON DELETE CASCADE,
+  package_id INTEGER NOT NULL REFERENCES packages(id) ON DELETE CASCADE,
+  downloads INTEGER NOT NULL DEFAULT 0,
+  clients BLOB,
+  PRIMARY KEY (day, artifact_id)
+);
+CREATE INDEX IF NOT EXISTS idx_download_daily_package ON download_daily(package_id, day);
+CREATE INDEX IF NOT EXISTS idx_download_daily_version ON download_daily(package_version_id, day);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_download_daily_version;
+DROP INDEX IF EXISTS idx_download_daily_package;
+DROP TABLE IF EXISTS download_daily;
@@ -0,0 +1,64 @@
+-- +goose Up
+-- registry_events is the log of changes to packages, in order. payload is
+-- the JSON document sent to webhooks for the event.
+CREATE TABLE IF NOT EXISTS registry_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  event TEXT NOT NULL,
+  package_id INTEGER REFERENCES packages(id) ON DELETE SET NULL,
+  payload TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_registry_events_package ON registry_events(package_id, id);
+
+-- A webhook watches one package, every package of an org, or (site admins
+-- only) the whole registry when both are NULL. events is a comma-separated
+-- list of event names.
+CREATE TABLE IF NOT EXISTS webhooks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  owner_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  package_id INTEGER REFERENCES packages(id) ON DELETE CASCADE,
+  org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT NOT NULL,
+  active INTEGER NOT NULL DEFAULT 1,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  CHECK (package_id IS NULL OR org_id IS NULL)
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_package ON webhooks(package_id);
+CREATE INDEX IF NOT EXISTS idx_webhooks_org ON webhooks(org_id);
+
+-- One row per attempt series; redeliveries are new rows.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event_id INTEGER REFERENCES registry_events(id) ON DELETE SET NULL,
+  event TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  response_status INTEGER,
+  error TEXT NOT NULL DEFAULT '',
+  redelivery_of INTEGER REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  delivered_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
+
+-- yanked versions stay downloadable for existing lockfiles but are no
+-- longer resolved as latest
+ALTER TABLE package_versions ADD COLUMN yanked_at DATETIME;
+ALTER TABLE package_versions ADD COLUMN yank_reason TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_webhook_deliveries_webhook;
+DROP INDEX IF EXISTS idx_webhook_deliveries_due;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP INDEX IF EXISTS idx_webhooks_org;
+DROP INDEX IF EXISTS idx_webhooks_package;
+DROP TABLE IF EXISTS webhooks;
+DROP INDEX IF EXISTS idx_registry_events_package;
+DROP TABLE IF EXISTS registry_events;
+-- Note: SQLite doesn't support dropping columns easily; yanked_at and yank_reason will remain if downgrading.
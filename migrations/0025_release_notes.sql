@@ -0,0 +1,9 @@
+-- +goose Up
+-- Release notes are Markdown kept next to their rendered HTML, like package
+-- readmes. Maintainers may edit them after publishing.
+ALTER TABLE package_versions ADD COLUMN release_notes TEXT NOT NULL DEFAULT '';
+ALTER TABLE package_versions ADD COLUMN release_notes_html TEXT NOT NULL DEFAULT '';
+ALTER TABLE package_versions ADD COLUMN release_notes_updated_at DATETIME;
+
+-- +goose Down
+-- Note: SQLite doesn't support dropping columns easily; the release notes columns will remain if downgrading.
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Failed logins older than the counting window are pruned as new ones come
+-- in; this index keeps that cheap.
+CREATE INDEX IF NOT EXISTS idx_login_failures_created ON login_failures(created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_login_failures_created;
@@ -1,34 +1,86 @@
+let SEARCH_FILTERS = {};
+
+// authHeaders sends the access token on reads too: private packages are
+// only visible to callers who can read them
+function authHeaders() {
+  return ACCESS_TOKEN ? { 'Authorization': 'Bearer ' + ACCESS_TOKEN } : {};
+}
+
 async function search() {
   const qel = document.getElementById('q');
   const q = qel ? qel.value : '';
-  const res = await fetch('/search?q=' + encodeURIComponent(q));
+  const sortEl = document.getElementById('sort');
+  const params = new URLSearchParams({ q });
+  if (sortEl && sortEl.value) params.set('sort', sortEl.value);
+  Object.keys(SEARCH_FILTERS).forEach(k => params.set(k, SEARCH_FILTERS[k]));
+  const res = await fetch('/search?' + params.toString(), { headers: authHeaders() });
   const data = await res.json();
   const out = document.getElementById('results');
   out.innerHTML = '';
+  if (data.corrected) {
+    const note = document.createElement('div');
+    note.className = 'search-note';
+    note.innerText = 'No exact matches; showing similar results.';
+    out.appendChild(note);
+  }
   (data.results || []).forEach(p => {
     const el = document.createElement('div');
     el.className = 'pkg';
-    el.innerHTML = `<strong>${p.name}</strong> — ${p.description || ''} <button data-id='${p.id}'>View</button>`;
+    // name_highlight and snippet are HTML-escaped by the server apart from <mark>
+    el.innerHTML = `<strong>${p.name_highlight || p.name}</strong> — ${p.snippet || p.description || ''} <button data-id='${p.id}'>View</button>`;
     out.appendChild(el);
     el.querySelector('button').onclick = () => viewPackage(p.id);
   });
+  renderFacets(data.facets || {});
+}
+
+function renderFacets(facets) {
+  const el = document.getElementById('facets');
+  if (!el) return;
+  el.innerHTML = '';
+  ['category', 'bucket', 'license'].forEach(kind => {
+    const items = facets[kind] || [];
+    if (!items.length && !SEARCH_FILTERS[kind]) return;
+    const group = document.createElement('div');
+    group.className = 'facet';
+    group.innerHTML = `<strong>${kind}</strong>`;
+    items.forEach(f => {
+      const value = kind === 'license' ? f.name : String(f.id);
+      const b = document.createElement('button');
+      b.innerText = `${f.name} (${f.count})`;
+      if (SEARCH_FILTERS[kind] === value) b.className = 'active';
+      b.onclick = () => {
+        if (SEARCH_FILTERS[kind] === value) delete SEARCH_FILTERS[kind]; else SEARCH_FILTERS[kind] = value;
+        search();
+      };
+      group.appendChild(b);
+    });
+    el.appendChild(group);
+  });
 }
 
 async function viewPackage(id) {
-  const res = await fetch('/packages/' + id);
+  const res = await fetch('/packages/' + id, { headers: authHeaders() });
   const data = await res.json();
   document.getElementById('packageView').style.display = 'block';
   document.getElementById('pkgName').innerText = data.package.name;
   document.getElementById('pkgDesc').innerText = data.package.description || '';
+  renderPackageMeta(data.package);
+  const banner = document.getElementById('pkgQuarantine');
+  if (banner) {
+    banner.style.display = data.package.quarantined_at ? '' : 'none';
+    banner.innerText = data.package.quarantined_at ? `This package has been quarantined by the registry administrators: ${data.package.quarantine_reason}. Its files cannot be downloaded.` : '';
+  }
 
   // load versions
-  const vers = await fetch('/packages/' + id + '/versions');
+  const vers = await fetch('/packages/' + id + '/versions', { headers: authHeaders() });
   const vdata = await vers.json();
   const vlist = document.getElementById('versions');
   vlist.innerHTML = '';
   (vdata.versions || []).forEach(v => {
     const li = document.createElement('li');
-    li.innerHTML = `${v.version} — <button data-ver='${v.version}'>Select</button>`;
+    li.innerHTML = `${v.version}${v.quarantined ? ' <span class="quarantine-tag">quarantined</span>' : ''}${v.yanked ? ' <span class="quarantine-tag">yanked</span>' : ''}${v.is_deprecated ? ' <span class="version-tag">deprecated</span>' : ''} — <button data-ver='${v.version}'>Select</button>`;
+    if (v.quarantined) li.title = v.quarantine_reason;
     vlist.appendChild(li);
     li.querySelector('button').onclick = () => selectVersion(id, v.version);
   });
@@ -36,6 +88,137 @@ async function viewPackage(id) {
   // attach publish
   const btnPub = document.getElementById('btnPublish');
   if (btnPub) btnPub.onclick = () => publishVersion(id);
+
+  CURRENT_PACKAGE_ID = id;
+  loadComments(id);
+}
+
+let CURRENT_PACKAGE_ID = null;
+
+async function loadComments(pkgID) {
+  const el = document.getElementById('comments');
+  if (!el) return;
+  const res = await fetch(`/packages/${pkgID}/comments`, { headers: authHeaders() });
+  if (!res.ok) return;
+  const data = await res.json();
+  el.innerHTML = '';
+  (data.comments || []).forEach(cm => el.appendChild(renderComment(pkgID, cm)));
+}
+
+function renderComment(pkgID, cm) {
+  const el = document.createElement('div');
+  el.className = 'comment';
+  const head = document.createElement('div');
+  head.className = 'comment-head';
+  head.innerText = `${cm.username} — ${new Date(cm.created_at).toLocaleString()}${cm.updated_at ? ' (edited)' : ''}${cm.locked ? ' — locked' : ''}`;
+  el.appendChild(head);
+  const body = document.createElement('div');
+  body.className = 'comment-body';
+  if (cm.deleted) body.innerText = '[deleted]';
+  else if (cm.hidden && !cm.body_html) body.innerText = '[hidden by a moderator]';
+  // body_html is sanitized by the server
+  else body.innerHTML = cm.body_html;
+  el.appendChild(body);
+  if (ACCESS_TOKEN && !cm.deleted && !cm.hidden) {
+    const actions = document.createElement('div');
+    actions.className = 'comment-actions';
+    const add = (label, fn) => { const b = document.createElement('button'); b.innerText = label; b.onclick = fn; actions.appendChild(b); };
+    if (!cm.locked) add('Reply', () => {
+      const text = prompt('Reply');
+      if (text) postComment(pkgID, { body: text, parent_id: cm.id });
+    });
+    if (cm.username === CURRENT_USERNAME && !cm.locked) add('Edit', async () => {
+      const text = prompt('Edit comment', cm.body);
+      if (!text || text === cm.body) return;
+      await commentRequest(pkgID, cm.id, 'PATCH', { body: text });
+    });
+    add('Delete', async () => {
+      if (confirm('Delete this comment?')) await commentRequest(pkgID, cm.id, 'DELETE');
+    });
+    if (cm.username !== CURRENT_USERNAME) add('Report', () => fileReport(pkgID, { comment_id: cm.id }));
+    el.appendChild(actions);
+  }
+  (cm.replies || []).forEach(r => el.appendChild(renderComment(pkgID, r)));
+  return el;
+}
+
+async function fileReport(pkgID, target) {
+  const reason = prompt('Reason: spam, malware, abuse, impersonation or other', 'spam');
+  if (!reason) return;
+  const details = prompt('Details (optional)') || '';
+  const r = await fetch(`/packages/${pkgID}/reports`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json', 'Authorization': ACCESS_TOKEN ? 'Bearer ' + ACCESS_TOKEN : '' },
+    body: JSON.stringify(Object.assign({ reason, details }, target))
+  });
+  alert(r.ok ? 'Thanks, the report was sent to the moderators.' : await r.text());
+}
+
+async function postComment(pkgID, payload) {
+  const r = await fetch(`/packages/${pkgID}/comments`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json', 'Authorization': ACCESS_TOKEN ? 'Bearer ' + ACCESS_TOKEN : '' },
+    body: JSON.stringify(payload)
+  });
+  if (!r.ok) { alert(await r.text()); return false }
+  loadComments(pkgID);
+  return true;
+}
+
+async function commentRequest(pkgID, commentID, method, payload) {
+  const r = await fetch(`/packages/${pkgID}/comments/${commentID}`, {
+    method,
+    headers: { 'Content-Type': 'application/json', 'Authorization': ACCESS_TOKEN ? 'Bearer ' + ACCESS_TOKEN : '' },
+    body: payload ? JSON.stringify(payload) : undefined
+  });
+  if (!r.ok) alert(await r.text());
+  loadComments(pkgID);
+}
+
+function renderPackageMeta(pkg) {
+  const meta = document.getElementById('pkgMeta');
+  if (meta) {
+    meta.innerHTML = '';
+    const parts = [];
+    if (pkg.license) parts.push('License: ' + pkg.license);
+    if ((pkg.keywords || []).length) parts.push('Keywords: ' + pkg.keywords.join(', '));
+    meta.innerText = parts.join(' · ');
+    [['homepage', pkg.homepage], ['repository', pkg.repository_url]].forEach(([label, url]) => {
+      if (!url) return;
+      const a = document.createElement('a');
+      a.href = url; a.innerText = label; a.rel = 'nofollow noopener';
+      meta.appendChild(document.createTextNode(' '));
+      meta.appendChild(a);
+    });
+  }
+  // readme_html is rendered and sanitized by the server
+  const readme = document.getElementById('pkgReadme');
+  if (readme) readme.innerHTML = pkg.readme_html || '';
+  const fields = { editDesc: pkg.description, editHomepage: pkg.homepage, editRepo: pkg.repository_url, editLicense: pkg.license, editKeywords: (pkg.keywords || []).join(', '), editReadme: pkg.readme };
+  Object.keys(fields).forEach(id => { const el = document.getElementById(id); if (el) el.value = fields[id] || ''; });
+  const btnSave = document.getElementById('btnSavePackage');
+  if (btnSave) btnSave.onclick = () => savePackage(pkg.id);
+}
+
+async function savePackage(pkgID) {
+  const val = id => document.getElementById(id).value;
+  const body = {
+    description: val('editDesc'),
+    homepage: val('editHomepage'),
+    repository_url: val('editRepo'),
+    license: val('editLicense'),
+    keywords: val('editKeywords').split(',').map(k => k.trim()).filter(Boolean),
+    readme: val('editReadme')
+  };
+  const res = await fetch(`/packages/${pkgID}`, {
+    method: 'PATCH',
+    headers: { 'Content-Type': 'application/json', 'Authorization': ACCESS_TOKEN ? 'Bearer ' + ACCESS_TOKEN : '' },
+    body: JSON.stringify(body)
+  });
+  const data = await res.json();
+  if (!res.ok) { alert(JSON.stringify(data)); return }
+  document.getElementById('pkgDesc').innerText = data.package.description || '';
+  renderPackageMeta(data.package);
 }
 
 let selectedVersion = null;
@@ -45,15 +228,19 @@ let CSRF_TOKEN = null;
 
 async function selectVersion(pkgID, ver) {
   selectedVersion = ver;
-  const res = await fetch(`/packages/${pkgID}/versions/${encodeURIComponent(ver)}`);
+  const res = await fetch(`/packages/${pkgID}/versions/${encodeURIComponent(ver)}`, { headers: authHeaders() });
   const data = await res.json();
-  const arts = await fetch(`/packages/${pkgID}/versions/${encodeURIComponent(ver)}/artifacts`);
+  // release_notes_html is sanitized by the server
+  document.getElementById('releaseNotes').innerHTML = (data.version && data.version.release_notes_html) || '<em>No release notes.</em>';
+  document.getElementById('editReleaseNotes').value = (data.version && data.version.release_notes) || '';
+  document.getElementById('btnSaveReleaseNotes').onclick = () => saveReleaseNotes(pkgID, ver);
+  const arts = await fetch(`/packages/${pkgID}/versions/${encodeURIComponent(ver)}/artifacts`, { headers: authHeaders() });
   const adata = await arts.json();
   const al = document.getElementById('artifacts');
   al.innerHTML = '';
   (adata.artifacts || []).forEach(a => {
     const li = document.createElement('li');
-    li.innerHTML = `<a href='/artifacts/${a.id}/download'>${a.filename || a.blob_url}</a> (${a.size_bytes || 0})`;
+    li.innerHTML = `<a href='/artifacts/${a.id}/download'>${a.filename || a.blob_url || 'artifact ' + a.id}</a> (${a.size_bytes || 0})`;
     al.appendChild(li);
   });
 }
@@ -61,6 +248,7 @@ async function selectVersion(pkgID, ver) {
 async function publishVersion(pkgID) {
   const ver = document.getElementById('newVersion').value;
   const metadata = document.getElementById('newMetadata').value;
+  const release_notes = document.getElementById('newReleaseNotes').value;
   const token = ACCESS_TOKEN;
   const res = await fetch(`/packages/${pkgID}/versions`, {
     method: 'POST',
@@ -68,12 +256,26 @@ async function publishVersion(pkgID) {
       'Content-Type': 'application/json',
       'Authorization': token ? 'Bearer ' + token : ''
     },
-    body: JSON.stringify({ version: ver, metadata })
+    body: JSON.stringify({ version: ver, metadata, release_notes })
   });
   const data = await res.json();
   alert(JSON.stringify(data));
 }
 
+async function saveReleaseNotes(pkgID, ver) {
+  const res = await fetch(`/packages/${pkgID}/versions/${encodeURIComponent(ver)}`, {
+    method: 'PATCH',
+    headers: {
+      'Content-Type': 'application/json',
+      'Authorization': ACCESS_TOKEN ? 'Bearer ' + ACCESS_TOKEN : ''
+    },
+    body: JSON.stringify({ release_notes: document.getElementById('editReleaseNotes').value })
+  });
+  const data = await res.json();
+  if (!res.ok) { alert(data.error || 'failed'); return; }
+  document.getElementById('releaseNotes').innerHTML = data.release_notes_html || '<em>No release notes.</em>';
+}
+
 async function addArtifact(pkgID) {
   if (!selectedVersion) { alert('select a version'); return }
   const blob = document.getElementById('artifactBlob').value;
@@ -92,25 +294,22 @@ async function addArtifact(pkgID) {
 if (document.getElementById('btnSearch')) document.getElementById('btnSearch').onclick = search;
 if (document.getElementById('btnAddArtifact')) document.getElementById('btnAddArtifact').onclick = () => {
   const name = document.getElementById('pkgName').innerText;
-  fetch('/search?q=' + encodeURIComponent(name)).then(r=>r.json()).then(d=>{
+  fetch('/search?q=' + encodeURIComponent(name), { headers: authHeaders() }).then(r=>r.json()).then(d=>{
     const p = d.results && d.results[0];
     if (p) addArtifact(p.id);
   });
 };
 
 if (document.getElementById('btnComment')) document.getElementById('btnComment').onclick = async () => {
-  const body = document.getElementById('commentBody').value;
-  const name = document.getElementById('pkgName').innerText;
-  const res = await fetch('/search?q=' + encodeURIComponent(name));
-  const d = await res.json();
-  const p = d.results && d.results[0];
-  if (!p) { alert('package not found'); return }
-  const r = await fetch(`/packages/${p.id}/comments`, {
-    method: 'POST',
-    headers: { 'Content-Type': 'application/json', 'Authorization': ACCESS_TOKEN ? 'Bearer ' + ACCESS_TOKEN : '' },
-    body: JSON.stringify({ body })
-  });
-  alert(await r.text());
+  const input = document.getElementById('commentBody');
+  if (!CURRENT_PACKAGE_ID) { alert('package not found'); return }
+  if (await postComment(CURRENT_PACKAGE_ID, { body: input.value })) input.value = '';
+};
+
+if (document.getElementById('btnReportPackage')) document.getElementById('btnReportPackage').onclick = () => {
+  if (!CURRENT_PACKAGE_ID) return;
+  // a selected version narrows the report to it
+  fileReport(CURRENT_PACKAGE_ID, selectedVersion ? { version: selectedVersion } : {});
 };
 
 async function registerUser() {
@@ -166,6 +365,20 @@ async function loginWithCredentials(username, password) {
   });
   let data = null;
   try { data = await res.json(); } catch (e) { data = null }
+  if (res.ok && data && data.mfa_required) return completeMFA(data.mfa_token);
+  return { ok: res.ok, status: res.status, data };
+}
+
+// second step for accounts with 2FA: a TOTP or recovery code
+async function completeMFA(mfaToken) {
+  const code = window.prompt('Authentication code (or recovery code)');
+  if (!code) return { ok: false, status: 401, data: { error: 'authentication code required' } };
+  const res = await fetch('/login/mfa', {
+    method: 'POST', headers: {'Content-Type':'application/json'},
+    body: JSON.stringify({ mfa_token: mfaToken, code })
+  });
+  let data = null;
+  try { data = await res.json(); } catch (e) { data = null }
   return { ok: res.ok, status: res.status, data };
 }
 
@@ -179,15 +392,100 @@ function getCookie(name) {
 async function createPackage() {
   const name = document.getElementById('newPkgName') ? document.getElementById('newPkgName').value : '';
   const description = document.getElementById('newPkgDesc') ? document.getElementById('newPkgDesc').value : '';
+  const isPrivate = document.getElementById('newPkgPrivate') ? document.getElementById('newPkgPrivate').checked : false;
   const token = ACCESS_TOKEN;
   const res = await fetch('/packages', {
     method: 'POST', headers: { 'Content-Type': 'application/json', 'Authorization': token ? 'Bearer ' + token : '' },
-    body: JSON.stringify({ name, description })
+    body: JSON.stringify({ name, description, private: isPrivate })
   });
   const data = await res.json();
   const el = document.getElementById('createPackageResult'); if (el) el.innerText = JSON.stringify(data);
 }
 
+async function postJSON(url, body) {
+  const res = await fetch(url, { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify(body) });
+  let data = null;
+  try { data = await res.json(); } catch (e) { data = null }
+  return { ok: res.ok, status: res.status, data };
+}
+
+async function forgotPassword() {
+  const email = document.getElementById('forgotEmail').value;
+  const r = await postJSON('/password/forgot', { email });
+  document.getElementById('forgotResult').innerText = r.data ? (r.data.status || r.data.error) : 'request failed';
+}
+
+async function resetPassword(token) {
+  const password = document.getElementById('resetPasswordInput').value;
+  const r = await postJSON('/password/reset', { token, password });
+  document.getElementById('resetResult').innerText = r.data ? (r.data.status || r.data.error) : 'request failed';
+}
+
+// account.html handles the links mailed for verification and password reset
+function initAccountPage() {
+  const params = new URLSearchParams(window.location.search);
+  const verify = params.get('verify');
+  const reset = params.get('reset');
+  if (verify) {
+    document.getElementById('verifyEmail').style.display = '';
+    document.getElementById('forgotPassword').style.display = 'none';
+    postJSON('/verify-email', { token: verify }).then(r => {
+      document.getElementById('verifyResult').innerText = r.ok ? 'Your email address is verified.' : (r.data && r.data.error) || 'verification failed';
+    });
+  }
+  if (reset) {
+    document.getElementById('resetPassword').style.display = '';
+    document.getElementById('forgotPassword').style.display = 'none';
+    document.getElementById('btnReset').onclick = () => resetPassword(reset);
+  }
+  document.getElementById('btnForgot').onclick = forgotPassword;
+  if (!verify && !reset) loadSessions();
+}
+
+// the sessions list needs a signed-in browser; the refresh cookie provides
+// the access token
+async function loadSessions() {
+  if (!ACCESS_TOKEN) {
+    const r = await fetch('/refresh', { method: 'POST', credentials: 'same-origin', headers: { 'X-CSRF-Token': CSRF_TOKEN || getCookie('ebuild_csrf') || '' } });
+    if (!r.ok) return;
+    const j = await r.json();
+    ACCESS_TOKEN = j.token;
+    CSRF_TOKEN = j.csrf || CSRF_TOKEN;
+  }
+  const res = await fetch('/me/sessions', { headers: { 'Authorization': 'Bearer ' + ACCESS_TOKEN } });
+  if (!res.ok) return;
+  const data = await res.json();
+  document.getElementById('sessions').style.display = '';
+  const list = document.getElementById('sessionList');
+  list.innerHTML = '';
+  (data.sessions || []).forEach(s => {
+    const el = document.createElement('div');
+    el.className = 'session';
+    const seen = s.last_used_at ? new Date(s.last_used_at).toLocaleString() : 'never';
+    el.innerText = `${s.user_agent || 'unknown device'} — ${s.ip || 'unknown address'} — last active ${seen}${s.current ? ' (this browser)' : ''}`;
+    const b = document.createElement('button');
+    b.innerText = 'Revoke';
+    b.onclick = () => revokeSession(s.id, s.current);
+    el.appendChild(b);
+    list.appendChild(el);
+  });
+  document.getElementById('btnSignOutEverywhere').onclick = signOutEverywhere;
+}
+
+async function revokeSession(id, current) {
+  await fetch('/me/sessions/' + encodeURIComponent(id), { method: 'DELETE', credentials: 'same-origin', headers: { 'Authorization': 'Bearer ' + ACCESS_TOKEN } });
+  if (current) { window.location = '/'; return; }
+  loadSessions();
+}
+
+async function signOutEverywhere() {
+  if (!confirm('Sign out of every browser, including this one?')) return;
+  await fetch('/me/sessions', { method: 'DELETE', credentials: 'same-origin', headers: { 'Authorization': 'Bearer ' + ACCESS_TOKEN } });
+  ACCESS_TOKEN = null; CURRENT_USERNAME = null;
+  window.location = '/';
+}
+if (document.getElementById('forgotPassword')) initAccountPage();
+
 if (document.getElementById('btnRegister')) document.getElementById('btnRegister').onclick = registerUser;
 if (document.getElementById('btnLogin')) document.getElementById('btnLogin').onclick = loginUser;
 if (document.getElementById('btnCreatePackage')) document.getElementById('btnCreatePackage').onclick = createPackage;
@@ -236,5 +534,18 @@ function renderAuthState() {
   });
 }
 
-renderAuthState();
+// single sign-on sends accounts with 2FA back with a challenge in the fragment
+async function resumeMFAFromFragment() {
+  const m = window.location.hash.match(/^#mfa_token=(.+)$/);
+  if (!m) return;
+  history.replaceState(null, '', window.location.pathname + window.location.search);
+  const result = await completeMFA(m[1]);
+  if (result && result.ok && result.data && result.data.token) {
+    ACCESS_TOKEN = result.data.token;
+    CURRENT_USERNAME = result.data.username || null;
+    CSRF_TOKEN = result.data.csrf || null;
+  }
+}
+
+resumeMFAFromFragment().then(renderAuthState);
 search();